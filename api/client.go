@@ -0,0 +1,383 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client calls the /v1 endpoints of the backend. Its fields may be changed until the first call.
+//
+// Calls that are safe to repeat are retried on network errors, 5xx, 408 and 429 with jittered
+// exponential backoff, waiting at least as long as Retry-After asks for. These are the reads,
+// cancellation, and submissions that carry an idempotency key. Every other call is attempted once.
+type Client struct {
+	// BaseURL is the backend's address, such as "http://backend:8080".
+	BaseURL string
+	// APIKey is sent as "Authorization: Bearer <key>" unless it is empty.
+	APIKey string
+	// WorkerID is sent as the Worker-ID header unless it is empty. Workers set it to the ID they
+	// registered with, so that their tasks are handed back if they die.
+	WorkerID string
+	HTTP     *http.Client
+	// Timeout bounds each attempt. Long polls get their wait on top of it.
+	Timeout time.Duration
+	// MaxRetries is the number of attempts after the first one.
+	MaxRetries int
+	// Backoff is the delay before the first retry. It doubles for every retry after that, up to
+	// MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// OnRetry, if set, is called before waiting delay to retry a failed call. attempt is the
+	// number of the attempt that failed, starting at 1.
+	OnRetry func(method, path string, attempt int, delay time.Duration, err error)
+}
+
+func NewClient(base_url, api_key string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(base_url, "/"),
+		APIKey:     api_key,
+		HTTP:       &http.Client{},
+		Timeout:    time.Second * 10,
+		MaxRetries: 5,
+		Backoff:    time.Millisecond * 100,
+		MaxBackoff: time.Second * 10,
+	}
+}
+
+// request describes one call for do.
+type request struct {
+	method string
+	path   string
+	body   any
+	header http.Header
+	// out receives the decoded body of a 2xx response. It may be nil.
+	out   any
+	retry bool
+	// extra_timeout is added to Client.Timeout, for long polls.
+	extra_timeout time.Duration
+}
+
+// do performs req and returns the response status code and header. A response with a status of
+// 400 or above is returned as *Error.
+func (client *Client) do(ctx context.Context, req request) (code int, header http.Header, err error) {
+	var body []byte
+	if req.body != nil {
+		body, err = json.Marshal(req.body)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		code, header, err = client.attempt(ctx, req, body)
+		switch {
+		case err == nil:
+			return code, header, nil
+		case ctx.Err() != nil:
+			return code, header, ctx.Err()
+		case !Retryable(err):
+			return code, header, err
+		}
+		if !req.retry || attempt >= client.MaxRetries {
+			return code, header, err
+		}
+		delay := min(client.MaxBackoff, client.Backoff<<min(attempt, 16))
+		delay = delay/2 + rand.N(delay/2+1)
+		api_err := &Error{}
+		if errors.As(err, &api_err) {
+			delay = max(delay, api_err.RetryAfter)
+		}
+		if client.OnRetry != nil {
+			client.OnRetry(req.method, req.path, attempt+1, delay, err)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return code, header, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Retryable reports whether a failed call may succeed if repeated: it failed on the network, or
+// with a 5xx, 408 or 429 response. The caller's own context ending is not checked.
+func Retryable(err error) bool {
+	api_err := &Error{}
+	if !errors.As(err, &api_err) {
+		return err != nil
+	}
+	return api_err.StatusCode >= 500 ||
+		api_err.StatusCode == http.StatusTooManyRequests ||
+		api_err.StatusCode == http.StatusRequestTimeout
+}
+
+func (client *Client) attempt(ctx context.Context, req request, body []byte) (int, http.Header, error) {
+	ctx, cancel := context.WithTimeout(ctx, client.Timeout+req.extra_timeout)
+	defer cancel()
+	var body_reader io.Reader
+	if body != nil {
+		body_reader = bytes.NewReader(body)
+	}
+	http_req, err := http.NewRequestWithContext(ctx, req.method, client.BaseURL+req.path, body_reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	for key, values := range req.header {
+		http_req.Header[key] = values
+	}
+	if body != nil {
+		http_req.Header.Set("Content-Type", "application/json")
+	}
+	if client.APIKey != "" {
+		http_req.Header.Set("Authorization", "Bearer "+client.APIKey)
+	}
+	if client.WorkerID != "" {
+		http_req.Header.Set("Worker-ID", client.WorkerID)
+	}
+	resp, err := client.HTTP.Do(http_req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, resp.Header, err
+	}
+	if resp.StatusCode >= 400 {
+		api_err := &Error{StatusCode: resp.StatusCode}
+		failure := ErrorResponse{}
+		if json.Unmarshal(data, &failure) == nil {
+			api_err.Code = failure.Error
+		}
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			api_err.RetryAfter = time.Second * time.Duration(seconds)
+		}
+		return resp.StatusCode, resp.Header, api_err
+	}
+	if req.out != nil && resp.StatusCode != http.StatusNoContent {
+		if err := json.Unmarshal(data, req.out); err != nil {
+			return resp.StatusCode, resp.Header, fmt.Errorf("%s %s: decode response: %w", req.method, req.path, err)
+		}
+	}
+	return resp.StatusCode, resp.Header, nil
+}
+
+// Submit creates a task. With a non-empty idempotency_key, the submission is retried, and replayed
+// reports whether the backend returned a task created by an earlier attempt.
+func (client *Client) Submit(ctx context.Context, payload *SubmitRequest, idempotency_key string) (id int64, replayed bool, err error) {
+	resp := &SubmitResponse{}
+	req := request{method: http.MethodPost, path: PREFIX + "/submit", body: payload, out: resp}
+	if idempotency_key != "" {
+		req.header = http.Header{"Idempotency-Key": {idempotency_key}}
+		req.retry = true
+	}
+	_, header, err := client.do(ctx, req)
+	if err != nil {
+		return -1, false, err
+	}
+	return resp.ID, header.Get("Idempotent-Replayed") == "true", nil
+}
+
+// SubmitBatch creates a task per payload. Items fail independently, so the error of each is in
+// its response.
+func (client *Client) SubmitBatch(ctx context.Context, payloads []SubmitRequest) ([]SubmitResponse, error) {
+	resp := []SubmitResponse{}
+	_, _, err := client.do(ctx, request{method: http.MethodPost, path: PREFIX + "/submit/batch", body: payloads, out: &resp})
+	return resp, err
+}
+
+func (client *Client) Status(ctx context.Context, id int64) (*StatusResponse, error) {
+	resp := &StatusResponse{}
+	_, _, err := client.do(ctx, request{method: http.MethodGet, path: fmt.Sprintf(PREFIX+"/status/%d", id), out: resp, retry: true})
+	return resp, err
+}
+
+// Cancel withdraws a task. Cancelling a cancelled task succeeds, so it is retried.
+func (client *Client) Cancel(ctx context.Context, id int64) (*CancelResponse, error) {
+	resp := &CancelResponse{}
+	_, _, err := client.do(ctx, request{method: http.MethodPost, path: fmt.Sprintf(PREFIX+"/tasks/%d/cancel", id), out: resp, retry: true})
+	return resp, err
+}
+
+func (client *Client) Deliveries(ctx context.Context, id int64) (*DeliveriesResponse, error) {
+	resp := &DeliveriesResponse{}
+	_, _, err := client.do(ctx, request{method: http.MethodGet, path: fmt.Sprintf(PREFIX+"/tasks/%d/deliveries", id), out: resp, retry: true})
+	return resp, err
+}
+
+// ListTasks calls GET /tasks with query as its filters.
+func (client *Client) ListTasks(ctx context.Context, query url.Values) (*TaskListing, error) {
+	resp := &TaskListing{}
+	_, _, err := client.do(ctx, request{method: http.MethodGet, path: PREFIX + "/tasks?" + query.Encode(), out: resp, retry: true})
+	return resp, err
+}
+
+// Pending takes a task, waiting up to wait for one. It returns nil without an error if none
+// arrived in time. It is not retried: a task handed out in a response that was lost is only given
+// back if the backend noticed.
+func (client *Client) Pending(ctx context.Context, wait time.Duration) (*PendingTask, error) {
+	resp := &PendingTask{}
+	code, _, err := client.do(ctx, request{
+		method:        http.MethodGet,
+		path:          PREFIX + "/pending?wait=" + wait.String(),
+		out:           resp,
+		extra_timeout: wait,
+	})
+	if err != nil || code == http.StatusNoContent {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// PendingBatch is Pending for up to max tasks. Only the first task is waited for.
+func (client *Client) PendingBatch(ctx context.Context, max int, wait time.Duration) ([]PendingTask, error) {
+	resp := []PendingTask{}
+	code, _, err := client.do(ctx, request{
+		method:        http.MethodGet,
+		path:          fmt.Sprintf(PREFIX+"/pending?max=%d&wait=%s", max, wait),
+		out:           &resp,
+		extra_timeout: wait,
+	})
+	if err != nil || code == http.StatusNoContent {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Processed commits a task's output. It is not retried, since the backend only accepts the output
+// of a task once.
+func (client *Client) Processed(ctx context.Context, payload *ProcessedRequest) error {
+	_, _, err := client.do(ctx, request{method: http.MethodPost, path: PREFIX + "/processed", body: payload})
+	return err
+}
+
+// ProcessedBatch is Processed for many tasks. Items fail independently, so the error of each is in
+// its response.
+func (client *Client) ProcessedBatch(ctx context.Context, payloads []ProcessedRequest) ([]ProcessedResponse, error) {
+	resp := []ProcessedResponse{}
+	_, _, err := client.do(ctx, request{method: http.MethodPost, path: PREFIX + "/processed/batch", body: payloads, out: &resp})
+	return resp, err
+}
+
+// RegisterWorker registers a worker. It is retried, since registering twice only hands back the
+// tasks of the first registration, which has none yet.
+func (client *Client) RegisterWorker(ctx context.Context, payload *RegisterWorkerRequest) (*WorkerResponse, error) {
+	resp := &WorkerResponse{}
+	_, _, err := client.do(ctx, request{method: http.MethodPost, path: PREFIX + "/workers", body: payload, out: resp, retry: true})
+	return resp, err
+}
+
+// Heartbeat reports that the worker id is alive. It is not retried: the next heartbeat is due soon
+// anyway. It fails with UNKNOWN_WORKER once the backend forgot the worker, which must then register
+// again.
+func (client *Client) Heartbeat(ctx context.Context, id string, payload *HeartbeatRequest) error {
+	_, _, err := client.do(ctx, request{method: http.MethodPost, path: PREFIX + "/workers/" + url.PathEscape(id) + "/heartbeat", body: payload})
+	return err
+}
+
+// Release hands back tasks the worker id will not commit. It is retried, since handing back a task
+// twice, or one that is no longer the worker's, changes nothing.
+func (client *Client) Release(ctx context.Context, id string, payload *ReleaseRequest) error {
+	_, _, err := client.do(ctx, request{method: http.MethodPost, path: PREFIX + "/workers/" + url.PathEscape(id) + "/release", body: payload, retry: true})
+	return err
+}
+
+// DeregisterWorker removes the worker id, handing back any task it still holds.
+func (client *Client) DeregisterWorker(ctx context.Context, id string) error {
+	_, _, err := client.do(ctx, request{method: http.MethodDelete, path: PREFIX + "/workers/" + url.PathEscape(id), retry: true})
+	return err
+}
+
+func (client *Client) ListWorkers(ctx context.Context) (*WorkerListing, error) {
+	resp := &WorkerListing{}
+	_, _, err := client.do(ctx, request{method: http.MethodGet, path: PREFIX + "/workers", out: resp, retry: true})
+	return resp, err
+}
+
+// PendingCount returns the length of the pending queue, which the autoscaler scales on. Its
+// endpoint is internal to the deployment and so not versioned.
+func (client *Client) PendingCount(ctx context.Context) (int, error) {
+	var count int
+	_, _, err := client.do(ctx, request{method: http.MethodGet, path: "/__SUPER_DUPER_SECRET_PENDING_COUNT__", out: &count, retry: true})
+	return count, err
+}
+
+// EventStream reads the events of GET /tasks/{id}/events or GET /events.
+type EventStream struct {
+	body    io.ReadCloser
+	scanner *bufio.Scanner
+}
+
+// Events opens a stream of status changes for ids, of which there must be at least one. The stream
+// is not reconnected when it breaks; reopening it starts with the current status of every task
+// again.
+func (client *Client) Events(ctx context.Context, ids ...int64) (*EventStream, error) {
+	if len(ids) == 0 {
+		return nil, errors.New("events: no task IDs")
+	}
+	path := fmt.Sprintf(PREFIX+"/tasks/%d/events", ids[0])
+	if len(ids) > 1 {
+		strs := make([]string, len(ids))
+		for i, id := range ids {
+			strs[i] = strconv.FormatInt(id, 10)
+		}
+		path = PREFIX + "/events?ids=" + strings.Join(strs, ",")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, client.BaseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if client.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+client.APIKey)
+	}
+	resp, err := client.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		api_err := &Error{StatusCode: resp.StatusCode}
+		failure := ErrorResponse{}
+		if json.NewDecoder(resp.Body).Decode(&failure) == nil {
+			api_err.Code = failure.Error
+		}
+		return nil, api_err
+	}
+	return &EventStream{body: resp.Body, scanner: bufio.NewScanner(resp.Body)}, nil
+}
+
+// Next blocks until the next event. It returns io.EOF once the backend ended the stream, which it
+// does after every task reached a terminal status.
+func (stream *EventStream) Next() (TaskEvent, error) {
+	for stream.scanner.Scan() {
+		data, ok := strings.CutPrefix(stream.scanner.Text(), "data: ")
+		if !ok {
+			// Event names, keepalive comments and the blank lines between events.
+			continue
+		}
+		event := TaskEvent{}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return TaskEvent{}, fmt.Errorf("decode event: %w", err)
+		}
+		return event, nil
+	}
+	if err := stream.scanner.Err(); err != nil {
+		return TaskEvent{}, err
+	}
+	return TaskEvent{}, io.EOF
+}
+
+func (stream *EventStream) Close() error {
+	return stream.body.Close()
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func new_test_client(t *testing.T, handler http.HandlerFunc) *Client {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	client := NewClient(server.URL, "secret")
+	client.Backoff = time.Millisecond
+	client.MaxRetries = 3
+	return client
+}
+
+func TestClientRetriesOnlyWhatIsSafeToRepeat(t *testing.T) {
+	attempts := 0
+	client := new_test_client(t, func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("Got Authorization: %q", r.Header.Get("Authorization"))
+		}
+		if attempts < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"id":-1,"error":"Overloaded"}`)
+			return
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		fmt.Fprint(w, `{"id":7,"error":""}`)
+	})
+
+	retried := []int{}
+	client.OnRetry = func(method, path string, attempt int, delay time.Duration, err error) {
+		if method != http.MethodPost || path != PREFIX+"/submit" || !errors.Is(err, OVERLOADED) {
+			t.Errorf("Got: OnRetry(%s, %s, %d, %s, %v)", method, path, attempt, delay, err)
+		}
+		retried = append(retried, attempt)
+	}
+	id, replayed, err := client.Submit(context.Background(), &SubmitRequest{Data: "a"}, "key")
+	if err != nil || id != 7 || !replayed || attempts != 3 {
+		t.Fatalf("Got: %d, %v, %v after %d attempts\nWant: 7, true, <nil> after 3 attempts", id, replayed, err, attempts)
+	}
+	if len(retried) != 2 || retried[1] != 2 {
+		t.Fatalf("Got: OnRetry after attempts %v\nWant: [1 2]", retried)
+	}
+	client.OnRetry = nil
+
+	// Without an idempotency key, a retry could create a duplicate task
+	attempts = 0
+	_, _, err = client.Submit(context.Background(), &SubmitRequest{Data: "a"}, "")
+	if !errors.Is(err, OVERLOADED) || attempts != 1 {
+		t.Fatalf("Got: %v after %d attempts\nWant: %v after 1 attempt", err, attempts, OVERLOADED)
+	}
+	api_err := &Error{}
+	if !errors.As(err, &api_err) || api_err.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Got: %#v", err)
+	}
+}
+
+func TestClientReturnsTypedErrors(t *testing.T) {
+	attempts := 0
+	client := new_test_client(t, func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusGone)
+		fmt.Fprint(w, `{"id":-1,"status":"","error":"Task_Expired"}`)
+	})
+	_, err := client.Status(context.Background(), 3)
+	if !errors.Is(err, TASK_EXPIRED) || errors.Is(err, UNKNOWN_TASK) {
+		t.Fatalf("Got: %v\nWant: %v", err, TASK_EXPIRED)
+	}
+	// A client error does not go away by retrying
+	if attempts != 1 {
+		t.Fatalf("Got: %d attempts\nWant: 1", attempts)
+	}
+}
+
+func TestClientPendingTimesOutWithoutError(t *testing.T) {
+	client := new_test_client(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("wait") != "1s" {
+			t.Errorf("Got wait: %q", r.URL.Query().Get("wait"))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	task, err := client.Pending(context.Background(), time.Second)
+	if task != nil || err != nil {
+		t.Fatalf("Got: %v, %v\nWant: <nil>, <nil>", task, err)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	client := new_test_client(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != PREFIX+"/events" || r.URL.Query().Get("ids") != "1,2" {
+			t.Errorf("Got: %s", r.URL)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: status\ndata: {\"id\":1,\"status\":\"PENDING\",\"error\":\"\"}\n\n")
+		fmt.Fprint(w, ": keepalive\n\n")
+		fmt.Fprint(w, "event: status\ndata: {\"id\":2,\"status\":\"\",\"error\":\"Unknown_Task\"}\n\n")
+	})
+	stream, err := client.Events(context.Background(), 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	want := []TaskEvent{{ID: 1, Status: STATUS_PENDING}, {ID: 2, Error: UNKNOWN_TASK}}
+	for _, w := range want {
+		if event, err := stream.Next(); err != nil || event != w {
+			t.Fatalf("Got: %+v, %v\nWant: %+v, <nil>", event, err, w)
+		}
+	}
+	if _, err := stream.Next(); err != io.EOF {
+		t.Fatalf("Got: %v\nWant: %v", err, io.EOF)
+	}
+	if _, err := client.Events(context.Background()); err == nil {
+		t.Fatal("Opened a stream without task IDs")
+	}
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestClientMatchesDocument calls every Client method against a server that only knows the routes
+// in the document, and checks that each request is one the document describes.
+func TestClientMatchesDocument(t *testing.T) {
+	// Decoded from JSON, as anything that fetched GET /v1/openapi.json would see it.
+	doc := Document{}
+	data, err := json.Marshal(OpenAPI())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	called := map[string]bool{}
+	mux := http.NewServeMux()
+	for i := range Routes {
+		route := &Routes[i]
+		mux.HandleFunc(route.Pattern(), func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			called[route.Pattern()] = true
+			mu.Unlock()
+			body, _ := io.ReadAll(r.Body)
+			if err := doc.ValidateRequest(route, body); err != nil {
+				t.Errorf("%s: %v\n%s", route.Pattern(), err, body)
+			}
+			if err := validate_query(route, r.URL.Query()); err != nil {
+				t.Errorf("%s: %v", route.Pattern(), err)
+			}
+
+			// Reply with the zero value of the response, which must itself match the document.
+			response := route.Response
+			if alternatives, ok := response.(OneOf); ok {
+				response = alternatives[0]
+				if r.URL.Query().Has("max") {
+					response = alternatives[1]
+				}
+			}
+			data, _ := json.Marshal(response)
+			if route.Stream {
+				w.Header().Set("Content-Type", "text/event-stream")
+				data = fmt.Appendf(nil, "event: status\ndata: %s\n\n", data)
+			}
+			if err := doc.ValidateResponse(route, http.StatusOK, data); err != nil {
+				t.Errorf("%s: %v\n%s", route.Pattern(), err, data)
+			}
+			w.Write(data)
+		})
+	}
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	client := NewClient(server.URL, "secret")
+	client.MaxRetries = 0
+	client.WorkerID = "w"
+
+	ctx := context.Background()
+	calls := []func() error{
+		func() error { _, _, err := client.Submit(ctx, &SubmitRequest{Data: "a"}, "key"); return err },
+		func() error { _, err := client.SubmitBatch(ctx, []SubmitRequest{{Data: "a"}}); return err },
+		func() error { _, err := client.Status(ctx, 1); return err },
+		func() error { _, err := client.Cancel(ctx, 1); return err },
+		func() error { _, err := client.Deliveries(ctx, 1); return err },
+		func() error {
+			_, err := client.ListTasks(ctx, url.Values{"status": {STATUS_PENDING}, "limit": {"10"}, "sort": {"-id"}})
+			return err
+		},
+		func() error { _, err := client.Pending(ctx, time.Second); return err },
+		func() error { _, err := client.PendingBatch(ctx, 2, time.Second); return err },
+		func() error { return client.Processed(ctx, &ProcessedRequest{ID: 1, Output: []string{"a"}}) },
+		func() error { _, err := client.ProcessedBatch(ctx, []ProcessedRequest{{ID: 1}}); return err },
+		func() error {
+			_, err := client.RegisterWorker(ctx, &RegisterWorkerRequest{ID: "w", Capabilities: []string{"batch"}})
+			return err
+		},
+		func() error { return client.Heartbeat(ctx, "w", &HeartbeatRequest{Tasks: []int64{1}}) },
+		func() error { return client.Release(ctx, "w", &ReleaseRequest{Tasks: []int64{1}}) },
+		func() error { return client.DeregisterWorker(ctx, "w") },
+		func() error { _, err := client.ListWorkers(ctx); return err },
+		func() error { return drain(client.Events(ctx, 1)) },
+		func() error { return drain(client.Events(ctx, 1, 2)) },
+	}
+	for i, call := range calls {
+		if err := call(); err != nil {
+			t.Errorf("Call %d: %v", i, err)
+		}
+	}
+
+	for i := range Routes {
+		route := &Routes[i]
+		if !called[route.Pattern()] && route.Path != "/openapi.json" {
+			t.Errorf("The client never calls %s", route.Pattern())
+		}
+	}
+}
+
+// validate_query checks that every query parameter is declared by route and has the declared type.
+func validate_query(route *Route, query url.Values) error {
+	for key, values := range query {
+		declared := false
+		for _, param := range route.Query {
+			if param.Name != key {
+				continue
+			}
+			declared = true
+			if _, err := strconv.Atoi(values[0]); param.Type == "integer" && err != nil {
+				return fmt.Errorf("?%s=%s is not an integer", key, values[0])
+			}
+		}
+		if !declared {
+			return fmt.Errorf("undeclared query parameter %s", key)
+		}
+	}
+	return nil
+}
+
+func drain(stream *EventStream, err error) error {
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	for {
+		if _, err := stream.Next(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func TestValidateRejectsDrift(t *testing.T) {
+	doc := OpenAPI()
+	route := &Routes[0]
+	tests := []struct {
+		name string
+		code int
+		body string
+	}{
+		{"missing field", 200, `{"id":1}`},
+		{"undeclared field", 200, `{"id":1,"error":"","extra":true}`},
+		{"wrong type", 200, `{"id":"1","error":""}`},
+		{"unknown code", 200, `{"id":1,"error":"Whoops"}`},
+		{"code not sent with this status", 400, `{"error":"Task_Expired","message":""}`},
+		{"undocumented status", 404, `{"error":"Unknown_Task","message":""}`},
+	}
+	for _, tt := range tests {
+		if err := doc.ValidateResponse(route, tt.code, []byte(tt.body)); err == nil {
+			t.Errorf("%s: %s was accepted", tt.name, tt.body)
+		}
+	}
+	if err := doc.ValidateResponse(route, 429, []byte(`{"error":"Overloaded","message":"slow down"}`)); err != nil {
+		t.Error(err)
+	}
+}
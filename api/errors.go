@@ -0,0 +1,136 @@
+package api
+
+import (
+	"fmt"
+	"time"
+)
+
+// Code is the "error" field of a response. The empty Code means success.
+//
+// A Code is also an error, so that a failed call can be tested with errors.Is:
+//
+//	if errors.Is(err, api.TASK_CANCELLED) { ... }
+type Code string
+
+func (code Code) Error() string {
+	return string(code)
+}
+
+const (
+	MALFORMED_JSON            Code = "Malformed_JSON"
+	MALFORMED_ID              Code = "Malformed_ID"
+	MALFORMED_SCHEDULE        Code = "Malformed_Schedule"
+	MALFORMED_CALLBACK_URL    Code = "Malformed_Callback_URL"
+	MALFORMED_IDEMPOTENCY_KEY Code = "Malformed_Idempotency_Key"
+	MALFORMED_BATCH_SIZE      Code = "Malformed_Batch_Size"
+	MALFORMED_WAIT            Code = "Malformed_Wait"
+	MALFORMED_STATUS          Code = "Malformed_Status"
+	MALFORMED_TIME            Code = "Malformed_Time"
+	MALFORMED_PRIORITY        Code = "Malformed_Priority"
+	MALFORMED_LIMIT           Code = "Malformed_Limit"
+	MALFORMED_SORT            Code = "Malformed_Sort"
+	MALFORMED_CURSOR          Code = "Malformed_Cursor"
+	BATCH_TOO_LARGE           Code = "Batch_Too_Large"
+	// The key was already used for a submission with a different body.
+	IDEMPOTENCY_KEY_REUSED Code = "Idempotency_Key_Reused"
+	// callback_url was set while the backend has no WEBHOOK_SECRET.
+	WEBHOOKS_DISABLED Code = "Webhooks_Disabled"
+	// The ID was never handed out.
+	UNKNOWN_TASK Code = "Unknown_Task"
+	// The task existed but was evicted after its retention.
+	TASK_EXPIRED Code = "Task_Expired"
+	// The task was cancelled, so its output is discarded.
+	TASK_CANCELLED Code = "Task_Cancelled"
+	// The task already finished, so it cannot be cancelled.
+	TASK_FINISHED Code = "Task_Finished"
+	// The task's offloaded output could not be read.
+	OUTPUT_UNAVAILABLE Code = "Output_Unavailable"
+	// Admission control rejected a submission. Retry after the Retry-After header.
+	OVERLOADED   Code = "Overloaded"
+	RATE_LIMITED Code = "Rate_Limited"
+	// The API key is missing or unknown.
+	UNAUTHENTICATED Code = "Unauthenticated"
+	// The API key's role is not allowed on the endpoint, or the worker ID was registered with
+	// another key.
+	FORBIDDEN Code = "Forbidden"
+	// No /v1 endpoint has the requested path.
+	ROUTE_NOT_FOUND Code = "Route_Not_Found"
+	// The worker was declared dead and its tasks handed to others, so its output is discarded.
+	TASK_REASSIGNED     Code = "Task_Reassigned"
+	MALFORMED_WORKER_ID Code = "Malformed_Worker_ID"
+	// No live worker is registered under the ID. The worker should register again.
+	UNKNOWN_WORKER Code = "Unknown_Worker"
+	// No registered worker handles the submitted task type.
+	UNKNOWN_TASK_TYPE   Code = "Unknown_Task_Type"
+	MALFORMED_TASK_TYPE Code = "Malformed_Task_Type"
+	MALFORMED_SLOTS     Code = "Malformed_Slots"
+	MALFORMED_TIMEOUT   Code = "Malformed_Timeout"
+	// The committed input differs from the task's, so the output cannot be the task's.
+	INPUT_MISMATCH Code = "Input_Mismatch"
+)
+
+// messages are the human-readable explanations /v1 sends along with each Code. Only the codes are
+// stable; messages may be reworded at any time.
+var messages = map[Code]string{
+	MALFORMED_JSON:            "The request body is not valid JSON for this endpoint.",
+	MALFORMED_ID:              "Task IDs are non-negative integers.",
+	MALFORMED_SCHEDULE:        "delay_ms must be between 0 and 30 days, run_at must be RFC 3339, and at most one of them may be set.",
+	MALFORMED_CALLBACK_URL:    "callback_url must be an absolute http or https URL.",
+	MALFORMED_IDEMPOTENCY_KEY: "The Idempotency-Key header and the key field disagree.",
+	MALFORMED_BATCH_SIZE:      "max must be a positive integer no larger than the maximum batch size.",
+	MALFORMED_WAIT:            "wait must be a positive Go duration no longer than the maximum long poll.",
+	MALFORMED_STATUS:          "status must be a comma-separated list of task statuses.",
+	MALFORMED_TIME:            "Times must be RFC 3339.",
+	MALFORMED_PRIORITY:        "Priorities must be integers.",
+	MALFORMED_LIMIT:           "limit must be a positive integer no larger than the maximum page size.",
+	MALFORMED_SORT:            "sort must be id, submitted_at, started_at or priority, optionally prefixed with -.",
+	MALFORMED_CURSOR:          "cursor must be the next_cursor of a previous page with the same sort.",
+	BATCH_TOO_LARGE:           "The batch has more items than the maximum batch size.",
+	IDEMPOTENCY_KEY_REUSED:    "The idempotency key was already used for a submission with a different body.",
+	WEBHOOKS_DISABLED:         "The backend has no webhook secret, so callback_url cannot be used.",
+	UNKNOWN_TASK:              "No task was ever created with this ID.",
+	TASK_EXPIRED:              "The task was evicted after its retention period.",
+	TASK_CANCELLED:            "The task was cancelled, so its output was discarded.",
+	TASK_FINISHED:             "The task already finished, so it cannot be cancelled.",
+	OUTPUT_UNAVAILABLE:        "The task's output could not be read. Try again later.",
+	OVERLOADED:                "The backend is shedding load. Retry after the Retry-After header.",
+	RATE_LIMITED:              "Too many submissions from this client. Retry after the Retry-After header.",
+	UNAUTHENTICATED:           "Send a valid API key as \"Authorization: Bearer <key>\".",
+	FORBIDDEN:                 "The API key's role may not call this endpoint, or the worker ID was registered by another key.",
+	ROUTE_NOT_FOUND:           "No endpoint has this method and path.",
+	TASK_REASSIGNED:           "The task was handed to another worker after this one missed its heartbeats, so this output was discarded.",
+	MALFORMED_WORKER_ID:       "Worker IDs are 1 to 128 characters without whitespace.",
+	UNKNOWN_WORKER:            "No live worker is registered with this ID. Register again.",
+	UNKNOWN_TASK_TYPE:         "No registered worker handles this task type.",
+	MALFORMED_TASK_TYPE:       "Task types are 1 to 64 lowercase letters, digits, '-', '_' or '.'.",
+	MALFORMED_SLOTS:           "Slots must be between 0 and 1024.",
+	MALFORMED_TIMEOUT:         "timeout_ms must be between 0 and 86400000, a day.",
+	INPUT_MISMATCH:            "The input sent along with the output is not the task's input.",
+}
+
+// Message returns the human-readable explanation of code, or "" for an unknown code.
+func (code Code) Message() string {
+	return messages[code]
+}
+
+// Error is a failed response.
+type Error struct {
+	// Code is empty when the response did not carry one, such as a 404 for an unknown route.
+	Code       Code
+	StatusCode int
+	// RetryAfter is the Retry-After header, or 0 if there was none.
+	RetryAfter time.Duration
+}
+
+func (err *Error) Error() string {
+	if err.Code == "" {
+		return fmt.Sprintf("backend replied %d", err.StatusCode)
+	}
+	return fmt.Sprintf("backend replied %d %s", err.StatusCode, err.Code)
+}
+
+// Is reports whether target is err's Code.
+func (err *Error) Is(target error) bool {
+	code, ok := target.(Code)
+	return ok && code == err.Code
+}
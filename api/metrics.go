@@ -0,0 +1,262 @@
+package api
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// This file implements just enough of the Prometheus text exposition format (version 0.0.4) for
+// the backend's and the worker's own metrics, so that no client library has to be vendored.
+
+// Registry renders every metric registered with it, in registration order.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+func (registry *Registry) register(m metric) {
+	registry.mu.Lock()
+	registry.metrics = append(registry.metrics, m)
+	registry.mu.Unlock()
+}
+
+func (registry *Registry) Render(w io.Writer) error {
+	registry.mu.Lock()
+	metrics := slices.Clone(registry.metrics)
+	registry.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// series holds the values of one metric family, keyed by its label values joined with
+// label_separator.
+type series[T any] struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]*T
+}
+
+const label_separator = "\xff"
+
+func (s *series[T]) get(label_values []string, init func() *T) *T {
+	if len(label_values) != len(s.labels) {
+		panic(s.name + ": wrong number of label values")
+	}
+	key := strings.Join(label_values, label_separator)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[key]
+	if !ok {
+		v = init()
+		s.values[key] = v
+	}
+	return v
+}
+
+// each calls fn for every label combination in a stable order. fn runs with s.mu held.
+func (s *series[T]) each(w *bufio.Writer, fn func(label_values []string, v *T)) {
+	w.WriteString("# HELP " + s.name + " " + s.help + "\n")
+	w.WriteString("# TYPE " + s.name + " " + s.kind + "\n")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		var label_values []string
+		if len(s.labels) > 0 {
+			label_values = strings.Split(key, label_separator)
+		}
+		fn(label_values, s.values[key])
+	}
+}
+
+// CounterVec is a monotonically increasing value per label combination.
+type CounterVec struct {
+	series[float64]
+}
+
+func NewCounterVec(registry *Registry, name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{series[float64]{name: name, help: help, kind: "counter", labels: labels, values: map[string]*float64{}}}
+	registry.register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(label_values ...string) {
+	c.Add(1, label_values...)
+}
+
+func (c *CounterVec) Add(delta float64, label_values ...string) {
+	v := c.get(label_values, func() *float64 { return new(float64) })
+	c.mu.Lock()
+	*v += delta
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.each(w, func(label_values []string, v *float64) {
+		write_sample(w, c.name, c.labels, label_values, "", "", *v)
+	})
+}
+
+// GaugeVec is a value per label combination that can go up and down.
+type GaugeVec struct {
+	CounterVec
+}
+
+func NewGaugeVec(registry *Registry, name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{CounterVec{series[float64]{name: name, help: help, kind: "gauge", labels: labels, values: map[string]*float64{}}}}
+	registry.register(g)
+	return g
+}
+
+func (g *GaugeVec) Dec(label_values ...string) {
+	g.Add(-1, label_values...)
+}
+
+// GaugeFunc is a gauge whose values are computed at scrape time. collect returns one value per
+// label combination, keyed by the label values joined with label_separator.
+type GaugeFunc struct {
+	name    string
+	help    string
+	labels  []string
+	collect func() map[string]float64
+}
+
+func NewGaugeFunc(registry *Registry, name, help string, labels []string, collect func() map[string]float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, labels: labels, collect: collect}
+	registry.register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	w.WriteString("# HELP " + g.name + " " + g.help + "\n")
+	w.WriteString("# TYPE " + g.name + " gauge\n")
+	values := g.collect()
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		var label_values []string
+		if len(g.labels) > 0 {
+			label_values = strings.Split(key, label_separator)
+		}
+		write_sample(w, g.name, g.labels, label_values, "", "", values[key])
+	}
+}
+
+// HistogramVec counts observations into cumulative buckets per label combination.
+type HistogramVec struct {
+	series[histogram]
+	buckets []float64
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewHistogramVec(registry *Registry, name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		series:  series[histogram]{name: name, help: help, kind: "histogram", labels: labels, values: map[string]*histogram{}},
+		buckets: buckets,
+	}
+	registry.register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(v float64, label_values ...string) {
+	hist := h.get(label_values, func() *histogram { return &histogram{counts: make([]uint64, len(h.buckets))} })
+	h.mu.Lock()
+	// Buckets are stored non-cumulatively and summed up when written.
+	if i, _ := slices.BinarySearch(h.buckets, v); i < len(h.buckets) {
+		hist.counts[i]++
+	}
+	hist.count++
+	hist.sum += v
+	h.mu.Unlock()
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.each(w, func(label_values []string, hist *histogram) {
+		cumulative := uint64(0)
+		for i, upper := range h.buckets {
+			cumulative += hist.counts[i]
+			write_sample(w, h.name+"_bucket", h.labels, label_values, "le", format_float(upper), float64(cumulative))
+		}
+		write_sample(w, h.name+"_bucket", h.labels, label_values, "le", "+Inf", float64(hist.count))
+		write_sample(w, h.name+"_sum", h.labels, label_values, "", "", hist.sum)
+		write_sample(w, h.name+"_count", h.labels, label_values, "", "", float64(hist.count))
+	})
+}
+
+// ExponentialBuckets returns count upper bounds starting at start, each factor times the last.
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// write_sample writes one line. extra_label is appended after the metric's own labels, which is
+// how histograms add "le".
+func write_sample(w *bufio.Writer, name string, labels, label_values []string, extra_label, extra_value string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extra_label != "" {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(label + `="` + escape_label_value(label_values[i]) + `"`)
+		}
+		if extra_label != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extra_label + `="` + extra_value + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(format_float(v))
+	w.WriteByte('\n')
+}
+
+var label_value_escaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escape_label_value(s string) string {
+	return label_value_escaper.Replace(s)
+}
+
+func format_float(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegistryRendersExpositionFormat(t *testing.T) {
+	registry := &Registry{}
+	counter := NewCounterVec(registry, "test_requests_total", "Requests.", "route")
+	histogram := NewHistogramVec(registry, "test_seconds", "Latency.", []float64{0.1, 1})
+	counter.Inc(`GET /status/{id}`)
+	counter.Add(2, "quote\"and\\slash\n")
+	for _, v := range []float64{0.05, 0.1, 0.5, 3} {
+		histogram.Observe(v)
+	}
+
+	got := &strings.Builder{}
+	if err := registry.Render(got); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"# HELP test_requests_total Requests.",
+		"# TYPE test_requests_total counter",
+		`test_requests_total{route="GET /status/{id}"} 1`,
+		`test_requests_total{route="quote\"and\\slash\n"} 2`,
+		"# HELP test_seconds Latency.",
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{le="0.1"} 2`,
+		`test_seconds_bucket{le="1"} 3`,
+		`test_seconds_bucket{le="+Inf"} 4`,
+		"test_seconds_sum 3.65",
+		"test_seconds_count 4",
+		"",
+	}, "\n")
+	if got.String() != want {
+		t.Fatalf("Got:\n%s\nWant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,438 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Document is an OpenAPI 3.1 document, either as generated by OpenAPI or as decoded from JSON.
+type Document map[string]any
+
+// OpenAPI generates the document of Routes. The schemas are derived from the Go types by
+// reflection, so they cannot drift from what the backend and the Client encode.
+func OpenAPI() Document {
+	gen := &schema_generator{components: map[string]any{}}
+	paths := map[string]any{}
+	for i := range Routes {
+		route := &Routes[i]
+		item, ok := paths[route.Path].(map[string]any)
+		if !ok {
+			item = map[string]any{}
+			paths[route.Path] = item
+		}
+		item[strings.ToLower(route.Method)] = gen.operation(route)
+	}
+	// The empty Code is what successful responses carry.
+	codes := []any{""}
+	for code := range messages {
+		codes = append(codes, string(code))
+	}
+	slices.SortFunc(codes, func(a, b any) int { return strings.Compare(a.(string), b.(string)) })
+	gen.components["Code"] = map[string]any{
+		"type":        "string",
+		"enum":        codes,
+		"description": "Stable error code. The empty string means success.",
+	}
+	gen.schema(reflect.TypeFor[ErrorResponse]())
+	return Document{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":   "Task backend",
+			"version": strings.TrimPrefix(PREFIX, "/v"),
+		},
+		"servers": []any{map[string]any{"url": PREFIX}},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": gen.components,
+			"securitySchemes": map[string]any{
+				"bearer": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []any{map[string]any{"bearer": []any{}}},
+	}
+}
+
+type schema_generator struct {
+	// components holds the schema of every struct type by name. Structs are always referenced.
+	components map[string]any
+}
+
+func (gen *schema_generator) operation(route *Route) map[string]any {
+	parameters := []any{}
+	for _, segment := range strings.Split(route.Path, "/") {
+		if name, ok := strings.CutPrefix(segment, "{"); ok {
+			name = strings.TrimSuffix(name, "}")
+			kind := "string"
+			if name == "id" {
+				kind = "integer"
+			}
+			parameters = append(parameters, map[string]any{
+				"name":     name,
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]any{"type": kind},
+			})
+		}
+	}
+	for in, params := range map[string][]Param{"query": route.Query, "header": route.Header} {
+		for _, param := range params {
+			parameters = append(parameters, map[string]any{
+				"name":        param.Name,
+				"in":          in,
+				"description": param.Description,
+				"schema":      map[string]any{"type": param.Type},
+			})
+		}
+	}
+	slices.SortStableFunc(parameters, func(a, b any) int {
+		return strings.Compare(a.(map[string]any)["in"].(string), b.(map[string]any)["in"].(string))
+	})
+
+	responses := map[string]any{}
+	if route.Stream {
+		responses["200"] = map[string]any{
+			"description": "Server-sent events. The data of each is x-event-data.",
+			"content": map[string]any{
+				"text/event-stream": map[string]any{
+					"schema":       map[string]any{"type": "string"},
+					"x-event-data": gen.schema(reflect.TypeOf(route.Response)),
+				},
+			},
+		}
+	} else {
+		responses["200"] = map[string]any{
+			"description": "OK",
+			"content":     json_content(gen.response_schema(route.Response)),
+		}
+	}
+	if route.NoContent {
+		responses["204"] = map[string]any{"description": "No Content"}
+	}
+	errors := route.Errors
+	if !route.Public {
+		errors = map[int][]Code{
+			http.StatusUnauthorized: {UNAUTHENTICATED},
+			http.StatusForbidden:    {FORBIDDEN},
+		}
+		for code, codes := range route.Errors {
+			errors[code] = codes
+		}
+	}
+	for code, codes := range errors {
+		enum := []any{}
+		for _, error_code := range codes {
+			enum = append(enum, string(error_code))
+		}
+		responses[strconv.Itoa(code)] = map[string]any{
+			"description": http.StatusText(code),
+			"content": json_content(map[string]any{
+				"allOf": []any{
+					map[string]any{"$ref": "#/components/schemas/ErrorResponse"},
+					map[string]any{"properties": map[string]any{"error": map[string]any{"enum": enum}}},
+				},
+			}),
+		}
+	}
+
+	operation := map[string]any{
+		"summary":    route.Summary,
+		"parameters": parameters,
+		"responses":  responses,
+	}
+	if route.Request != nil {
+		operation["requestBody"] = map[string]any{
+			"required": true,
+			"content":  json_content(gen.request_schema(reflect.TypeOf(route.Request))),
+		}
+	}
+	if route.Public {
+		operation["security"] = []any{}
+	}
+	return operation
+}
+
+func (gen *schema_generator) response_schema(response any) map[string]any {
+	alternatives, ok := response.(OneOf)
+	if !ok {
+		return gen.schema(reflect.TypeOf(response))
+	}
+	schemas := []any{}
+	for _, alternative := range alternatives {
+		schemas = append(schemas, gen.schema(reflect.TypeOf(alternative)))
+	}
+	return map[string]any{"oneOf": schemas}
+}
+
+// request_schema is schema for a request body. The backend decodes a missing field as its zero
+// value, so no field of a request is required.
+func (gen *schema_generator) request_schema(t reflect.Type) map[string]any {
+	schema := gen.schema(t)
+	for t.Kind() == reflect.Slice || t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if component, ok := gen.components[t.Name()].(map[string]any); ok && t.Kind() == reflect.Struct {
+		component["required"] = []any{}
+	}
+	return schema
+}
+
+func json_content(schema map[string]any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+// schema returns the JSON schema of how encoding/json encodes t.
+func (gen *schema_generator) schema(t reflect.Type) map[string]any {
+	switch {
+	case t == reflect.TypeFor[json.RawMessage]():
+		return map[string]any{}
+	case t == reflect.TypeFor[Code]():
+		return map[string]any{"$ref": "#/components/schemas/Code"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return gen.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		// A nil slice encodes as null.
+		return map[string]any{"type": []any{"array", "null"}, "items": gen.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": []any{"object", "null"}, "additionalProperties": gen.schema(t.Elem())}
+	case reflect.Interface:
+		return map[string]any{}
+	case reflect.Struct:
+		ref := map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+		if _, done := gen.components[t.Name()]; done {
+			return ref
+		}
+		schema := map[string]any{"type": "object"}
+		// Registered before the fields so that a type referring to itself terminates.
+		gen.components[t.Name()] = schema
+		properties := map[string]any{}
+		required := []any{}
+		for i := range t.NumField() {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if !field.IsExported() || tag == "-" {
+				continue
+			}
+			name, options, _ := strings.Cut(tag, ",")
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = gen.schema(field.Type)
+			if !slices.Contains(strings.Split(options, ","), "omitempty") {
+				required = append(required, name)
+			}
+		}
+		schema["properties"] = properties
+		schema["required"] = required
+		return ref
+	}
+	panic(fmt.Sprintf("api: no JSON schema for %s", t))
+}
+
+// operation returns the operation of route in doc.
+func (doc Document) operation(route *Route) (map[string]any, error) {
+	paths, _ := doc["paths"].(map[string]any)
+	item, _ := paths[route.Path].(map[string]any)
+	operation, ok := item[strings.ToLower(route.Method)].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s is not in the document", route.Pattern())
+	}
+	return operation, nil
+}
+
+// ValidateRequest checks body against the request schema of route.
+func (doc Document) ValidateRequest(route *Route, body []byte) error {
+	operation, err := doc.operation(route)
+	if err != nil {
+		return err
+	}
+	request_body, ok := operation["requestBody"].(map[string]any)
+	if !ok {
+		if len(body) > 0 {
+			return fmt.Errorf("%s takes no body", route.Pattern())
+		}
+		return nil
+	}
+	return doc.validate_json(walk(request_body, "content", "application/json", "schema"), body)
+}
+
+// ValidateResponse checks a response of route with the given status code against the document.
+// For an event stream, the data of every event is checked.
+//
+// Validation is stricter than the document: properties that an object schema does not declare are
+// rejected, so that a field a response gained without its Go type is caught.
+func (doc Document) ValidateResponse(route *Route, code int, body []byte) error {
+	operation, err := doc.operation(route)
+	if err != nil {
+		return err
+	}
+	response, ok := walk(operation, "responses", strconv.Itoa(code)).(map[string]any)
+	if !ok {
+		return fmt.Errorf("%s does not reply %d", route.Pattern(), code)
+	}
+	content, ok := response["content"].(map[string]any)
+	if !ok {
+		if len(bytes.TrimSpace(body)) > 0 {
+			return fmt.Errorf("%s replies %d without a body", route.Pattern(), code)
+		}
+		return nil
+	}
+	if stream, ok := content["text/event-stream"].(map[string]any); ok {
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				if err := doc.validate_json(stream["x-event-data"], []byte(data)); err != nil {
+					return err
+				}
+			}
+		}
+		return scanner.Err()
+	}
+	return doc.validate_json(walk(content, "application/json", "schema"), body)
+}
+
+func (doc Document) validate_json(schema any, data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return err
+	}
+	schema_map, ok := schema.(map[string]any)
+	if !ok {
+		return fmt.Errorf("malformed schema: %v", schema)
+	}
+	return doc.validate(schema_map, value, "$")
+}
+
+// validate supports the subset of JSON schema that OpenAPI generates.
+func (doc Document) validate(schema map[string]any, value any, path string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		resolved, ok := walk(map[string]any(doc), "components", "schemas", name).(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: unresolved %s", path, ref)
+		}
+		return doc.validate(resolved, value, path)
+	}
+	for _, sub := range as_slice(schema["allOf"]) {
+		if err := doc.validate(sub.(map[string]any), value, path); err != nil {
+			return err
+		}
+	}
+	if alternatives, ok := schema["oneOf"].([]any); ok {
+		matches := 0
+		for _, sub := range alternatives {
+			if doc.validate(sub.(map[string]any), value, path) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fmt.Errorf("%s: matches %d of oneOf, want 1", path, matches)
+		}
+	}
+	if enum, ok := schema["enum"].([]any); ok && !slices.Contains(enum, value) {
+		return fmt.Errorf("%s: %v is not one of %v", path, value, enum)
+	}
+	if types, ok := schema["type"]; ok {
+		kind := json_kind(value)
+		if !slices.Contains(as_slice(types), any(kind)) && !(kind == "integer" && slices.Contains(as_slice(types), any("number"))) {
+			return fmt.Errorf("%s: got %s, want %v", path, kind, types)
+		}
+	}
+	switch value := value.(type) {
+	case map[string]any:
+		properties, _ := schema["properties"].(map[string]any)
+		for _, name := range as_slice(schema["required"]) {
+			if _, ok := value[name.(string)]; !ok {
+				return fmt.Errorf("%s: missing %s", path, name)
+			}
+		}
+		additional, _ := schema["additionalProperties"].(map[string]any)
+		for name, v := range value {
+			sub, ok := properties[name].(map[string]any)
+			switch {
+			case ok:
+			case additional != nil:
+				sub = additional
+			case schema["type"] == "object":
+				return fmt.Errorf("%s: undeclared property %s", path, name)
+			default:
+				continue
+			}
+			if err := doc.validate(sub, v, path+"."+name); err != nil {
+				return err
+			}
+		}
+	case []any:
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, v := range value {
+				if err := doc.validate(items, v, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func json_kind(value any) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if _, err := value.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// as_slice turns a schema keyword that is a single value or a list of values into a list.
+func as_slice(v any) []any {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case []any:
+		return v
+	default:
+		return []any{v}
+	}
+}
+
+// walk follows keys through nested maps, returning nil where one is missing.
+func walk(v any, keys ...string) any {
+	for _, key := range keys {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
@@ -0,0 +1,250 @@
+package api
+
+import "net/http"
+
+// PREFIX is prepended to the Path of every Route. The backend also serves the same endpoints
+// without it, with their pre-/v1 failure bodies, so that workers built before /v1 keep working
+// while a deployment rolls over. Upgrade the backend before anything that calls it.
+const PREFIX = "/v1"
+
+// Route describes one /v1 endpoint. Routes is what the OpenAPI document is generated from, and
+// what the contract tests hold the backend and the Client to.
+type Route struct {
+	Method string
+	// Path follows http.ServeMux pattern syntax and excludes PREFIX. {id} is a task ID, and
+	// {worker} a worker ID.
+	Path    string
+	Summary string
+	Query   []Param
+	// Header lists the request headers the endpoint reads, besides Authorization.
+	Header []Param
+	// Request is a value of the request body's type, or nil if there is no body.
+	Request any
+	// Response is a value of the 200 response body's type, or of the type of each event's data
+	// when Stream is set. OneOf lists alternatives.
+	Response any
+	Stream   bool
+	// NoContent is set when the endpoint may also reply 204 with no body.
+	NoContent bool
+	// Errors maps each failure status to the codes it is sent with. 401 and 403 are implied unless
+	// Public is set.
+	Errors map[int][]Code
+	Public bool
+}
+
+// Param is a query parameter or header.
+type Param struct {
+	Name string
+	// Type is a JSON schema type: "string", "integer" or "boolean".
+	Type        string
+	Description string
+}
+
+// OneOf is a Response that is one of several types, depending on the request.
+type OneOf []any
+
+// Pattern returns the http.ServeMux pattern of route, with PREFIX.
+func (route *Route) Pattern() string {
+	return route.Method + " " + PREFIX + route.Path
+}
+
+var Routes = []Route{
+	{
+		Method:  http.MethodPost,
+		Path:    "/submit",
+		Summary: "Submit a task.",
+		Header: []Param{
+			{"Idempotency-Key", "string", "Submissions with the same key return the task created by the first one instead of creating another."},
+		},
+		Request:  SubmitRequest{},
+		Response: SubmitResponse{},
+		Errors: map[int][]Code{
+			http.StatusBadRequest:          {MALFORMED_JSON, MALFORMED_SCHEDULE, MALFORMED_CALLBACK_URL, MALFORMED_IDEMPOTENCY_KEY, WEBHOOKS_DISABLED, UNKNOWN_TASK_TYPE, MALFORMED_TIMEOUT},
+			http.StatusUnprocessableEntity: {IDEMPOTENCY_KEY_REUSED},
+			http.StatusTooManyRequests:     {OVERLOADED, RATE_LIMITED},
+		},
+	},
+	{
+		Method:   http.MethodPost,
+		Path:     "/submit/batch",
+		Summary:  "Submit many tasks. Items fail independently, each with its own error.",
+		Request:  []SubmitRequest{},
+		Response: []SubmitResponse{},
+		Errors: map[int][]Code{
+			http.StatusBadRequest:            {MALFORMED_JSON},
+			http.StatusRequestEntityTooLarge: {BATCH_TOO_LARGE},
+			http.StatusTooManyRequests:       {RATE_LIMITED},
+		},
+	},
+	{
+		Method:   http.MethodGet,
+		Path:     "/status/{id}",
+		Summary:  "Get a task's status, and its output once it is finished.",
+		Response: StatusResponse{},
+		Errors: map[int][]Code{
+			http.StatusBadRequest:          {MALFORMED_ID, UNKNOWN_TASK},
+			http.StatusGone:                {TASK_EXPIRED},
+			http.StatusInternalServerError: {OUTPUT_UNAVAILABLE},
+		},
+	},
+	{
+		Method:  http.MethodGet,
+		Path:    "/pending",
+		Summary: "Take pending tasks of the types the worker registered with. They are PROCESSING from then on.",
+		Query: []Param{
+			{"max", "integer", "Take up to this many tasks and reply with an array. Without it, the reply is a single task."},
+			{"wait", "string", "Go duration to wait for a task before replying 204. Without it, the request waits until a task arrives."},
+		},
+		Header: []Param{
+			{"Worker-ID", "string", "ID the worker registered with. Tasks are handed back if that worker is declared dead."},
+		},
+		Response:  OneOf{PendingTask{}, []PendingTask{}},
+		NoContent: true,
+		Errors: map[int][]Code{
+			http.StatusBadRequest: {MALFORMED_BATCH_SIZE, MALFORMED_WAIT, UNKNOWN_WORKER},
+		},
+	},
+	{
+		Method:  http.MethodPost,
+		Path:    "/processed",
+		Summary: "Commit the output of a task taken from /pending, or report that it failed.",
+		Header: []Param{
+			{"Worker-ID", "string", "ID the worker registered with. Tasks are handed back if that worker is declared dead."},
+		},
+		Request:  ProcessedRequest{},
+		Response: ProcessedResponse{},
+		Errors: map[int][]Code{
+			http.StatusBadRequest: {MALFORMED_JSON, UNKNOWN_TASK, INPUT_MISMATCH},
+			http.StatusConflict:   {TASK_CANCELLED, TASK_REASSIGNED},
+		},
+	},
+	{
+		Method:  http.MethodPost,
+		Path:    "/processed/batch",
+		Summary: "Commit the output of many tasks. Items fail independently, each with its own error.",
+		Header: []Param{
+			{"Worker-ID", "string", "ID the worker registered with. Tasks are handed back if that worker is declared dead."},
+		},
+		Request:  []ProcessedRequest{},
+		Response: []ProcessedResponse{},
+		Errors: map[int][]Code{
+			http.StatusBadRequest: {MALFORMED_JSON},
+		},
+	},
+	{
+		Method:   http.MethodPost,
+		Path:     "/tasks/{id}/cancel",
+		Summary:  "Cancel a task that has not finished. Cancelling a cancelled task succeeds.",
+		Response: CancelResponse{},
+		Errors: map[int][]Code{
+			http.StatusBadRequest: {MALFORMED_ID, UNKNOWN_TASK},
+			http.StatusConflict:   {TASK_FINISHED},
+			http.StatusGone:       {TASK_EXPIRED},
+		},
+	},
+	{
+		Method:   http.MethodGet,
+		Path:     "/tasks/{id}/deliveries",
+		Summary:  "Get the webhook delivery log of a task.",
+		Response: DeliveriesResponse{},
+		Errors: map[int][]Code{
+			http.StatusBadRequest: {MALFORMED_ID, UNKNOWN_TASK},
+			http.StatusGone:       {TASK_EXPIRED},
+		},
+	},
+	{
+		Method:   http.MethodGet,
+		Path:     "/tasks/{id}/events",
+		Summary:  "Stream a task's status changes as server-sent events, starting with its current status.",
+		Response: TaskEvent{},
+		Stream:   true,
+		Errors: map[int][]Code{
+			http.StatusBadRequest: {MALFORMED_ID},
+		},
+	},
+	{
+		Method:  http.MethodGet,
+		Path:    "/events",
+		Summary: "Stream the status changes of many tasks as server-sent events.",
+		Query: []Param{
+			{"ids", "string", "Comma-separated task IDs."},
+		},
+		Response: TaskEvent{},
+		Stream:   true,
+		Errors: map[int][]Code{
+			http.StatusBadRequest: {MALFORMED_ID, BATCH_TOO_LARGE},
+		},
+	},
+	{
+		Method:  http.MethodGet,
+		Path:    "/tasks",
+		Summary: "List retained tasks, a page at a time.",
+		Query: []Param{
+			{"status", "string", "Comma-separated statuses to include."},
+			{"submitted_after", "string", "RFC 3339, exclusive."},
+			{"submitted_before", "string", "RFC 3339, exclusive."},
+			{"started_before", "string", "RFC 3339, exclusive. Tasks that never started do not match."},
+			{"min_priority", "integer", "Inclusive."},
+			{"max_priority", "integer", "Inclusive."},
+			{"sort", "string", "id, submitted_at, started_at or priority, prefixed with - for descending. Defaults to id."},
+			{"limit", "integer", "Page size."},
+			{"cursor", "string", "next_cursor of the previous page."},
+		},
+		Response: TaskListing{},
+		Errors: map[int][]Code{
+			http.StatusBadRequest: {MALFORMED_STATUS, MALFORMED_TIME, MALFORMED_PRIORITY, MALFORMED_LIMIT, MALFORMED_SORT, MALFORMED_CURSOR},
+		},
+	},
+	{
+		Method:   http.MethodPost,
+		Path:     "/workers",
+		Summary:  "Register a worker. Workers register on startup and then send heartbeats.",
+		Request:  RegisterWorkerRequest{},
+		Response: WorkerResponse{},
+		Errors: map[int][]Code{
+			http.StatusBadRequest: {MALFORMED_JSON, MALFORMED_WORKER_ID, MALFORMED_TASK_TYPE, MALFORMED_SLOTS},
+		},
+	},
+	{
+		Method:   http.MethodPost,
+		Path:     "/workers/{worker}/heartbeat",
+		Summary:  "Report that a worker is alive, and what it is doing.",
+		Request:  HeartbeatRequest{},
+		Response: WorkerResponse{},
+		Errors: map[int][]Code{
+			http.StatusBadRequest: {MALFORMED_JSON, UNKNOWN_WORKER},
+		},
+	},
+	{
+		Method:   http.MethodPost,
+		Path:     "/workers/{worker}/release",
+		Summary:  "Hand back tasks a worker will not commit, such as those cut short by its shutdown.",
+		Request:  ReleaseRequest{},
+		Response: WorkerResponse{},
+		Errors: map[int][]Code{
+			http.StatusBadRequest: {MALFORMED_JSON, UNKNOWN_WORKER},
+		},
+	},
+	{
+		Method:   http.MethodDelete,
+		Path:     "/workers/{worker}",
+		Summary:  "Deregister a worker that is shutting down. Tasks it still holds are handed back.",
+		Response: WorkerResponse{},
+		Errors: map[int][]Code{
+			http.StatusBadRequest: {UNKNOWN_WORKER},
+		},
+	},
+	{
+		Method:   http.MethodGet,
+		Path:     "/workers",
+		Summary:  "List registered workers, including recently dead ones.",
+		Response: WorkerListing{},
+	},
+	{
+		Method:   http.MethodGet,
+		Path:     "/openapi.json",
+		Summary:  "Get this document.",
+		Response: map[string]any{},
+		Public:   true,
+	},
+}
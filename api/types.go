@@ -0,0 +1,283 @@
+// Package api is the wire protocol of the backend: the request and response bodies of every
+// endpoint, the error codes they carry, and a Client for them. The backend, the worker, the
+// workload and the autoscaler all use it, so that the protocol is defined in one place.
+package api
+
+import "encoding/json"
+
+// Worker statuses.
+const (
+	WORKER_ALIVE = "ALIVE"
+	// A worker is DEAD once it missed enough heartbeats. Its tasks have been handed back, but it
+	// becomes ALIVE again if it resumes sending heartbeats.
+	WORKER_DEAD = "DEAD"
+)
+
+// Slot states. A slot is one of the tasks a worker processes at once.
+const (
+	// SLOT_IDLE slots are waiting for a task from GET /pending.
+	SLOT_IDLE       = "idle"
+	SLOT_COMPUTING  = "computing"
+	SLOT_COMMITTING = "committing"
+)
+
+// DEFAULT_TASK_TYPE is the type of tasks submitted without one. Every worker runs it, including
+// workers that predate task types, so it is accepted even while no registered worker lists it.
+const DEFAULT_TASK_TYPE = "substrings"
+
+// Task statuses.
+const (
+	STATUS_SCHEDULED  = "SCHEDULED"
+	STATUS_PENDING    = "PENDING"
+	STATUS_PROCESSING = "PROCESSING"
+	STATUS_FINISHED   = "FINISHED"
+	// A task is FAILED when its handler reported an error instead of an output. It is not retried.
+	STATUS_FAILED    = "FAILED"
+	STATUS_CANCELLED = "CANCELLED"
+)
+
+// Reasons a worker reports a task as failed.
+const (
+	// The handler returned an error, crashed, or replied with something that is not a result.
+	FAILURE_HANDLER_ERROR = "handler_error"
+	// The handler did not finish within the task's deadline.
+	FAILURE_DEADLINE_EXCEEDED = "deadline_exceeded"
+	// The worker has no handler for the task's type.
+	FAILURE_UNKNOWN_TYPE = "unknown_type"
+)
+
+// SubmitRequest is the body of POST /submit and one element of POST /submit/batch.
+type SubmitRequest struct {
+	Data string `json:"data"`
+	// Optional. Selects the handler that runs the task, defaulting to DEFAULT_TASK_TYPE. It must
+	// be one of the types registered workers list.
+	Type string `json:"type"`
+	// Optional. At most one of DelayMillisecond and RunAt may be set. DelayMillisecond is at most 30
+	// days. RunAt is RFC 3339.
+	DelayMillisecond int64  `json:"delay_ms"`
+	RunAt            string `json:"run_at"`
+	// Optional. Same as the Idempotency-Key header, for clients that cannot set headers.
+	Key string `json:"key"`
+	// Optional. Higher is more important. It does not affect the order tasks are handed out in,
+	// but lower priorities are rejected first while the backend sheds load.
+	Priority int `json:"priority"`
+	// Optional. Receives a signed POST with the result once the task is finished, failed or cancelled.
+	CallbackURL string `json:"callback_url"`
+	// Optional. How long the worker may compute the task before failing it with
+	// FAILURE_DEADLINE_EXCEEDED. Workers have a timeout of their own, and the shorter one applies.
+	TimeoutMillisecond int64 `json:"timeout_ms"`
+}
+
+// SubmitResponse is the response of POST /submit and one element of the response of POST
+// /submit/batch. ID is -1 on failure.
+type SubmitResponse struct {
+	ID    int64 `json:"id"`
+	Error Code  `json:"error"`
+}
+
+// StatusResponse is the response of GET /status/{id}.
+type StatusResponse struct {
+	ID int64 `json:"id"`
+	// Type is only set on success.
+	Type   string `json:"type,omitempty"`
+	Status string `json:"status"`
+	Input  string `json:"input"`
+	// Only set once the task is FINISHED.
+	Output []string `json:"output"`
+	// RFC 3339. Only set while the task is SCHEDULED.
+	RunAt string `json:"run_at,omitempty"`
+	// Only set once the task is FAILED.
+	Failure        string `json:"failure,omitempty"`
+	FailureMessage string `json:"failure_message,omitempty"`
+	Error          Code   `json:"error"`
+}
+
+// PendingTask is the response of GET /pending, or one element of it with ?max.
+type PendingTask struct {
+	ID int64 `json:"id"`
+	// Type is only set on success.
+	Type  string `json:"type,omitempty"`
+	Input string `json:"input"`
+	// TimeoutMillisecond is the submitter's SubmitRequest.TimeoutMillisecond, 0 if none was set.
+	TimeoutMillisecond int64 `json:"timeout_ms,omitempty"`
+	Error              Code  `json:"error,omitempty"`
+}
+
+// ProcessedRequest is the body of POST /processed and one element of POST /processed/batch.
+type ProcessedRequest struct {
+	ID     int64    `json:"id"`
+	Input  string   `json:"input"`
+	Output []string `json:"output"`
+	// Failure is one of the FAILURE_* reasons when the task could not be computed, in which case
+	// Output is ignored and the task becomes FAILED. FailureMessage is the handler's error.
+	Failure        string `json:"failure"`
+	FailureMessage string `json:"failure_message"`
+}
+
+// ProcessedResponse is the response of POST /processed and one element of the response of POST
+// /processed/batch.
+type ProcessedResponse struct {
+	ID    int64 `json:"id"`
+	Error Code  `json:"error"`
+}
+
+// CancelResponse is the response of POST /tasks/{id}/cancel.
+type CancelResponse struct {
+	ID     int64  `json:"id"`
+	Status string `json:"status"`
+	Error  Code   `json:"error"`
+}
+
+// DeliveryAttempt is one entry of a task's webhook delivery log.
+type DeliveryAttempt struct {
+	Attempt int    `json:"attempt"`
+	At      string `json:"at"`
+	// StatusCode is 0 when no response was received.
+	StatusCode     int    `json:"status_code"`
+	Error          string `json:"error"`
+	DurationMillis int64  `json:"duration_ms"`
+}
+
+// DeliveriesResponse is the response of GET /tasks/{id}/deliveries.
+type DeliveriesResponse struct {
+	ID          int64             `json:"id"`
+	CallbackURL string            `json:"callback_url"`
+	Deliveries  []DeliveryAttempt `json:"deliveries"`
+	Error       Code              `json:"error"`
+}
+
+// WebhookPayload is the body the backend POSTs to a task's callback URL. Output is only set for
+// FINISHED tasks.
+type WebhookPayload struct {
+	ID     int64           `json:"id"`
+	Status string          `json:"status"`
+	Output json.RawMessage `json:"output"`
+	// Only set for FAILED tasks.
+	Failure    string `json:"failure,omitempty"`
+	FinishedAt string `json:"finished_at"`
+}
+
+// TaskEvent is the data of one server-sent event on GET /tasks/{id}/events and GET /events.
+type TaskEvent struct {
+	ID     int64  `json:"id"`
+	Status string `json:"status"`
+	// Error is UNKNOWN_TASK or TASK_EXPIRED when the subscribed ID does not exist. No further
+	// events follow for that ID.
+	Error Code `json:"error"`
+}
+
+// TaskSummary is one element of GET /tasks. Timestamps are RFC 3339 and empty when unset.
+type TaskSummary struct {
+	ID          int64  `json:"id"`
+	Type        string `json:"type"`
+	Status      string `json:"status"`
+	Priority    int    `json:"priority"`
+	SubmittedAt string `json:"submitted_at"`
+	RunAt       string `json:"run_at"`
+	StartedAt   string `json:"started_at"`
+	FinishedAt  string `json:"finished_at"`
+}
+
+// TaskListing is the response of GET /tasks.
+type TaskListing struct {
+	Tasks []TaskSummary `json:"tasks"`
+	// NextCursor is passed back as ?cursor to fetch the following page. It is empty on the last page.
+	NextCursor string `json:"next_cursor"`
+	// Counts holds the number of tasks per status across every retained task, ignoring filters.
+	Counts map[string]int `json:"counts"`
+	Error  Code           `json:"error"`
+}
+
+// RegisterWorkerRequest is the body of POST /workers. Registering an ID that is already registered
+// is taken to mean the worker restarted: the tasks its previous run held are handed back.
+type RegisterWorkerRequest struct {
+	ID string `json:"id"`
+	// Types are the task types the worker has handlers for. GET /pending only hands the worker
+	// tasks of these types. Empty means DEFAULT_TASK_TYPE only.
+	Types []string `json:"types"`
+	// Capabilities are free-form labels describing the worker, such as "batch". They are only
+	// reported by GET /workers.
+	Capabilities []string `json:"capabilities"`
+	// Slots is how many tasks the worker processes at once. 0 means 1.
+	Slots int `json:"slots"`
+}
+
+// WorkerResponse is the response of POST /workers, POST /workers/{worker}/heartbeat and DELETE
+// /workers/{worker}.
+type WorkerResponse struct {
+	ID string `json:"id"`
+	// HeartbeatIntervalMillisecond is how often the backend expects a heartbeat. A worker is
+	// declared dead after missing a few in a row.
+	HeartbeatIntervalMillisecond int64 `json:"heartbeat_interval_ms"`
+	Error                        Code  `json:"error"`
+}
+
+// HeartbeatRequest is the body of POST /workers/{worker}/heartbeat.
+type HeartbeatRequest struct {
+	// Tasks are the IDs of the tasks the worker is processing.
+	Tasks []int64     `json:"tasks"`
+	Stats WorkerStats `json:"stats"`
+	// Slots has one element per slot. Stats is their sum.
+	Slots []SlotStats `json:"slots"`
+}
+
+// ReleaseRequest is the body of POST /workers/{worker}/release.
+type ReleaseRequest struct {
+	// Tasks are the IDs of tasks the worker took from /pending and will not commit.
+	Tasks []int64 `json:"tasks"`
+}
+
+// SlotStats describe one slot of a worker.
+type SlotStats struct {
+	Slot  int    `json:"slot"`
+	State string `json:"state"`
+	// BusyMillisecond is the time the slot spent outside SLOT_IDLE since the worker started.
+	BusyMillisecond int64       `json:"busy_ms"`
+	Stats           WorkerStats `json:"stats"`
+}
+
+// WorkerStats are counters since the worker started.
+type WorkerStats struct {
+	TasksProcessed int64 `json:"tasks_processed"`
+	// TasksDiscarded counts outputs the backend refused because the task was cancelled or
+	// reassigned.
+	TasksDiscarded int64 `json:"tasks_discarded"`
+	// TasksFailed counts tasks whose handler failed, and outputs that could not be committed.
+	TasksFailed int64 `json:"tasks_failed"`
+}
+
+// WorkerSummary is one element of GET /workers. Timestamps are RFC 3339.
+type WorkerSummary struct {
+	ID           string   `json:"id"`
+	Status       string   `json:"status"`
+	Types        []string `json:"types"`
+	Capabilities []string `json:"capabilities"`
+	RegisteredAt string   `json:"registered_at"`
+	// LastHeartbeat is RegisteredAt until the first heartbeat.
+	LastHeartbeat string `json:"last_heartbeat"`
+	// Tasks are the IDs of the tasks the worker reported processing in its last heartbeat.
+	Tasks []int64     `json:"tasks"`
+	Stats WorkerStats `json:"stats"`
+	Slots int         `json:"slots"`
+	// SlotStats are the slots as of the last heartbeat, empty until the first one.
+	SlotStats []SlotStats `json:"slot_stats"`
+}
+
+// WorkerListing is the response of GET /workers.
+type WorkerListing struct {
+	Workers []WorkerSummary `json:"workers"`
+	// Alive is the number of workers whose status is WORKER_ALIVE.
+	Alive int `json:"alive"`
+	// Capacity is the number of slots across WORKER_ALIVE workers, which is how many tasks they
+	// can process at once.
+	Capacity int  `json:"capacity"`
+	Error    Code `json:"error"`
+}
+
+// ErrorResponse is the body of every failed /v1 response, and of failures on the unversioned
+// routes that are not specific to an endpoint, such as authentication. Unversioned endpoints
+// otherwise fail with their own response type, whose error field carries the same Code.
+type ErrorResponse struct {
+	Error   Code   `json:"error"`
+	Message string `json:"message"`
+}
@@ -1,15 +1,13 @@
 package main
 
 import (
+	"api"
 	"bytes"
+	"context"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"os/exec"
 	"runtime"
-	"strconv"
-	"strings"
 	"time"
 )
 
@@ -20,11 +18,14 @@ const (
 	// drop faster than they accumulate and remain below the threshold.
 	// Must be a positive integer.
 	CONSECUTIVE_REDUCTION_THRESHOLD = 3
-	// Number of pending tasks before doubling workers
+	// Number of pending tasks before doubling slots
 	PENDING_COUNT_THRESHOLD = 100
 	CHECK_FREQUENCY_SECOND  = time.Second * 5
 )
 
+// BACKEND_API_KEY authenticates the autoscaler to the backend. It must have the operator role.
+var BACKEND_API_KEY = os.Getenv("BACKEND_API_KEY")
+
 func main() {
 	runtime.GOMAXPROCS(1)
 
@@ -34,20 +35,35 @@ func main() {
 		panic("CONSECUTIVE_REDUCTION_THRESHOLD must be positive")
 	}
 
+	client := api.NewClient("http://localhost:8080", BACKEND_API_KEY)
+	// A count that arrives late is stale anyway. The next check asks again.
+	client.MaxRetries = 0
+
 	var previous_arr [3]int
 	previous := previous_arr[:0]
 	for {
 		time.Sleep(CHECK_FREQUENCY_SECOND)
-		resp, err := http.Get("http://localhost:8080/__SUPER_DUPER_SECRET_PENDING_COUNT__")
+		pending, err := client.PendingCount(context.Background())
+		if err != nil {
+			// Most likely a missing or revoked BACKEND_API_KEY, or the backend is down. Scaling on a
+			// bogus count is worse than not scaling at all.
+			fmt.Printf("fetching pending count: %s\n", err)
+			continue
+		}
+		// Workers that are running but stuck or cut off from the backend stop sending heartbeats, so
+		// they are not counted as capacity.
+		listing, err := client.ListWorkers(context.Background())
 		if err != nil {
+			fmt.Printf("listing workers: %s\n", err)
 			continue
 		}
-		defer resp.Body.Close()
-		b, _ := io.ReadAll(resp.Body)
-		pending, _ := strconv.Atoi(strings.TrimSpace(string(b)))
-		n_workers := strings.Count(pipe("docker-compose", "ps", "-q", WORKER_SERVICE_NAME), "\n") + 1
+		n_workers := max(1, listing.Alive)
+		// Workers process several tasks at once, so capacity is counted in slots. Scaling still
+		// happens a whole worker at a time.
+		n_slots := max(1, listing.Capacity)
+		slots_per_worker := max(1, n_slots/n_workers)
 
-		fmt.Printf("pending tasks=%d n_workers=%d\n", pending, n_workers)
+		fmt.Printf("pending tasks=%d n_workers=%d n_slots=%d\n", pending, n_workers, n_slots)
 
 		if len(previous) == CONSECUTIVE_REDUCTION_THRESHOLD {
 			previous = previous[1:]
@@ -73,13 +89,13 @@ func main() {
 		n := -1
 		if pending > PENDING_COUNT_THRESHOLD {
 			if decreasing {
-				n = max(1, n_workers/2)
+				n = max(1, workers_for(n_slots/2, slots_per_worker))
 				if n != n_workers {
-					fmt.Printf("halved workers to %d\n", n)
+					fmt.Printf("halved slots to %d across %d workers\n", n*slots_per_worker, n)
 				}
 			} else {
-				n = n_workers * 2
-				fmt.Printf("doubled workers to %d\n", n)
+				n = workers_for(n_slots*2, slots_per_worker)
+				fmt.Printf("doubled slots to %d across %d workers\n", n*slots_per_worker, n)
 			}
 		} else {
 			if n_workers > 1 {
@@ -92,17 +108,13 @@ func main() {
 	}
 }
 
-// === Scripting ===
-
-func pipe(cmd string, args ...string) string {
-	c := exec.Command(cmd, args...)
-	var buf bytes.Buffer
-	c.Stdout = &buf
-	c.Run()
-	output, _ := strings.CutSuffix(buf.String(), "\n")
-	return output
+// workers_for returns the number of workers needed for n_slots slots, rounding up.
+func workers_for(n_slots, slots_per_worker int) int {
+	return (n_slots + slots_per_worker - 1) / slots_per_worker
 }
 
+// === Scripting ===
+
 func spawn(working_directory string, environment []string, binary string, arguments ...string) error {
 	cmd := exec.Command(binary, arguments...)
 	if len(environment) > 0 {
@@ -120,7 +132,7 @@ func spawn(working_directory string, environment []string, binary string, argume
 	cmd.Stderr = nil
 	cmd.Stdin = os.Stdin
 	if err := cmd.Run(); err != nil {
-		return fmt.Errorf(buf.String())
+		return fmt.Errorf("%s", buf.String())
 	}
 	return nil
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	runtime_metrics "runtime/metrics"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Admission decides whether a submission is accepted before a task is created for it, so that
+// clients that submit faster than workers drain are pushed back with 429 instead of growing the
+// backend until it runs out of memory. Every limit is disabled when its setting is 0.
+//
+// Once the pending queue or the heap crosses shed_percent of its limit, the backend is shedding:
+// only tasks with a priority of at least shed_min_priority are admitted. At the limit itself,
+// nothing is admitted. Replayed idempotent submissions are never rejected since they create nothing.
+type Admission struct {
+	max_pending       int64
+	max_heap_bytes    int64
+	shed_percent      int64
+	shed_min_priority int
+	// heap_bytes is sampled by Run rather than read on every submission, because reading it is
+	// not free and the value only needs to be roughly current.
+	heap_bytes atomic.Int64
+
+	// Per-client token buckets. rate is tokens per second and 0 disables rate limiting.
+	rate    float64
+	burst   float64
+	mu      sync.Mutex
+	buckets map[string]*token_bucket
+}
+
+type token_bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// Rejection reasons. These are the values of the reason label on
+// backend_submissions_rejected_total.
+const (
+	REJECT_RATE_LIMITED  = "rate_limited"
+	REJECT_PENDING_LIMIT = "pending_limit"
+	REJECT_MEMORY_LIMIT  = "memory_limit"
+	REJECT_SHED          = "shed"
+)
+
+// OVERLOAD_RETRY_AFTER is the Retry-After sent when the backend itself is overloaded. Unlike a
+// rate limit, there is no way to know when the queue will have drained.
+const OVERLOAD_RETRY_AFTER = time.Second * 5
+
+func NewAdmission(max_pending, max_heap_bytes, shed_percent int64, shed_min_priority int, rate, burst float64) *Admission {
+	return &Admission{
+		max_pending:       max_pending,
+		max_heap_bytes:    max_heap_bytes,
+		shed_percent:      shed_percent,
+		shed_min_priority: shed_min_priority,
+		rate:              rate,
+		burst:             max(burst, 1),
+		buckets:           make(map[string]*token_bucket),
+	}
+}
+
+// Run samples the heap size every interval. It never returns.
+func (admission *Admission) Run(interval time.Duration) {
+	sample := []runtime_metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	for {
+		runtime_metrics.Read(sample)
+		admission.heap_bytes.Store(int64(sample[0].Value.Uint64()))
+		time.Sleep(interval)
+	}
+}
+
+// Admit reports why a task of the given priority must be rejected right now, or "" if it may be
+// created. pending is the current length of the pending queue.
+func (admission *Admission) Admit(priority int, pending int64) (reason string) {
+	pressure := func(value, limit int64) int64 {
+		if limit == 0 {
+			return 0
+		}
+		return value * 100 / limit
+	}
+	pending_pressure := pressure(pending, admission.max_pending)
+	heap_pressure := pressure(admission.heap_bytes.Load(), admission.max_heap_bytes)
+	switch {
+	case pending_pressure >= 100:
+		return REJECT_PENDING_LIMIT
+	case heap_pressure >= 100:
+		return REJECT_MEMORY_LIMIT
+	case admission.shed_percent > 0 &&
+		max(pending_pressure, heap_pressure) >= admission.shed_percent &&
+		priority < admission.shed_min_priority:
+		return REJECT_SHED
+	}
+	return ""
+}
+
+// Take removes n tokens from client's bucket. If there are not enough, it takes nothing and
+// returns how long until there will be. A request for more than the burst is let through once the
+// bucket is full and leaves it in debt, so that large batches are slowed down rather than
+// rejected forever.
+func (admission *Admission) Take(client string, n int, now time.Time) (ok bool, retry_after time.Duration) {
+	if admission.rate == 0 {
+		return true, 0
+	}
+	admission.mu.Lock()
+	defer admission.mu.Unlock()
+	bucket, exists := admission.buckets[client]
+	if !exists {
+		bucket = &token_bucket{tokens: admission.burst, at: now}
+		admission.buckets[client] = bucket
+	}
+	bucket.tokens = min(admission.burst, bucket.tokens+now.Sub(bucket.at).Seconds()*admission.rate)
+	bucket.at = now
+	needed := min(float64(n), admission.burst)
+	if bucket.tokens >= needed {
+		bucket.tokens -= float64(n)
+		return true, 0
+	}
+	missing := needed - bucket.tokens
+	return false, time.Duration(missing / admission.rate * float64(time.Second))
+}
+
+// Evict forgets buckets that have refilled completely, since a new bucket starts out full anyway.
+// It returns how many buckets remain.
+func (admission *Admission) Evict(now time.Time) int {
+	admission.mu.Lock()
+	defer admission.mu.Unlock()
+	for client, bucket := range admission.buckets {
+		if bucket.tokens+now.Sub(bucket.at).Seconds()*admission.rate >= admission.burst {
+			delete(admission.buckets, client)
+		}
+	}
+	return len(admission.buckets)
+}
+
+// client_id identifies the submitter for rate limiting: the name of the API key authenticate
+// accepted, or its address while authentication is disabled.
+func client_id(r *http.Request) string {
+	if principal := principal_of(r); principal != nil {
+		return "key:" + principal.Name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// set_retry_after sets the Retry-After header, rounding up to whole seconds as the header requires.
+func set_retry_after(w http.ResponseWriter, d time.Duration) {
+	seconds := int64(math.Ceil(d.Seconds()))
+	w.Header().Set("Retry-After", strconv.FormatInt(max(seconds, 1), 10))
+}
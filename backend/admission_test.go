@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdmissionShedsLowPriorityBeforeTheLimit(t *testing.T) {
+	admission := NewAdmission(100, 0, 80, 1, 0, 0)
+	cases := []struct {
+		priority int
+		pending  int64
+		want     string
+	}{
+		{priority: 0, pending: 79, want: ""},
+		{priority: 0, pending: 80, want: REJECT_SHED},
+		{priority: 1, pending: 80, want: ""},
+		{priority: 1, pending: 99, want: ""},
+		{priority: 1, pending: 100, want: REJECT_PENDING_LIMIT},
+	}
+	for _, c := range cases {
+		if got := admission.Admit(c.priority, c.pending); got != c.want {
+			t.Errorf("Admit(%d, %d)\nGot: %q\nWant: %q", c.priority, c.pending, got, c.want)
+		}
+	}
+
+	admission.heap_bytes.Store(1 << 20)
+	admission.max_heap_bytes = 1 << 20
+	if got := admission.Admit(1, 0); got != REJECT_MEMORY_LIMIT {
+		t.Errorf("Got: %q\nWant: %q", got, REJECT_MEMORY_LIMIT)
+	}
+}
+
+func TestAdmissionTokenBucket(t *testing.T) {
+	admission := NewAdmission(0, 0, 0, 1, 10, 5)
+	now := time.Now()
+	for i := range 5 {
+		if ok, _ := admission.Take("a", 1, now); !ok {
+			t.Fatalf("Request %d within the burst was rejected", i)
+		}
+	}
+	ok, retry_after := admission.Take("a", 1, now)
+	if ok || retry_after != time.Millisecond*100 {
+		t.Fatalf("Got: %v, %v\nWant: false, 100ms", ok, retry_after)
+	}
+	// Other clients have their own bucket
+	if ok, _ := admission.Take("b", 1, now); !ok {
+		t.Fatal("Client b was limited by client a")
+	}
+	if ok, _ := admission.Take("a", 1, now.Add(time.Millisecond*100)); !ok {
+		t.Fatal("Bucket did not refill")
+	}
+
+	// A batch larger than the burst gets through on a full bucket and puts it in debt
+	now = now.Add(time.Hour)
+	if ok, _ := admission.Take("a", 15, now); !ok {
+		t.Fatal("Oversized batch was rejected on a full bucket")
+	}
+	if ok, retry_after := admission.Take("a", 1, now); ok || retry_after != time.Millisecond*1100 {
+		t.Fatalf("Got: %v, %v\nWant: false, 1.1s", ok, retry_after)
+	}
+
+	if remaining := admission.Evict(now.Add(time.Hour)); remaining != 0 {
+		t.Fatalf("Got: %d buckets after every bucket refilled\nWant: 0", remaining)
+	}
+}
+
+func TestClientIDIsTheAuthenticatedKey(t *testing.T) {
+	r := httptest.NewRequest("POST", "/submit", nil)
+	r.RemoteAddr = "10.0.0.1:5000"
+	if got := client_id(r); got != "10.0.0.1" {
+		t.Fatalf("Got: %q\nWant: the address without authentication", got)
+	}
+	// Whatever key the request carries, the principal authenticate accepted is the one counted.
+	r.Header.Set("Authorization", "Bearer other-key")
+	r = r.WithContext(context.WithValue(r.Context(), principal_key{}, &Principal{Name: "workload"}))
+	if got := client_id(r); got != "key:workload" {
+		t.Fatalf("Got: %q\nWant: %q", got, "key:workload")
+	}
+}
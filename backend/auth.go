@@ -0,0 +1,238 @@
+package main
+
+import (
+	"api"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Roles. A key has exactly one role, and each route lists the roles allowed to call it in
+// route_roles.
+const (
+	// ROLE_CLIENT submits tasks and reads their results.
+	ROLE_CLIENT = "client"
+	// ROLE_WORKER takes pending tasks and commits their output.
+	ROLE_WORKER = "worker"
+	// ROLE_OPERATOR reads metrics and administers the backend, including for the autoscaler.
+	ROLE_OPERATOR = "operator"
+)
+
+// route_roles maps every route pattern to the roles allowed to call it. An empty list makes the
+// route public. Routes missing from the map are reserved for ROLE_OPERATOR, so that a new route is
+// never accidentally public. /v1 routes are listed without api.PREFIX.
+var route_roles = map[string][]string{
+	"GET /health":       {},
+	"GET /openapi.json": {},
+	// Unknown /v1 paths, which are answered with api.ROUTE_NOT_FOUND.
+	"/": {},
+
+	"POST /submit":                              {ROLE_CLIENT},
+	"POST /submit/batch":                        {ROLE_CLIENT},
+	"GET /status/{id}":                          {ROLE_CLIENT, ROLE_OPERATOR},
+	"POST /tasks/{id}/cancel":                   {ROLE_CLIENT, ROLE_OPERATOR},
+	"GET /tasks/{id}/deliveries":                {ROLE_CLIENT, ROLE_OPERATOR},
+	"GET /tasks/{id}/events":                    {ROLE_CLIENT, ROLE_OPERATOR},
+	"GET /events":                               {ROLE_CLIENT, ROLE_OPERATOR},
+	"GET /pending":                              {ROLE_WORKER},
+	"POST /processed":                           {ROLE_WORKER},
+	"POST /processed/batch":                     {ROLE_WORKER},
+	"POST /workers":                             {ROLE_WORKER},
+	"POST /workers/{worker}/heartbeat":          {ROLE_WORKER},
+	"POST /workers/{worker}/release":            {ROLE_WORKER},
+	"DELETE /workers/{worker}":                  {ROLE_WORKER},
+	"GET /workers":                              {ROLE_OPERATOR},
+	"GET /tasks":                                {ROLE_OPERATOR},
+	"GET /metrics":                              {ROLE_OPERATOR},
+	"GET /__SUPER_DUPER_SECRET_PENDING_COUNT__": {ROLE_OPERATOR},
+}
+
+// Principal is the holder of an API key.
+type Principal struct {
+	Name string
+	Role string
+}
+
+// APIKeys holds the keys accepted in "Authorization: Bearer <key>". They are loaded from a file
+// with one key per line:
+//
+//	# role  name        key
+//	client  workload    3b8e0c...
+//	worker  worker-pool 91d2f4...
+//	operator autoscaler $OPERATOR_API_KEY
+//
+// A key written as $NAME is read from the environment variable NAME instead, so that the file can
+// be committed without the secrets themselves. Blank lines and lines starting with # are ignored.
+// Names label the key in logs and rate limits, and own the workers registered with it. They may
+// repeat, which is how a key is rotated without downtime: add the new key under the same name,
+// reload, move the callers over, then remove the old key and reload again.
+type APIKeys struct {
+	path string
+	// keys is indexed by the SHA-256 of the key, so that looking a key up does not compare the
+	// secret itself byte by byte.
+	keys atomic.Pointer[map[[sha256.Size]byte]Principal]
+	// contents is the file as last loaded, to only log reloads that changed something.
+	contents []byte
+}
+
+// LoadAPIKeys reads the key file at path. Call Reload to pick up changes to it.
+func LoadAPIKeys(path string) (*APIKeys, error) {
+	api_keys := &APIKeys{path: path}
+	if _, err := api_keys.Reload(); err != nil {
+		return nil, err
+	}
+	return api_keys, nil
+}
+
+// Reload re-reads the key file and swaps the new keys in atomically. If the file cannot be read or
+// parsed, the previous keys stay in effect. changed reports whether the file differed from the
+// last successful load. Reload must not be called concurrently with itself.
+func (api_keys *APIKeys) Reload() (changed bool, err error) {
+	contents, err := os.ReadFile(api_keys.path)
+	if err != nil {
+		return false, err
+	}
+	if api_keys.keys.Load() != nil && bytes.Equal(contents, api_keys.contents) {
+		return false, nil
+	}
+	keys, err := parse_api_keys(contents)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", api_keys.path, err)
+	}
+	api_keys.keys.Store(&keys)
+	api_keys.contents = contents
+	return true, nil
+}
+
+// Len returns the number of keys currently accepted.
+func (api_keys *APIKeys) Len() int {
+	return len(*api_keys.keys.Load())
+}
+
+// Authenticate returns the holder of the key the request carries, or nil.
+func (api_keys *APIKeys) Authenticate(r *http.Request) *Principal {
+	key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || key == "" {
+		return nil
+	}
+	principal, ok := (*api_keys.keys.Load())[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil
+	}
+	return &principal
+}
+
+func parse_api_keys(contents []byte) (map[[sha256.Size]byte]Principal, error) {
+	keys := make(map[[sha256.Size]byte]Principal)
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for line_number := 1; scanner.Scan(); line_number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: want \"<role> <name> <key>\"", line_number)
+		}
+		role, name, key := fields[0], fields[1], fields[2]
+		if variable, ok := strings.CutPrefix(key, "$"); ok {
+			if key = os.Getenv(variable); key == "" {
+				return nil, fmt.Errorf("line %d: %s is unset", line_number, variable)
+			}
+		}
+		switch role {
+		case ROLE_CLIENT, ROLE_WORKER, ROLE_OPERATOR:
+		default:
+			return nil, fmt.Errorf("line %d: unknown role %q", line_number, role)
+		}
+		hash := sha256.Sum256([]byte(key))
+		if _, exists := keys[hash]; exists {
+			return nil, fmt.Errorf("line %d: duplicate key", line_number)
+		}
+		keys[hash] = Principal{Name: name, Role: role}
+	}
+	return keys, scanner.Err()
+}
+
+type principal_key struct{}
+
+// principal_of returns the holder of the key a request was authenticated with, or nil when
+// authentication is disabled or the route is public.
+func principal_of(r *http.Request) *Principal {
+	principal, _ := r.Context().Value(principal_key{}).(*Principal)
+	return principal
+}
+
+// owner_of is the owner a worker registered by the request is bound to, see Worker.Owner.
+func owner_of(r *http.Request) string {
+	if principal := principal_of(r); principal != nil {
+		return principal.Name
+	}
+	return ""
+}
+
+// acts_as_worker reports whether the request may act as worker_id, which is empty for workers that
+// did not register. A worker ID belongs to the principal that registered it, so that one key
+// cannot heartbeat, deregister or commit for a worker of another.
+func acts_as_worker(r *http.Request, worker_id string) bool {
+	return worker_id == "" || workers.Owns(worker_id, owner_of(r))
+}
+
+// authenticate rejects requests whose key does not grant a role allowed on the route they match.
+// With api_keys nil, authentication is disabled and every request is let through.
+func authenticate(mux *http.ServeMux, api_keys *APIKeys) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if api_keys == nil {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			// Let the mux answer 404 or 405.
+			mux.ServeHTTP(w, r)
+			return
+		}
+		roles, listed := route_roles[unversioned(pattern)]
+		if !listed {
+			roles = []string{ROLE_OPERATOR}
+		}
+		if len(roles) == 0 {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		reject := func(error_code api.Code, code int) {
+			// The mux never sees the request, so label it for instrument here.
+			r.Pattern = pattern
+			w.Header().Set("Content-Type", "application/json")
+			if code == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			w.WriteHeader(code)
+			json.NewEncoder(w).Encode(&api.ErrorResponse{Error: error_code, Message: error_code.Message()})
+		}
+		principal := api_keys.Authenticate(r)
+		if principal == nil {
+			auth_failures_total.Inc("unauthenticated")
+			reject(api.UNAUTHENTICATED, http.StatusUnauthorized)
+			return
+		}
+		for _, role := range roles {
+			if principal.Role == role {
+				// The mux labels the copy carrying the principal, so label the original for instrument.
+				r.Pattern = pattern
+				mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principal_key{}, principal)))
+				return
+			}
+		}
+		auth_failures_total.Inc("forbidden")
+		lgr.Warn().Str("name", principal.Name).Str("role", principal.Role).Str("route", pattern).Msg("forbidden")
+		reject(api.FORBIDDEN, http.StatusForbidden)
+	})
+}
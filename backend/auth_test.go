@@ -0,0 +1,190 @@
+package main
+
+import (
+	"api"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuthenticateEnforcesRoles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api_keys")
+	write_keys := func(contents string) {
+		if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write_keys("# role name key\nclient workload client-key\n\nworker pool worker-key\n")
+	keys, err := LoadAPIKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	for _, pattern := range []string{"GET /health", "POST /submit", "GET /pending", "GET /unlisted"} {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {})
+	}
+	handler := authenticate(mux, keys)
+	request := func(method, path, key string) int {
+		r := httptest.NewRequest(method, path, nil)
+		if key != "" {
+			r.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	cases := []struct {
+		method, path, key string
+		want              int
+	}{
+		{"GET", "/health", "", http.StatusOK},
+		{"POST", "/submit", "", http.StatusUnauthorized},
+		{"POST", "/submit", "wrong-key", http.StatusUnauthorized},
+		{"POST", "/submit", "client-key", http.StatusOK},
+		{"POST", "/submit", "worker-key", http.StatusForbidden},
+		{"GET", "/pending", "worker-key", http.StatusOK},
+		{"GET", "/pending", "client-key", http.StatusForbidden},
+		// Routes without an entry in route_roles are operator only
+		{"GET", "/unlisted", "client-key", http.StatusForbidden},
+		{"GET", "/missing", "", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		if got := request(c.method, c.path, c.key); got != c.want {
+			t.Errorf("%s %s with %q\nGot: %d\nWant: %d", c.method, c.path, c.key, got, c.want)
+		}
+	}
+
+	// Rotation: both keys work while both are listed, and the old one stops working once removed
+	write_keys("client workload client-key\nclient workload client-key-2\n")
+	if changed, err := keys.Reload(); !changed || err != nil {
+		t.Fatalf("Got: %v, %v\nWant: true, <nil>", changed, err)
+	}
+	if request("POST", "/submit", "client-key") != http.StatusOK || request("POST", "/submit", "client-key-2") != http.StatusOK {
+		t.Fatal("Keys listed during rotation are not both accepted")
+	}
+	write_keys("client workload client-key-2\n")
+	keys.Reload()
+	if got := request("POST", "/submit", "client-key"); got != http.StatusUnauthorized {
+		t.Fatalf("Removed key\nGot: %d\nWant: %d", got, http.StatusUnauthorized)
+	}
+
+	// A broken file keeps the previous keys in effect
+	write_keys("superuser root key\n")
+	if _, err := keys.Reload(); err == nil {
+		t.Fatal("Unknown role was accepted")
+	}
+	if got := request("POST", "/submit", "client-key-2"); got != http.StatusOK {
+		t.Fatalf("Got: %d\nWant: %d", got, http.StatusOK)
+	}
+}
+
+func TestAPIKeysFromTheEnvironment(t *testing.T) {
+	t.Setenv("TEST_WORKER_KEY", "from-env")
+	keys, err := parse_api_keys([]byte("worker pool $TEST_WORKER_KEY\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal, ok := keys[sha256.Sum256([]byte("from-env"))]; !ok || principal.Name != "pool" {
+		t.Fatalf("Got: %v\nWant: the key read from TEST_WORKER_KEY", keys)
+	}
+	if _, err := parse_api_keys([]byte("worker pool $TEST_UNSET_KEY\n")); err == nil {
+		t.Fatal("A key from an unset variable was accepted")
+	}
+}
+
+// TestWorkerIDsBelongToTheirKey checks that a worker key cannot act as a worker registered with
+// another one.
+func TestWorkerIDsBelongToTheirKey(t *testing.T) {
+	with_workers(t)
+	path := filepath.Join(t.TempDir(), "api_keys")
+	if err := os.WriteFile(path, []byte("worker pool-a key-a\nworker pool-b key-b\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadAPIKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	register_routes(mux)
+	handler := authenticate(mux, keys)
+	request := func(method, path, key, body string) int {
+		r := httptest.NewRequest(method, api.PREFIX+path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+key)
+		r.Header.Set("Worker-ID", "w")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := request("POST", "/workers", "key-a", `{"id":"w"}`); code != http.StatusOK {
+		t.Fatalf("Got: %d registering\nWant: 200", code)
+	}
+
+	for _, step := range []struct{ method, path, body string }{
+		{"POST", "/workers", `{"id":"w"}`},
+		{"POST", "/workers/w/heartbeat", `{}`},
+		{"GET", "/pending?wait=1ms", ""},
+		{"POST", "/processed", `{"id":0,"input":"x","output":["x"]}`},
+		{"POST", "/processed/batch", `[{"id":0,"input":"x","output":["x"]}]`},
+		{"POST", "/workers/w/release", `{}`},
+		{"DELETE", "/workers/w", ""},
+	} {
+		if code := request(step.method, step.path, "key-b", step.body); code != http.StatusForbidden {
+			t.Errorf("%s %s with another key\nGot: %d\nWant: 403", step.method, step.path, code)
+		}
+	}
+
+	if code := request("POST", "/workers/w/heartbeat", "key-a", `{}`); code != http.StatusOK {
+		t.Fatalf("Got: %d heartbeating with the registering key\nWant: 200", code)
+	}
+	if code := request("DELETE", "/workers/w", "key-a", ""); code != http.StatusOK {
+		t.Fatalf("Got: %d deregistering with the registering key\nWant: 200", code)
+	}
+	// Once deregistered, the ID is free for any key.
+	if code := request("POST", "/workers", "key-b", `{"id":"w"}`); code != http.StatusOK {
+		t.Fatalf("Got: %d registering a free ID\nWant: 200", code)
+	}
+}
+
+func TestAuthorizedRequestsKeepTheirRouteLabel(t *testing.T) {
+	with_workers(t)
+	path := filepath.Join(t.TempDir(), "api_keys")
+	if err := os.WriteFile(path, []byte("operator ops ops-key\nclient workload client-key\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadAPIKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	register_routes(mux)
+	handler := instrument(authenticate(mux, keys))
+	request := func(path, key string) string {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	request(api.PREFIX+"/workers", "ops-key")
+	request(api.PREFIX+"/workers", "client-key")
+	scraped := request("/metrics", "ops-key")
+	for _, want := range []string{
+		`route="GET /v1/workers",code="200"`,
+		`route="GET /v1/workers",code="403"`,
+	} {
+		if !strings.Contains(scraped, want) {
+			t.Errorf("/metrics has no %s", want)
+		}
+	}
+	// /metrics itself is only counted once it returns, so scrape again.
+	if scraped := request("/metrics", "ops-key"); !strings.Contains(scraped, `route="GET /metrics",code="200"`) {
+		t.Error("/metrics was not labelled with its own route")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/james-orcales/golang_snacks/invariant"
+)
+
+// BlobStore is a content-addressed store on disk for task outputs too large to keep in the heap.
+// A blob is named by the SHA-256 of its contents, so identical outputs share a file. Reference
+// counts are kept in memory, and the file is deleted once the last task referencing it is evicted.
+type BlobStore struct {
+	dir string
+	// mu only guards refs. Files are written without it, so that a large Put does not hold up
+	// every other Put and Release.
+	mu   sync.Mutex
+	refs map[string]*blob
+}
+
+type blob struct {
+	refs int
+	// written is closed once the file was written, or failed to be with err.
+	written chan struct{}
+	err     error
+}
+
+// NewBlobStore creates dir if needed and deletes any blobs, and any temporary files of blobs being
+// written, left in it by a previous process. Task state does not survive restarts, so nothing can
+// reference them anymore.
+func NewBlobStore(dir string) (*BlobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Only files that look like blobs are removed, in case dir is shared with something else.
+		if !d.IsDir() && (is_blob_ref(d.Name()) || is_blob_tmp(path)) {
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BlobStore{dir: dir, refs: make(map[string]*blob)}, nil
+}
+
+// Put stores data and returns its reference. Every Put must be paired with a Release.
+func (store *BlobStore) Put(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	ref := hex.EncodeToString(sum[:])
+
+	// The reference is taken before the file exists, so that a Release of the same blob cannot
+	// delete it from under the write. Puts of the same blob in the meantime wait for the write.
+	store.mu.Lock()
+	b, writing := store.refs[ref]
+	if writing {
+		b.refs++
+	} else {
+		b = &blob{refs: 1, written: make(chan struct{})}
+		store.refs[ref] = b
+	}
+	store.mu.Unlock()
+
+	if !writing {
+		b.err = store.write(ref, data)
+		close(b.written)
+	}
+	<-b.written
+	if b.err != nil {
+		store.Release(ref)
+		return "", b.err
+	}
+	return ref, nil
+}
+
+func (store *BlobStore) write(ref string, data []byte) error {
+	path := store.path(ref)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// Written under a temporary name first so that a crash never leaves a truncated blob behind
+	// under a valid name.
+	tmp, err := os.CreateTemp(filepath.Dir(path), BLOB_TMP_PREFIX+"*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	err = errors.Join(err, tmp.Close())
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Open returns the blob's contents. The returned file stays readable even if the blob is released
+// while it is open.
+func (store *BlobStore) Open(ref string) (*os.File, error) {
+	return os.Open(store.path(ref))
+}
+
+func (store *BlobStore) Release(ref string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	b, ok := store.refs[ref]
+	invariant.Always(ok && b.refs > 0, "Released blob is referenced")
+	b.refs--
+	if b.refs > 0 {
+		return
+	}
+	delete(store.refs, ref)
+	// Removed under the lock, or a Put of the same blob could write it again just before.
+	os.Remove(store.path(ref))
+}
+
+func (store *BlobStore) path(ref string) string {
+	// Fan out into subdirectories so no single directory grows too large.
+	return filepath.Join(store.dir, ref[:2], ref)
+}
+
+// BLOB_TMP_PREFIX names the temporary files of blobs being written.
+const BLOB_TMP_PREFIX = "tmp-"
+
+// is_blob_tmp reports whether path is a temporary file of Put, which sit next to the blobs in the
+// fan-out subdirectories.
+func is_blob_tmp(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), BLOB_TMP_PREFIX) && len(filepath.Base(filepath.Dir(path))) == 2
+}
+
+func is_blob_ref(name string) bool {
+	if len(name) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
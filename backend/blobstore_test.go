@@ -0,0 +1,138 @@
+package main
+
+import (
+	"api"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBlobStoreCountsReferences(t *testing.T) {
+	store, err := NewBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := store.Put([]byte("shared"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := store.Put([]byte("shared")); again != ref {
+		t.Fatalf("Got: %s for the same contents\nWant: %s", again, ref)
+	}
+
+	store.Release(ref)
+	f, err := store.Open(ref)
+	if err != nil {
+		t.Fatalf("Blob deleted while a reference was left: %v", err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if string(data) != "shared" {
+		t.Fatalf("Got: %q\nWant: shared", data)
+	}
+
+	store.Release(ref)
+	if _, err := store.Open(ref); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Got: %v after the last release\nWant: the blob deleted", err)
+	}
+	if len(store.refs) != 0 {
+		t.Fatalf("Got: %d references left\nWant: none", len(store.refs))
+	}
+}
+
+func TestBlobStoreConcurrentPutsShareOneFile(t *testing.T) {
+	store, _ := NewBlobStore(t.TempDir())
+	var wg sync.WaitGroup
+	for range 32 {
+		wg.Go(func() {
+			ref, err := store.Put([]byte("same"))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if f, err := store.Open(ref); err != nil {
+				t.Errorf("Put returned before the blob was written: %v", err)
+			} else {
+				f.Close()
+			}
+			store.Release(ref)
+		})
+	}
+	wg.Wait()
+	if len(store.refs) != 0 {
+		t.Fatalf("Got: %d references left\nWant: none", len(store.refs))
+	}
+}
+
+func TestBlobStoreRemovesLeftoversOfAPreviousProcess(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := NewBlobStore(dir)
+	ref, _ := store.Put([]byte("old"))
+	tmp := filepath.Join(filepath.Dir(store.path(ref)), BLOB_TMP_PREFIX+"123")
+	unrelated := filepath.Join(dir, "notes.txt")
+	for _, path := range []string{tmp, unrelated} {
+		if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	NewBlobStore(dir)
+	for _, path := range []string{store.path(ref), tmp} {
+		if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Got: %v for %s\nWant: removed", err, path)
+		}
+	}
+	if _, err := os.Stat(unrelated); err != nil {
+		t.Errorf("Removed a file that is not a blob: %v", err)
+	}
+}
+
+// TestStatusOutputRoundTrips checks that a task's output reads back the same whether it was kept
+// in memory or offloaded to blobs.
+func TestStatusOutputRoundTrips(t *testing.T) {
+	with_workers(t)
+	previous := blobs
+	t.Cleanup(func() { blobs = previous })
+	var err error
+	if blobs, err = NewBlobStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	output := []string{"a", `"quoted"`, "ünïcode"}
+	data, _ := json.Marshal(output)
+	ref, err := blobs.Put(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	all_tasks.Insert(&Task{ID: 0, Type: api.DEFAULT_TASK_TYPE, Status: api.STATUS_FINISHED, Input: "x", Output: output, FinishedAt: now})
+	all_tasks.Insert(&Task{ID: 1, Type: api.DEFAULT_TASK_TYPE, Status: api.STATUS_FINISHED, Input: "x", OutputRef: ref, FinishedAt: now})
+	next_id.Store(max(next_id.Load(), 2))
+
+	mux := http.NewServeMux()
+	register_routes(mux)
+	want := api.StatusResponse{Type: api.DEFAULT_TASK_TYPE, Status: api.STATUS_FINISHED, Output: output}
+	for _, prefix := range []string{"", api.PREFIX} {
+		for id := range int64(2) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, prefix+"/status/"+strconv.FormatInt(id, 10), nil))
+			got := api.StatusResponse{}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); w.Code != http.StatusOK || err != nil {
+				t.Fatalf("GET %s/status/%d\nGot: %d %s", prefix, id, w.Code, w.Body)
+			}
+			want.ID = id
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("GET %s/status/%d\nGot: %+v\nWant: %+v", prefix, id, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"api"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func with_scheduler(t *testing.T) {
+	with_workers(t)
+	previous := scheduled_tasks
+	scheduled_tasks = NewScheduler(release_scheduled)
+	t.Cleanup(func() { scheduled_tasks = previous })
+}
+
+func check_cancelled(t *testing.T, id int64) {
+	t.Helper()
+	if status, error_code, code := cancel_task(id); status != api.STATUS_CANCELLED || error_code != "" || code != http.StatusOK {
+		t.Fatalf("Got: %s %q %d\nWant: CANCELLED", status, error_code, code)
+	}
+	if task, _, _, _ := snapshot_task(id); task.Status != api.STATUS_CANCELLED {
+		t.Fatalf("Got: %s\nWant: CANCELLED", task.Status)
+	}
+	// Cancelling again succeeds and changes nothing.
+	if status, error_code, _ := cancel_task(id); status != api.STATUS_CANCELLED || error_code != "" {
+		t.Fatalf("Got: %s %q on the second cancel\nWant: CANCELLED", status, error_code)
+	}
+}
+
+func TestCancelScheduledTask(t *testing.T) {
+	with_scheduler(t)
+	run_at := time.Now().Add(time.Hour).Format(time.RFC3339)
+	id, _, _, _ := submit_task(&api.SubmitRequest{Data: "x", RunAt: run_at}, "", nil)
+	check_cancelled(t, id)
+	if scheduled_tasks.Len() != 0 {
+		t.Fatal("The cancelled task is still scheduled")
+	}
+
+	// The scheduler popped the task just before it was cancelled.
+	id, _, _, _ = submit_task(&api.SubmitRequest{Data: "y", RunAt: run_at}, "", nil)
+	scheduled_tasks.Remove(id)
+	check_cancelled(t, id)
+	release_scheduled(id)
+	if pending_tasks.Len() != 0 {
+		t.Fatal("The cancelled task became pending once due")
+	}
+}
+
+func TestCancelPendingTask(t *testing.T) {
+	with_scheduler(t)
+	id, _, _, _ := submit_task(&api.SubmitRequest{Data: "x"}, "", nil)
+	check_cancelled(t, id)
+	if pending_tasks.Len() != 0 {
+		t.Fatal("The cancelled task is still pending")
+	}
+
+	// GET /pending dequeued the task just before it was cancelled.
+	id, _, _, _ = submit_task(&api.SubmitRequest{Data: "y"}, "", nil)
+	dequeued, _ := pending_tasks.TryDequeue(default_types)
+	check_cancelled(t, id)
+	if _, ok := claim_pending(dequeued, "w"); ok {
+		t.Fatal("A worker claimed the cancelled task")
+	}
+}
+
+func TestCancelProcessingTask(t *testing.T) {
+	with_scheduler(t)
+	now := time.Now()
+	workers.Register("w", "", nil, nil, 1, now)
+	submit_task(&api.SubmitRequest{Data: "x"}, "", nil)
+	id := take(t, "w")
+	check_cancelled(t, id)
+
+	// The worker commits its output after the cancellation. It is discarded.
+	if error_code, code := complete_task(&api.ProcessedRequest{ID: id, Input: "x", Output: []string{"x"}}, "w"); error_code != api.TASK_CANCELLED || code != http.StatusConflict {
+		t.Fatalf("Got: %q %d\nWant: %q 409", error_code, code, api.TASK_CANCELLED)
+	}
+	// Or the response of GET /pending never reached it, and the delivery is undone.
+	release_delivery([]int64{id}, "w")
+	if task, _, _, _ := snapshot_task(id); task.Status != api.STATUS_CANCELLED || task.Output != nil || pending_tasks.Len() != 0 {
+		t.Fatalf("Got: %s with output %v, %d pending\nWant: CANCELLED without output and nothing pending", task.Status, task.Output, pending_tasks.Len())
+	}
+	if orphaned, _ := workers.Deregister("w"); len(orphaned.ids) != 0 {
+		t.Fatalf("Got: %v still held by the worker\nWant: none", orphaned.ids)
+	}
+}
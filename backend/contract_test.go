@@ -0,0 +1,186 @@
+package main
+
+import (
+	"api"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/james-orcales/golang_snacks/itlog"
+)
+
+func TestRoutesMatchDocument(t *testing.T) {
+	mux := http.NewServeMux()
+	register_routes(mux)
+	for i := range api.Routes {
+		route := &api.Routes[i]
+		path := strings.ReplaceAll(route.Path, "{id}", "1")
+		if _, pattern := mux.Handler(httptest.NewRequest(route.Method, api.PREFIX+path, nil)); pattern != route.Pattern() {
+			t.Errorf("Got: %q serving %s\nWant: %q", pattern, route.Pattern(), route.Pattern())
+		}
+		roles, listed := route_roles[route.Method+" "+route.Path]
+		if !listed || (len(roles) == 0) != route.Public {
+			t.Errorf("%s: roles %v do not agree with Public=%v", route.Pattern(), roles, route.Public)
+		}
+	}
+}
+
+// TestHandlersMatchDocument drives every /v1 endpoint through its successes and failures, and checks
+// each response against the document the backend serves.
+func TestHandlersMatchDocument(t *testing.T) {
+	lgr = itlog.New(io.Discard, itlog.LevelInfo)
+	// The steps below refer to the tasks they submit by ID, starting from 0.
+	all_tasks = NewTaskTable(DEFAULT_TASK_SHARDS)
+	pending_tasks = NewPendingQueues()
+	next_id.Store(0)
+	workers = NewWorkerRegistry(time.Second, 3, time.Minute)
+	t.Cleanup(func() {
+		all_tasks = NewTaskTable(DEFAULT_TASK_SHARDS)
+		pending_tasks = NewPendingQueues()
+		workers = NewWorkerRegistry(time.Second*5, 3, time.Minute*10)
+	})
+	mux := http.NewServeMux()
+	register_routes(mux)
+	server := httptest.NewServer(instrument(authenticate(mux, nil)))
+	defer server.Close()
+
+	call := func(method, path, body string) (int, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, data
+	}
+
+	code, data := call(http.MethodGet, api.PREFIX+"/openapi.json", "")
+	doc := api.Document{}
+	if err := json.Unmarshal(data, &doc); code != http.StatusOK || err != nil {
+		t.Fatalf("GET /v1/openapi.json: %d %v", code, err)
+	}
+
+	steps := []struct {
+		method, path, body string
+		want               int
+	}{
+		{"POST", "/submit", `{"data":"abc"}`, 200},
+		{"POST", "/submit", `{"data":`, 400},
+		{"POST", "/submit", `{"data":"abc","delay_ms":-1}`, 400},
+		{"POST", "/submit", `{"data":"abc","type":"resize"}`, 400},
+		{"POST", "/submit", `{"data":"abc","timeout_ms":-1}`, 400},
+		{"POST", "/submit/batch", `[{"data":"ab"},{"data":1}]`, 200},
+		{"POST", "/submit/batch", `{}`, 400},
+		{"POST", "/submit/batch", "[" + strings.Repeat(`{},`, MAX_BATCH_SIZE) + "{}]", 413},
+		{"GET", "/status/0", "", 200},
+		{"GET", "/status/x", "", 400},
+		{"GET", "/status/1000000", "", 400},
+		{"GET", "/pending?wait=1s", "", 200},
+		{"GET", "/pending?max=2&wait=1s", "", 200},
+		{"GET", "/pending?max=0", "", 400},
+		{"GET", "/pending?wait=1ms", "", 204},
+		{"POST", "/processed", `{"id":0,"input":"abc","output":["a"]}`, 200},
+		{"POST", "/processed/batch", `[{"id":1,"input":"ab","output":["a"]}]`, 200},
+		{"POST", "/processed/batch", `[{"id":`, 400},
+		{"POST", "/processed", `{"id":`, 400},
+		{"POST", "/processed", `{"id":1000000,"input":"abc","output":["a"]}`, 400},
+		{"GET", "/status/0", "", 200},
+		{"POST", "/tasks/0/cancel", "", 409},
+		{"POST", "/submit", `{"data":"f","timeout_ms":1500}`, 200},
+		{"GET", "/pending?wait=1s", "", 200},
+		{"POST", "/processed", `{"id":2,"input":"f","failure":"handler_error","failure_message":"no"}`, 200},
+		{"GET", "/status/2", "", 200},
+		{"POST", "/tasks/x/cancel", "", 400},
+		{"GET", "/tasks/0/deliveries", "", 200},
+		{"GET", "/tasks/1000000/deliveries", "", 400},
+		{"GET", "/tasks/0/events", "", 200},
+		{"GET", "/tasks/x/events", "", 400},
+		{"GET", "/events?ids=0,1", "", 200},
+		{"GET", "/events?ids=0,x", "", 400},
+		{"GET", "/tasks?status=FINISHED&sort=-id", "", 200},
+		{"GET", "/tasks?sort=name", "", 400},
+		{"POST", "/workers", `{"id":"w","capabilities":["batch"],"slots":4}`, 200},
+		{"POST", "/workers", `{"id":"has space"}`, 400},
+		{"POST", "/workers", `{"id":"w","types":["Upper"]}`, 400},
+		{"POST", "/workers", `{"id":"w","slots":-1}`, 400},
+		{"POST", "/workers/w/heartbeat", `{"tasks":[1],"stats":{"tasks_processed":2},"slots":[{"slot":0,"state":"computing","busy_ms":5,"stats":{"tasks_processed":2}}]}`, 200},
+		{"POST", "/workers/nope/heartbeat", `{}`, 400},
+		{"GET", "/workers", "", 200},
+		{"POST", "/workers/w/release", `{"tasks":[1]}`, 200},
+		{"POST", "/workers/nope/release", `{"tasks":[]}`, 400},
+		{"DELETE", "/workers/w", "", 200},
+		{"DELETE", "/workers/w", "", 400},
+	}
+	for _, step := range steps {
+		_, pattern := mux.Handler(httptest.NewRequest(step.method, api.PREFIX+step.path, nil))
+		var route *api.Route
+		for i := range api.Routes {
+			if api.Routes[i].Pattern() == pattern {
+				route = &api.Routes[i]
+			}
+		}
+		if route == nil {
+			t.Errorf("%s %s matches no route", step.method, step.path)
+			continue
+		}
+		code, data := call(step.method, api.PREFIX+step.path, step.body)
+		if code != step.want {
+			t.Errorf("%s %s\nGot: %d %s\nWant: %d", step.method, step.path, code, data, step.want)
+		}
+		if err := doc.ValidateResponse(route, code, data); err != nil {
+			t.Errorf("%s %s: %v\n%s", step.method, step.path, err, data)
+		}
+	}
+
+	code, data = call(http.MethodGet, api.PREFIX+"/nope", "")
+	failure := api.ErrorResponse{}
+	if json.Unmarshal(data, &failure); code != http.StatusNotFound || failure.Error != api.ROUTE_NOT_FOUND {
+		t.Fatalf("Got: %d %s\nWant: 404 %s", code, data, api.ROUTE_NOT_FOUND)
+	}
+}
+
+// TestUnversionedRoutesKeepTheirBodies pins the failure bodies that workers built before /v1 decode.
+func TestUnversionedRoutesKeepTheirBodies(t *testing.T) {
+	t.Cleanup(func() { all_tasks = NewTaskTable(DEFAULT_TASK_SHARDS) })
+	mux := http.NewServeMux()
+	register_routes(mux)
+	all_tasks.Insert(&Task{ID: 0, Status: api.STATUS_CANCELLED, Input: "a", FinishedAt: time.Now()})
+	next_id.Store(max(next_id.Load(), 1))
+
+	tests := []struct {
+		method, path, body string
+		want               string
+	}{
+		{"GET", "/status/x", "", `{"id":-1,"status":"","input":"","output":null,"error":"Malformed_ID"}`},
+		{"POST", "/processed", `{"id":0,"input":"a","output":["a"]}`, `{"id":0,"error":"Task_Cancelled"}`},
+		{"GET", "/pending?max=0", "", `{"id":-1,"input":"","error":"Malformed_Batch_Size"}`},
+	}
+	for _, tt := range tests {
+		for _, prefix := range []string{"", api.PREFIX} {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(tt.method, prefix+tt.path, strings.NewReader(tt.body)))
+			got := strings.TrimSpace(w.Body.String())
+			want := tt.want
+			if prefix != "" {
+				// The same failure, in the /v1 envelope.
+				old := map[string]any{}
+				json.Unmarshal([]byte(tt.want), &old)
+				error_code := api.Code(old["error"].(string))
+				want = fmt.Sprintf(`{"error":%q,"message":%q}`, error_code, error_code.Message())
+			}
+			if got != want {
+				t.Errorf("%s %s%s\nGot: %s\nWant: %s", tt.method, prefix, tt.path, got, want)
+			}
+		}
+	}
+}
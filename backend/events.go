@@ -0,0 +1,172 @@
+package main
+
+import (
+	"api"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/james-orcales/golang_snacks/invariant"
+)
+
+// EventBus fans task status transitions out to subscribers. Publish never blocks: a subscriber
+// keeps only the latest event per task until its stream writes it out. A slow consumer therefore
+// may skip intermediate statuses (seeing PENDING then FINISHED), but always sees the current one,
+// and its memory use is bounded by the number of tasks it subscribed to.
+type EventBus struct {
+	mu   sync.Mutex
+	subs map[int64]map[*Subscription]struct{}
+}
+
+type Subscription struct {
+	ids []int64
+	mu  sync.Mutex
+	// latest holds the newest unsent event per task, and order the tasks in the order their
+	// first unsent event arrived.
+	latest map[int64]api.TaskEvent
+	order  []int64
+	// ready has room for one signal and is signalled whenever latest goes from empty to non-empty.
+	ready chan struct{}
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[int64]map[*Subscription]struct{})}
+}
+
+// Subscribe registers interest in ids. To not miss a transition, callers subscribe first and then
+// push each task's current status while holding the read lock of its shard. Publish is only called
+// with the shard locked for writing, so the snapshot can never overwrite a newer event.
+func (bus *EventBus) Subscribe(ids []int64) *Subscription {
+	sub := &Subscription{
+		ids:    ids,
+		latest: make(map[int64]api.TaskEvent, len(ids)),
+		ready:  make(chan struct{}, 1),
+	}
+	bus.mu.Lock()
+	for _, id := range ids {
+		if bus.subs[id] == nil {
+			bus.subs[id] = make(map[*Subscription]struct{})
+		}
+		bus.subs[id][sub] = struct{}{}
+	}
+	bus.mu.Unlock()
+	return sub
+}
+
+func (bus *EventBus) Unsubscribe(sub *Subscription) {
+	bus.mu.Lock()
+	for _, id := range sub.ids {
+		delete(bus.subs[id], sub)
+		if len(bus.subs[id]) == 0 {
+			delete(bus.subs, id)
+		}
+	}
+	bus.mu.Unlock()
+}
+
+// Publish records a task's current status. The caller holds the lock of the task's shard.
+func (bus *EventBus) Publish(task *Task) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	for sub := range bus.subs[task.ID] {
+		sub.push(api.TaskEvent{ID: task.ID, Status: task.Status})
+	}
+}
+
+// Len returns the number of (subscription, task) pairs.
+func (bus *EventBus) Len() int {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	n := 0
+	for _, subs := range bus.subs {
+		n += len(subs)
+	}
+	return n
+}
+
+func (sub *Subscription) push(event api.TaskEvent) {
+	sub.mu.Lock()
+	if _, ok := sub.latest[event.ID]; !ok {
+		sub.order = append(sub.order, event.ID)
+	}
+	sub.latest[event.ID] = event
+	sub.mu.Unlock()
+	select {
+	case sub.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Ready is signalled when Drain has events to return.
+func (sub *Subscription) Ready() <-chan struct{} {
+	return sub.ready
+}
+
+// Drain returns and forgets every unsent event.
+func (sub *Subscription) Drain() []api.TaskEvent {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	events := make([]api.TaskEvent, 0, len(sub.order))
+	for _, id := range sub.order {
+		events = append(events, sub.latest[id])
+		delete(sub.latest, id)
+	}
+	sub.order = sub.order[:0]
+	return events
+}
+
+// EVENT_KEEPALIVE is how often an idle stream sends a comment line, so that proxies and clients do
+// not time out a stream that is merely waiting.
+const EVENT_KEEPALIVE = time.Second * 15
+
+// stream_events serves a text/event-stream of api.TaskEvent for ids. It starts with the current status
+// of every task and ends once every task has reached a terminal status or turned out not to exist.
+func stream_events(w http.ResponseWriter, r *http.Request, ids []int64) {
+	open := make(map[int64]bool, len(ids))
+	sub := task_events.Subscribe(ids)
+	defer task_events.Unsubscribe(sub)
+	for _, id := range ids {
+		shard := all_tasks.Shard(id)
+		shard.RLock()
+		if task, error_code, _ := lookup_task(id); task == nil {
+			sub.push(api.TaskEvent{ID: id, Error: error_code})
+		} else {
+			sub.push(api.TaskEvent{ID: id, Status: task.Status})
+			open[id] = true
+		}
+		shard.RUnlock()
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	controller := http.NewResponseController(w)
+	keepalive := time.NewTicker(EVENT_KEEPALIVE)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			io.WriteString(w, ": keepalive\n\n")
+		case <-sub.Ready():
+			for _, event := range sub.Drain() {
+				data, err := json.Marshal(&event)
+				invariant.AlwaysNil(err, "Task events are JSON serializable")
+				fmt.Fprintf(w, "event: status\ndata: %s\n\n", data)
+				if event.Error != "" || is_terminal(event.Status) {
+					delete(open, event.ID)
+				}
+			}
+		}
+		if err := controller.Flush(); err != nil {
+			return
+		}
+		if len(open) == 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"api"
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func with_events(t *testing.T) *httptest.Server {
+	with_scheduler(t)
+	previous := task_events
+	task_events = NewEventBus()
+	t.Cleanup(func() { task_events = previous })
+	mux := http.NewServeMux()
+	register_routes(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// next_event reads the stream up to its next event.
+func next_event(t *testing.T, stream *bufio.Reader) api.TaskEvent {
+	t.Helper()
+	for {
+		line, err := stream.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Stream ended: %v", err)
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			event := api.TaskEvent{}
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				t.Fatalf("Malformed event: %s", data)
+			}
+			return event
+		}
+	}
+}
+
+func TestEventsFollowATaskThroughEveryStatus(t *testing.T) {
+	server := with_events(t)
+	id, _, _, _ := submit_task(&api.SubmitRequest{Data: "x", RunAt: time.Now().Add(time.Hour).Format(time.RFC3339)}, "", nil)
+	resp, err := http.Get(server.URL + api.PREFIX + "/tasks/" + strconv.FormatInt(id, 10) + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	stream := bufio.NewReader(resp.Body)
+
+	// Each transition waits for the previous event, so none of them is coalesced.
+	transitions := []func(){
+		func() {},
+		func() {
+			scheduled_tasks.Remove(id)
+			release_scheduled(id)
+		},
+		func() { take(t, "") },
+		func() { complete_task(&api.ProcessedRequest{ID: id, Input: "x", Output: []string{"x"}}, "") },
+	}
+	for i, want := range []string{api.STATUS_SCHEDULED, api.STATUS_PENDING, api.STATUS_PROCESSING, api.STATUS_FINISHED} {
+		transitions[i]()
+		if event := next_event(t, stream); event.ID != id || event.Status != want {
+			t.Fatalf("Got: %+v\nWant: %s", event, want)
+		}
+	}
+	if line, err := stream.ReadString('\n'); err == nil && line != "\n" {
+		t.Fatalf("Got: %q after the terminal status\nWant: the stream to end", line)
+	}
+}
+
+func TestSlowSubscriberKeepsOnlyTheLatestEvent(t *testing.T) {
+	with_events(t)
+	first, _, _, _ := submit_task(&api.SubmitRequest{Data: "x"}, "", nil)
+	second, _, _, _ := submit_task(&api.SubmitRequest{Data: "y"}, "", nil)
+	sub := task_events.Subscribe([]int64{first, second})
+	defer task_events.Unsubscribe(sub)
+
+	// Nobody drains the subscription while the tasks go through their statuses. Publishing must
+	// not wait for it.
+	done := make(chan struct{})
+	go func() {
+		take(t, "")
+		take(t, "")
+		complete_task(&api.ProcessedRequest{ID: first, Input: "x", Output: []string{"x"}}, "")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		t.Fatal("Publishing blocked on a subscriber that does not read")
+	}
+
+	<-sub.Ready()
+	events := sub.Drain()
+	want := []api.TaskEvent{{ID: first, Status: api.STATUS_FINISHED}, {ID: second, Status: api.STATUS_PROCESSING}}
+	if len(events) != len(want) || events[0] != want[0] || events[1] != want[1] {
+		t.Fatalf("Got: %+v\nWant: %+v", events, want)
+	}
+	if events := sub.Drain(); len(events) != 0 {
+		t.Fatalf("Got: %+v after draining\nWant: nothing", events)
+	}
+}
+
+func TestEventsUnsubscribeWhenTheClientLeaves(t *testing.T) {
+	server := with_events(t)
+	id, _, _, _ := submit_task(&api.SubmitRequest{Data: "x"}, "", nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+api.PREFIX+"/tasks/"+strconv.FormatInt(id, 10)+"/events", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	next_event(t, bufio.NewReader(resp.Body))
+	if task_events.Len() != 1 {
+		t.Fatalf("Got: %d subscriptions while streaming\nWant: 1", task_events.Len())
+	}
+
+	cancel()
+	deadline := time.Now().Add(time.Second * 2)
+	for task_events.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("The subscription outlived the client")
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
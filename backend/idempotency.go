@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// IdempotencyStore remembers which task a client-supplied key created, so that a retried POST
+// /submit returns the original task instead of enqueueing a duplicate. Only successful submissions
+// are remembered; a request that was rejected can be retried with the same key.
+type IdempotencyStore struct {
+	mu        sync.Mutex
+	entries   map[string]*idempotency_entry
+	retention time.Duration
+}
+
+type idempotency_entry struct {
+	id int64
+	// fingerprint detects a key being reused for a different request body.
+	fingerprint [sha256.Size]byte
+	expires_at  time.Time
+	// pending is true while the submission that reserved the key runs. done is closed once it
+	// returned, after which id is set if it was accepted, and the entry removed if it was not.
+	pending  bool
+	accepted bool
+	done     chan struct{}
+}
+
+func NewIdempotencyStore(retention time.Duration) *IdempotencyStore {
+	return &IdempotencyStore{
+		entries:   make(map[string]*idempotency_entry),
+		retention: retention,
+	}
+}
+
+// Do returns the task ID previously recorded for key, or calls submit and records the ID it
+// returns. The key is reserved while submit runs, so that concurrent retries carrying the same key
+// cannot both enqueue a task: they wait for the first to return instead. submit runs without the
+// store locked, so submissions with other keys are not held up. submit reports ok=false when the
+// submission was rejected, in which case nothing is recorded and a waiting retry submits itself.
+//
+// conflict is true when key was already used with a different body.
+func (store *IdempotencyStore) Do(key string, body []byte, submit func() (id int64, ok bool)) (id int64, replayed bool, conflict bool) {
+	fingerprint := sha256.Sum256(body)
+	for {
+		store.mu.Lock()
+		entry, exists := store.entries[key]
+		if exists && !entry.pending && !time.Now().Before(entry.expires_at) {
+			exists = false
+		}
+		if !exists {
+			entry = &idempotency_entry{fingerprint: fingerprint, pending: true, done: make(chan struct{})}
+			store.entries[key] = entry
+			store.mu.Unlock()
+			return store.submit(key, entry, submit), false, false
+		}
+		store.mu.Unlock()
+		if entry.fingerprint != fingerprint {
+			return -1, false, true
+		}
+		<-entry.done
+		if entry.accepted {
+			return entry.id, true, false
+		}
+	}
+}
+
+// submit runs submit for the entry that reserved key and publishes its outcome.
+func (store *IdempotencyStore) submit(key string, entry *idempotency_entry, submit func() (int64, bool)) int64 {
+	id, ok := submit()
+	store.mu.Lock()
+	entry.pending = false
+	if ok {
+		entry.id = id
+		entry.accepted = true
+		entry.expires_at = time.Now().Add(store.retention)
+	} else {
+		delete(store.entries, key)
+	}
+	store.mu.Unlock()
+	close(entry.done)
+	return id
+}
+
+// Evict removes expired keys and returns how many were removed.
+func (store *IdempotencyStore) Evict() int {
+	now := time.Now()
+	n := 0
+	store.mu.Lock()
+	for key, entry := range store.entries {
+		if !entry.pending && !now.Before(entry.expires_at) {
+			delete(store.entries, key)
+			n++
+		}
+	}
+	store.mu.Unlock()
+	return n
+}
+
+func (store *IdempotencyStore) Len() int {
+	store.mu.Lock()
+	n := len(store.entries)
+	store.mu.Unlock()
+	return n
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"api"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKeyReplaysTheSameBody(t *testing.T) {
+	with_workers(t)
+	previous := idempotency_keys
+	idempotency_keys = NewIdempotencyStore(time.Hour)
+	t.Cleanup(func() { idempotency_keys = previous })
+
+	body := []byte(`{"data":"x"}`)
+	id, replayed, error_code, _ := submit_task(&api.SubmitRequest{Data: "x"}, "k", body)
+	if error_code != "" || replayed {
+		t.Fatalf("Got: %q replayed=%v on the first submit", error_code, replayed)
+	}
+	again, replayed, error_code, _ := submit_task(&api.SubmitRequest{Data: "x"}, "k", body)
+	if error_code != "" || !replayed || again != id {
+		t.Fatalf("Got: task %d %q replayed=%v\nWant: task %d replayed", again, error_code, replayed, id)
+	}
+	if pending_tasks.Len() != 1 {
+		t.Fatalf("Got: %d pending tasks\nWant: 1", pending_tasks.Len())
+	}
+
+	_, _, error_code, code := submit_task(&api.SubmitRequest{Data: "y"}, "k", []byte(`{"data":"y"}`))
+	if error_code != api.IDEMPOTENCY_KEY_REUSED || code != http.StatusUnprocessableEntity {
+		t.Fatalf("Got: %q %d\nWant: %q 422", error_code, code, api.IDEMPOTENCY_KEY_REUSED)
+	}
+}
+
+func TestIdempotencyKeysExpire(t *testing.T) {
+	store := NewIdempotencyStore(time.Millisecond * 20)
+	calls := int64(0)
+	submit := func() (int64, bool) {
+		calls++
+		return calls, true
+	}
+	store.Do("k", nil, submit)
+	if id, replayed, _ := store.Do("k", nil, submit); !replayed || id != 1 {
+		t.Fatalf("Got: task %d replayed=%v before expiry\nWant: task 1 replayed", id, replayed)
+	}
+
+	time.Sleep(time.Millisecond * 30)
+	if n := store.Evict(); n != 1 || store.Len() != 0 {
+		t.Fatalf("Got: %d evicted, %d left\nWant: 1, 0", n, store.Len())
+	}
+	if id, replayed, _ := store.Do("k", []byte("other body"), submit); replayed || id != 2 {
+		t.Fatalf("Got: task %d replayed=%v after expiry\nWant: a new task 2", id, replayed)
+	}
+}
+
+func TestIdempotencyKeyIsReservedWhileSubmitting(t *testing.T) {
+	store := NewIdempotencyStore(time.Hour)
+	release := make(chan struct{})
+	calls := atomic.Int64{}
+	started := make(chan struct{})
+	slow := func() (int64, bool) {
+		if calls.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		return 7, true
+	}
+
+	var wg sync.WaitGroup
+	ids := make([]int64, 4)
+	for i := range ids {
+		wg.Go(func() { ids[i], _, _ = store.Do("k", nil, slow) })
+	}
+	<-started
+	// Other keys go through while "k" is being submitted.
+	done := make(chan struct{})
+	go func() {
+		store.Do("other", nil, func() (int64, bool) { return 8, true })
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		t.Fatal("A submit with another key waited for a pending one")
+	}
+	if _, _, conflict := store.Do("k", []byte("different"), slow); !conflict {
+		t.Fatal("A different body for a pending key is not a conflict")
+	}
+
+	close(release)
+	wg.Wait()
+	if calls.Load() != 1 {
+		t.Fatalf("Got: %d submissions for one key\nWant: 1", calls.Load())
+	}
+	for _, id := range ids {
+		if id != 7 {
+			t.Fatalf("Got: %v\nWant: every request with task 7", ids)
+		}
+	}
+}
+
+func TestRejectedSubmissionLeavesTheKeyFree(t *testing.T) {
+	store := NewIdempotencyStore(time.Hour)
+	store.Do("k", nil, func() (int64, bool) { return -1, false })
+	if id, replayed, _ := store.Do("k", nil, func() (int64, bool) { return 3, true }); replayed || id != 3 {
+		t.Fatalf("Got: task %d replayed=%v\nWant: task 3 submitted anew", id, replayed)
+	}
+}
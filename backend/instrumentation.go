@@ -0,0 +1,158 @@
+package main
+
+import (
+	"api"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	metrics = &api.Registry{}
+
+	tasks_submitted_total = api.NewCounterVec(metrics,
+		"backend_tasks_submitted_total", "Tasks accepted by POST /submit and POST /submit/batch.",
+	)
+	submissions_rejected_total = api.NewCounterVec(metrics,
+		"backend_submissions_rejected_total", "Submissions rejected by admission control with 429, by reason.",
+		"reason",
+	)
+	auth_failures_total = api.NewCounterVec(metrics,
+		"backend_auth_failures_total", "Requests rejected for a missing or unknown API key (unauthenticated) or a role not allowed on the route (forbidden).",
+		"reason",
+	)
+	tasks_dequeued_total = api.NewCounterVec(metrics,
+		"backend_tasks_dequeued_total", "Tasks handed to workers by GET /pending.",
+	)
+	tasks_completed_total = api.NewCounterVec(metrics,
+		"backend_tasks_completed_total", "Tasks that reached a terminal status, by that status.",
+		"status",
+	)
+	task_queue_seconds = api.NewHistogramVec(metrics,
+		"backend_task_queue_seconds", "Time from a task becoming pending to it being handed to a worker.",
+		api.ExponentialBuckets(0.005, 2, 18),
+	)
+	task_processing_seconds = api.NewHistogramVec(metrics,
+		"backend_task_processing_seconds", "Time from a task being handed to a worker to its output being recorded.",
+		api.ExponentialBuckets(0.005, 2, 18),
+	)
+	http_request_seconds = api.NewHistogramVec(metrics,
+		"backend_http_request_duration_seconds", "HTTP request latency by route pattern and status code. GET /pending includes the long-poll wait.",
+		api.ExponentialBuckets(0.0005, 2, 20),
+		"route", "code",
+	)
+	webhook_deliveries_total = api.NewCounterVec(metrics,
+		"backend_webhook_deliveries_total", "Webhook delivery attempts by response status code, 0 when no response was received.",
+		"code",
+	)
+	workers_died_total = api.NewCounterVec(metrics,
+		"backend_workers_died_total", "Workers declared dead after missing their heartbeats.",
+	)
+	tasks_requeued_total = api.NewCounterVec(metrics,
+		"backend_tasks_requeued_total", "PROCESSING tasks handed back to the pending queue because their worker went away or released them, by reason.",
+		"reason",
+	)
+	long_polls_in_flight = api.NewGaugeVec(metrics,
+		"backend_long_polls_in_flight", "GET /pending requests waiting for a task.",
+	)
+	_ = api.NewGaugeFunc(metrics,
+		"backend_tasks", "Retained tasks by status.",
+		[]string{"status"},
+		func() map[string]float64 {
+			counts := map[string]float64{
+				api.STATUS_SCHEDULED:  0,
+				api.STATUS_PENDING:    0,
+				api.STATUS_PROCESSING: 0,
+				api.STATUS_FINISHED:   0,
+				api.STATUS_FAILED:     0,
+				api.STATUS_CANCELLED:  0,
+			}
+			all_tasks.Range(func(task *Task) { counts[task.Status]++ })
+			return counts
+		},
+	)
+	_ = api.NewGaugeFunc(metrics,
+		"backend_workers", "Registered workers by status.",
+		[]string{"status"},
+		func() map[string]float64 {
+			alive, dead := workers.Counts()
+			return map[string]float64{api.WORKER_ALIVE: float64(alive), api.WORKER_DEAD: float64(dead)}
+		},
+	)
+	_ = api.NewGaugeFunc(metrics,
+		"backend_worker_slots", "Slots of live workers by state, as of their last heartbeat. Their sum is the number of tasks workers can process at once.",
+		[]string{"state"},
+		func() map[string]float64 {
+			counts := map[string]float64{}
+			for state, n := range workers.SlotCounts() {
+				counts[state] = float64(n)
+			}
+			return counts
+		},
+	)
+	_ = api.NewGaugeFunc(metrics,
+		"backend_pending_queue_length", "Tasks waiting in the pending queue. This is what the autoscaler scales on.",
+		nil,
+		func() map[string]float64 { return map[string]float64{"": float64(pending_tasks.Len())} },
+	)
+	_ = api.NewGaugeFunc(metrics,
+		"backend_pending_queue_length_by_type", "Tasks waiting in the pending queue, by task type.",
+		[]string{"type"},
+		func() map[string]float64 {
+			lens := map[string]float64{}
+			for task_type, n := range pending_tasks.Lens() {
+				lens[task_type] = float64(n)
+			}
+			return lens
+		},
+	)
+	_ = api.NewGaugeFunc(metrics,
+		"backend_retained_bytes", "Estimated heap held by finished, failed and cancelled tasks.",
+		nil,
+		func() map[string]float64 { return map[string]float64{"": float64(retention.Bytes())} },
+	)
+	_ = api.NewGaugeFunc(metrics,
+		"backend_event_subscriptions", "Tasks watched by open event streams, counted once per stream.",
+		nil,
+		func() map[string]float64 { return map[string]float64{"": float64(task_events.Len())} },
+	)
+	_ = api.NewGaugeFunc(metrics,
+		"backend_idempotency_keys", "Idempotency keys currently remembered.",
+		nil,
+		func() map[string]float64 { return map[string]float64{"": float64(idempotency_keys.Len())} },
+	)
+)
+
+// instrument records http_request_seconds for every request served by handler.
+func instrument(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &status_recorder{ResponseWriter: w, code: http.StatusOK}
+		handler.ServeHTTP(recorder, r)
+		// The mux fills in r.Pattern. Unmatched requests all share one label to bound cardinality.
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		http_request_seconds.Observe(time.Since(start).Seconds(), route, strconv.Itoa(recorder.code))
+	})
+}
+
+type status_recorder struct {
+	http.ResponseWriter
+	code         int
+	wrote_header bool
+}
+
+func (recorder *status_recorder) WriteHeader(code int) {
+	if !recorder.wrote_header {
+		recorder.code = code
+		recorder.wrote_header = true
+	}
+	recorder.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, which GET /pending needs to flush.
+func (recorder *status_recorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"api"
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_LIST_LIMIT = 100
+	MAX_LIST_LIMIT     = 1000
+)
+
+// task_sort_keys maps each ?sort value to the field it orders by. A leading "-" sorts descending.
+// Ties are always broken by ID in the same direction, which makes the order total and so lets the
+// cursor be a single (key, id) position.
+var task_sort_keys = map[string]func(task *Task) int64{
+	"id":           func(task *Task) int64 { return task.ID },
+	"submitted_at": func(task *Task) int64 { return task.SubmittedAt.UnixNano() },
+	"started_at":   func(task *Task) int64 { return unix_nano_or_zero(task.StartedAt) },
+	"priority":     func(task *Task) int64 { return int64(task.Priority) },
+}
+
+// list_cursor is the decoded form of api.TaskListing.NextCursor. Sort is included so that a cursor
+// cannot be replayed against a different ordering.
+type list_cursor struct {
+	Sort string `json:"s"`
+	Key  int64  `json:"k"`
+	ID   int64  `json:"i"`
+}
+
+// list_tasks answers GET /tasks. Filters:
+//
+//	status=PENDING,PROCESSING         any of the listed statuses
+//	submitted_after, submitted_before RFC 3339, exclusive
+//	started_before                    RFC 3339, exclusive. Tasks that never started do not match.
+//	min_priority, max_priority        inclusive
+//	sort=id|submitted_at|started_at|priority, prefixed with "-" for descending. Defaults to id.
+//	limit                             page size, at most MAX_LIST_LIMIT
+//	cursor                            next_cursor from the previous page
+//
+// For example, tasks stuck in PROCESSING for more than 10 minutes are
+// ?status=PROCESSING&started_before=<now - 10m>&sort=started_at.
+func list_tasks(query url.Values) (listing *api.TaskListing, code int) {
+	listing = &api.TaskListing{Tasks: []api.TaskSummary{}, Counts: map[string]int{}}
+	fail := func(error_code api.Code) (*api.TaskListing, int) {
+		listing.Error = error_code
+		return listing, http.StatusBadRequest
+	}
+
+	statuses := map[string]bool{}
+	if v := query.Get("status"); v != "" {
+		for _, status := range strings.Split(v, ",") {
+			switch status {
+			case api.STATUS_SCHEDULED, api.STATUS_PENDING, api.STATUS_PROCESSING, api.STATUS_FINISHED, api.STATUS_FAILED, api.STATUS_CANCELLED:
+				statuses[status] = true
+			default:
+				return fail(api.MALFORMED_STATUS)
+			}
+		}
+	}
+	parse_time := func(key string) (time.Time, bool) {
+		v := query.Get(key)
+		if v == "" {
+			return time.Time{}, true
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		return t, err == nil
+	}
+	submitted_after, ok1 := parse_time("submitted_after")
+	submitted_before, ok2 := parse_time("submitted_before")
+	started_before, ok3 := parse_time("started_before")
+	if !ok1 || !ok2 || !ok3 {
+		return fail(api.MALFORMED_TIME)
+	}
+	parse_int := func(key string, fallback int) (int, bool) {
+		v := query.Get(key)
+		if v == "" {
+			return fallback, true
+		}
+		i, err := strconv.Atoi(v)
+		return i, err == nil
+	}
+	min_priority, ok1 := parse_int("min_priority", math.MinInt)
+	max_priority, ok2 := parse_int("max_priority", math.MaxInt)
+	if !ok1 || !ok2 {
+		return fail(api.MALFORMED_PRIORITY)
+	}
+	limit, ok := parse_int("limit", DEFAULT_LIST_LIMIT)
+	if !ok || limit <= 0 || limit > MAX_LIST_LIMIT {
+		return fail(api.MALFORMED_LIMIT)
+	}
+
+	sort := query.Get("sort")
+	if sort == "" {
+		sort = "id"
+	}
+	descending := strings.HasPrefix(sort, "-")
+	sort_key, ok := task_sort_keys[strings.TrimPrefix(sort, "-")]
+	if !ok {
+		return fail(api.MALFORMED_SORT)
+	}
+	var cursor *list_cursor
+	if v := query.Get("cursor"); v != "" {
+		cursor = &list_cursor{}
+		b, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil || json.Unmarshal(b, cursor) != nil || cursor.Sort != sort {
+			return fail(api.MALFORMED_CURSOR)
+		}
+	}
+	// after reports whether (key, id) comes strictly after (cursor_key, cursor_id) in the requested order.
+	after := func(key, id, cursor_key, cursor_id int64) bool {
+		if descending {
+			key, id, cursor_key, cursor_id = cursor_key, cursor_id, key, id
+		}
+		return key > cursor_key || (key == cursor_key && id > cursor_id)
+	}
+
+	type match struct {
+		key     int64
+		summary api.TaskSummary
+	}
+	matches := []match{}
+	// This is a full scan, which is fine for an operator endpoint at the number of tasks that
+	// retention lets the backend hold.
+	all_tasks.Range(func(task *Task) {
+		listing.Counts[task.Status]++
+		switch {
+		case len(statuses) > 0 && !statuses[task.Status]:
+			return
+		case !submitted_after.IsZero() && !task.SubmittedAt.After(submitted_after):
+			return
+		case !submitted_before.IsZero() && !task.SubmittedAt.Before(submitted_before):
+			return
+		case !started_before.IsZero() && (task.StartedAt.IsZero() || !task.StartedAt.Before(started_before)):
+			return
+		case task.Priority < min_priority || task.Priority > max_priority:
+			return
+		}
+		key := sort_key(task)
+		if cursor != nil && !after(key, task.ID, cursor.Key, cursor.ID) {
+			return
+		}
+		matches = append(matches, match{key: key, summary: api.TaskSummary{
+			ID:          task.ID,
+			Type:        task.Type,
+			Status:      task.Status,
+			Priority:    task.Priority,
+			SubmittedAt: format_time(task.SubmittedAt),
+			RunAt:       format_time(task.RunAt),
+			StartedAt:   format_time(task.StartedAt),
+			FinishedAt:  format_time(task.FinishedAt),
+		}})
+	})
+
+	slices.SortFunc(matches, func(a, b match) int {
+		switch {
+		case a.key == b.key && a.summary.ID == b.summary.ID:
+			return 0
+		case after(a.key, a.summary.ID, b.key, b.summary.ID):
+			return 1
+		default:
+			return -1
+		}
+	})
+	if len(matches) > limit {
+		last := matches[limit-1]
+		b, _ := json.Marshal(&list_cursor{Sort: sort, Key: last.key, ID: last.summary.ID})
+		listing.NextCursor = base64.RawURLEncoding.EncodeToString(b)
+		matches = matches[:limit]
+	}
+	for _, m := range matches {
+		listing.Tasks = append(listing.Tasks, m.summary)
+	}
+	return listing, http.StatusOK
+}
+
+func format_time(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// unix_nano_or_zero keeps the zero time at 0 so that tasks that never started sort first.
+func unix_nano_or_zero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"api"
+	"encoding/base64"
+	"net/url"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestListTasksPaginatesWithoutGapsOrDuplicates(t *testing.T) {
+	t.Cleanup(func() { all_tasks = NewTaskTable(DEFAULT_TASK_SHARDS) })
+	epoch := time.Now()
+	for id := range int64(7) {
+		all_tasks.Insert(&Task{ID: id, Status: api.STATUS_PENDING, Priority: int(id % 3), SubmittedAt: epoch})
+	}
+
+	for _, sort := range []string{"id", "-id", "priority", "-priority", "submitted_at"} {
+		seen := map[int64]bool{}
+		query := url.Values{"sort": {sort}, "limit": {"2"}}
+		for page := 0; ; page++ {
+			listing, code := list_tasks(query)
+			if code != 200 || listing.Error != "" {
+				t.Fatalf("Sort: %s\nGot: %d %s", sort, code, listing.Error)
+			}
+			for _, summary := range listing.Tasks {
+				if seen[summary.ID] {
+					t.Fatalf("Sort: %s\nTask %d listed twice", sort, summary.ID)
+				}
+				seen[summary.ID] = true
+			}
+			if listing.NextCursor == "" {
+				break
+			}
+			query.Set("cursor", listing.NextCursor)
+		}
+		if len(seen) != 7 {
+			t.Fatalf("Sort: %s\nGot: %d tasks\nWant: 7 tasks", sort, len(seen))
+		}
+	}
+
+	// A cursor only applies to the ordering it was issued for
+	listing, _ := list_tasks(url.Values{"sort": {"id"}, "limit": {"2"}})
+	if _, code := list_tasks(url.Values{"sort": {"-id"}, "cursor": {listing.NextCursor}}); code != 400 {
+		t.Fatalf("Got: %d\nWant: 400", code)
+	}
+}
+
+func TestListTasksFiltersAndSorts(t *testing.T) {
+	t.Cleanup(func() { all_tasks = NewTaskTable(DEFAULT_TASK_SHARDS) })
+	epoch := time.Now().Truncate(time.Second)
+	at := func(minutes int) time.Time { return epoch.Add(time.Minute * time.Duration(minutes)) }
+	format := func(minutes int) string { return at(minutes).Format(time.RFC3339) }
+	for _, task := range []*Task{
+		{ID: 0, Status: api.STATUS_FINISHED, Priority: 0, SubmittedAt: at(0), StartedAt: at(1)},
+		{ID: 1, Status: api.STATUS_PROCESSING, Priority: 2, SubmittedAt: at(1), StartedAt: at(2)},
+		{ID: 2, Status: api.STATUS_PROCESSING, Priority: 1, SubmittedAt: at(2), StartedAt: at(25)},
+		{ID: 3, Status: api.STATUS_PENDING, Priority: 5, SubmittedAt: at(3)},
+		{ID: 4, Status: api.STATUS_SCHEDULED, Priority: -1, SubmittedAt: at(4)},
+		{ID: 5, Status: api.STATUS_PROCESSING, Priority: 3, SubmittedAt: at(5), StartedAt: at(5)},
+	} {
+		all_tasks.Insert(task)
+	}
+
+	tests := []struct {
+		name  string
+		query url.Values
+		want  []int64
+	}{
+		{"by id by default", url.Values{}, []int64{0, 1, 2, 3, 4, 5}},
+		{"by priority descending", url.Values{"sort": {"-priority"}}, []int64{3, 5, 1, 2, 0, 4}},
+		{"by submission descending", url.Values{"sort": {"-submitted_at"}}, []int64{5, 4, 3, 2, 1, 0}},
+		{"by start, unstarted first", url.Values{"sort": {"started_at"}}, []int64{3, 4, 0, 1, 5, 2}},
+		{"any of several statuses", url.Values{"status": {"PENDING,SCHEDULED"}}, []int64{3, 4}},
+		{"submitted between, exclusive", url.Values{"submitted_after": {format(1)}, "submitted_before": {format(4)}}, []int64{2, 3}},
+		{"started before, exclusive", url.Values{"started_before": {format(5)}}, []int64{0, 1}},
+		{"priority range, inclusive", url.Values{"min_priority": {"1"}, "max_priority": {"3"}}, []int64{1, 2, 5}},
+		{
+			"PROCESSING for more than 10 minutes",
+			url.Values{"status": {api.STATUS_PROCESSING}, "started_before": {format(30 - 10)}, "sort": {"started_at"}},
+			[]int64{1, 5},
+		},
+	}
+	for _, tt := range tests {
+		listing, code := list_tasks(tt.query)
+		if code != 200 || listing.Error != "" {
+			t.Fatalf("%s\nGot: %d %s", tt.name, code, listing.Error)
+		}
+		got := []int64{}
+		for _, summary := range listing.Tasks {
+			got = append(got, summary.ID)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s\nGot: %v\nWant: %v", tt.name, got, tt.want)
+		}
+		// Counts cover every task, whatever the filters.
+		if listing.Counts[api.STATUS_PROCESSING] != 3 || listing.Counts[api.STATUS_PENDING] != 1 {
+			t.Errorf("%s\nGot counts: %v", tt.name, listing.Counts)
+		}
+	}
+}
+
+func TestListTasksRejectsMalformedQueries(t *testing.T) {
+	tests := []struct {
+		query url.Values
+		want  api.Code
+	}{
+		{url.Values{"status": {"DONE"}}, api.MALFORMED_STATUS},
+		{url.Values{"status": {"PENDING,"}}, api.MALFORMED_STATUS},
+		{url.Values{"submitted_after": {"yesterday"}}, api.MALFORMED_TIME},
+		{url.Values{"submitted_before": {"2024-01-01"}}, api.MALFORMED_TIME},
+		{url.Values{"started_before": {"x"}}, api.MALFORMED_TIME},
+		{url.Values{"min_priority": {"high"}}, api.MALFORMED_PRIORITY},
+		{url.Values{"max_priority": {"1.5"}}, api.MALFORMED_PRIORITY},
+		{url.Values{"limit": {"0"}}, api.MALFORMED_LIMIT},
+		{url.Values{"limit": {strconv.Itoa(MAX_LIST_LIMIT + 1)}}, api.MALFORMED_LIMIT},
+		{url.Values{"sort": {"name"}}, api.MALFORMED_SORT},
+		{url.Values{"cursor": {"not base64!"}}, api.MALFORMED_CURSOR},
+		{url.Values{"cursor": {base64.RawURLEncoding.EncodeToString([]byte("not json"))}}, api.MALFORMED_CURSOR},
+	}
+	for _, tt := range tests {
+		if listing, code := list_tasks(tt.query); code != 400 || listing.Error != tt.want {
+			t.Errorf("%v\nGot: %d %q\nWant: 400 %q", tt.query, code, listing.Error, tt.want)
+		}
+	}
+}
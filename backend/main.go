@@ -1,12 +1,15 @@
 package main
 
 import (
+	"api"
+	"context"
 	"encoding/json"
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
-	"sync"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -15,12 +18,55 @@ import (
 )
 
 var (
+	lgr = itlog.New(os.Stdout, itlog.LevelInfo)
+
 	next_id atomic.Int64
 
-	pending_tasks = NewInt64Queue()
+	pending_tasks   = NewPendingQueues()
+	scheduled_tasks = NewScheduler(release_scheduled)
+
+	all_tasks = NewTaskTable(int(get_env_int64("TASK_SHARDS", DEFAULT_TASK_SHARDS)))
+
+	retention = NewRetention(
+		get_env_duration("TASK_RETENTION_SECOND", time.Second, time.Hour),
+		get_env_int64("TASK_RETENTION_BYTES", 1<<30),
+	)
+
+	idempotency_keys = NewIdempotencyStore(get_env_duration("IDEMPOTENCY_RETENTION_SECOND", time.Second, time.Hour))
+
+	// Outputs whose estimated size exceeds BLOB_THRESHOLD_BYTES are kept in blobs instead of the
+	// heap. blobs is set up by main.
+	blobs                *BlobStore
+	BLOB_THRESHOLD_BYTES = get_env_int64("BLOB_THRESHOLD_BYTES", 64<<10)
+
+	task_events = NewEventBus()
+
+	// api_keys is set up by main from AUTH_KEYS_FILE. While it is nil, authentication is disabled.
+	api_keys *APIKeys
 
-	all_tasks    = make(map[int64]*Task)
-	all_tasks_mu = sync.RWMutex{}
+	// Every admission limit is disabled while its variable is unset. See Admission.
+	admission = NewAdmission(
+		get_env_int64("ADMISSION_MAX_PENDING", 0),
+		get_env_int64("ADMISSION_MAX_HEAP_BYTES", 0),
+		get_env_int64("ADMISSION_SHED_PERCENT", 0),
+		int(get_env_int64("ADMISSION_SHED_MIN_PRIORITY", 1)),
+		float64(get_env_int64("ADMISSION_RATE_PER_SECOND", 0)),
+		float64(get_env_int64("ADMISSION_BURST", get_env_int64("ADMISSION_RATE_PER_SECOND", 0))),
+	)
+
+	workers = NewWorkerRegistry(
+		get_env_duration("WORKER_HEARTBEAT_SECOND", time.Second, time.Second*5),
+		int(get_env_int64("WORKER_MISSED_HEARTBEATS", 3)),
+		get_env_duration("WORKER_DEAD_RETENTION_SECOND", time.Second, time.Minute*10),
+	)
+
+	// Callback URLs are rejected on submit while WEBHOOK_SECRET is unset.
+	webhooks = NewWebhooks(
+		all_tasks,
+		[]byte(os.Getenv("WEBHOOK_SECRET")),
+		int(get_env_int64("WEBHOOK_MAX_ATTEMPTS", 5)),
+		time.Second,
+	)
 )
 
 type Task struct {
@@ -28,149 +74,428 @@ type Task struct {
 	Status string
 	Input  string
 	Output []string
+	// OutputRef replaces Output when the output was offloaded to blobs. It holds the output's JSON
+	// encoding.
+	OutputRef string
+	Priority  int
+	// RunAt is zero for tasks that were pending from the moment they were submitted.
+	RunAt       time.Time
+	SubmittedAt time.Time
+	// StartedAt is when the task was last handed to a worker. It is zero until then.
+	StartedAt time.Time
+	// FinishedAt is when the task reached a terminal status.
+	FinishedAt time.Time
+	// CallbackURL is empty if the submitter did not ask for a webhook.
+	CallbackURL string
+	Deliveries  []api.DeliveryAttempt
+	// Type selects the worker handler that runs the task.
+	Type string
+	// Failure is the reason reported by the worker for a FAILED task, and FailureMessage the
+	// handler's error, truncated to MAX_FAILURE_MESSAGE_LENGTH.
+	Failure        string
+	FailureMessage string
+	// Timeout is how long the submitter allows the worker to compute the task, 0 if unlimited.
+	Timeout time.Duration
+	// WorkerID is the registered worker processing the task. It is empty when the task is not
+	// PROCESSING, or the worker did not register.
+	WorkerID string
 }
 
-const (
-	STATUS_PENDING    = "PENDING"
-	STATUS_PROCESSING = "PROCESSING"
-	STATUS_FINISHED   = "FINISHED"
-)
+// MAX_BATCH_SIZE bounds POST /submit/batch, POST /processed/batch and GET /pending?max.
+const MAX_BATCH_SIZE = 1000
+
+// MAX_FAILURE_MESSAGE_LENGTH bounds the handler errors kept with FAILED tasks.
+const MAX_FAILURE_MESSAGE_LENGTH = 4096
+
+// MAX_SCHEDULE_DELAY bounds SubmitRequest.DelayMillisecond.
+const MAX_SCHEDULE_DELAY = time.Hour * 24 * 30
+
+// MAX_TASK_TIMEOUT bounds SubmitRequest.TimeoutMillisecond.
+const MAX_TASK_TIMEOUT = time.Hour * 24
+
+// MAX_LONG_POLL bounds GET /pending?wait.
+const MAX_LONG_POLL = time.Minute * 5
+
+// get_env_int64 reads a positive integer from key, returning fallback when it is unset.
+func get_env_int64(key string, fallback int64) int64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	i, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		panic(err)
+	}
+	if i <= 0 {
+		panic(key + " must be positive")
+	}
+	return i
+}
+
+// get_env_duration reads key as an integer count of unit, returning fallback when it is unset.
+func get_env_duration(key string, unit time.Duration, fallback time.Duration) time.Duration {
+	return unit * time.Duration(get_env_int64(key, int64(fallback/unit)))
+}
 
 func main() {
-	lgr := itlog.New(os.Stdout, itlog.LevelInfo)
 	if os.Getenv("SILENCE_LOGS") == "true" {
 		lgr.Level = itlog.LevelDisabled
 	}
+
+	blob_dir := os.Getenv("BLOB_DIR")
+	if blob_dir == "" {
+		blob_dir = filepath.Join(os.TempDir(), "backend-blobs")
+	}
+	var err error
+	blobs, err = NewBlobStore(blob_dir)
+	if err != nil {
+		lgr.Error(err).Str("dir", blob_dir).Msg("initialize blob store")
+		os.Exit(1)
+	}
+	if path := os.Getenv("AUTH_KEYS_FILE"); path != "" {
+		api_keys, err = LoadAPIKeys(path)
+		if err != nil {
+			lgr.Error(err).Msg("load API keys")
+			os.Exit(1)
+		}
+		lgr.Info().Int("keys", api_keys.Len()).Msg("loaded API keys")
+	} else {
+		lgr.Warn().Msg("AUTH_KEYS_FILE is unset. every endpoint is open to anyone")
+	}
 	lgr.Info().Msg("backend initialized")
 
 	t := time.NewTicker(time.Second * 3)
 	go func() {
 		for range t.C {
-			lgr.Info().Int("pending_count", pending_tasks.Len()).Msg("checking pending tasks count")
+			lgr.Info().
+				Int("pending_count", pending_tasks.Len()).
+				Int("scheduled_count", scheduled_tasks.Len()).
+				Msg("checking pending tasks count")
 		}
 	}()
+	go scheduled_tasks.Run()
+	go webhooks.Run(context.Background(), int(get_env_int64("WEBHOOK_CONCURRENCY", 4)))
+	go admission.Run(time.Second)
+	if api_keys != nil {
+		go func() {
+			// Keys are rotated by editing the file. Mount its directory rather than the file itself
+			// into the container, or an editor replacing the file will not be seen.
+			t := time.NewTicker(get_env_duration("AUTH_RELOAD_SECOND", time.Second, time.Second*10))
+			for range t.C {
+				changed, err := api_keys.Reload()
+				switch {
+				case err != nil:
+					lgr.Error(err).Msg("reload API keys. keeping the previous keys")
+				case changed:
+					lgr.Info().Int("keys", api_keys.Len()).Msg("reloaded API keys")
+				}
+			}
+		}()
+	}
+	go func() {
+		t := time.NewTicker(time.Minute)
+		for now := range t.C {
+			admission.Evict(now)
+		}
+	}()
+	go func() {
+		t := time.NewTicker(workers.heartbeat_interval)
+		for now := range t.C {
+			for _, orphaned := range workers.Reap(now) {
+				requeue_orphaned(orphaned)
+			}
+		}
+	}()
+	go func() {
+		// Do already ignores expired keys, so the sweep only reclaims memory and can be infrequent.
+		t := time.NewTicker(min(idempotency_keys.retention, time.Minute))
+		for range t.C {
+			if n := idempotency_keys.Evict(); n > 0 {
+				lgr.Info().Int("evicted", n).Int("remaining", idempotency_keys.Len()).Msg("evicted expired idempotency keys")
+			}
+		}
+	}()
+	go func() {
+		t := time.NewTicker(get_env_duration("TASK_RETENTION_SWEEP_SECOND", time.Second, time.Second*10))
+		for now := range t.C {
+			if n, freed := retention.Sweep(now); n > 0 {
+				lgr.Info().
+					Int("evicted", n).
+					Int64("freed_bytes", freed).
+					Int64("retained_bytes", retention.Bytes()).
+					Msg("evicted expired tasks")
+			}
+		}
+	}()
+
+	mux := http.NewServeMux()
+	register_routes(mux)
+	http.ListenAndServe(":8080", instrument(authenticate(mux, api_keys)))
+}
 
+// register_routes registers every endpoint on mux. The task API is registered by handle, both with
+// and without api.PREFIX.
+func register_routes(mux *http.ServeMux) {
 	// === ONLY FOR AUTOSCALER ===
-	http.HandleFunc("GET /__SUPER_DUPER_SECRET_PENDING_COUNT__", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("GET /__SUPER_DUPER_SECRET_PENDING_COUNT__", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(strconv.Itoa(len(pending_tasks.data))))
+		w.Write([]byte(strconv.Itoa(pending_tasks.Len())))
 	})
 
-	http.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("Health check passed!"))
 	})
 
 	// === Client ===
-	http.HandleFunc("POST /submit", func(w http.ResponseWriter, r *http.Request) {
-		type Response struct {
-			ID    int64  `json:"id"`
-			Error string `json:"error"`
-		}
+	handle(mux, "POST /submit", func(w http.ResponseWriter, r *http.Request) {
+		type Response = api.SubmitResponse
 		write := func(resp *Response, code int) {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(code)
-			json.NewEncoder(w).Encode(resp)
+			respond(w, r, resp, resp.Error, code)
 		}
 
+		if ok, retry_after := admission.Take(client_id(r), 1, time.Now()); !ok {
+			submissions_rejected_total.Inc(REJECT_RATE_LIMITED)
+			set_retry_after(w, retry_after)
+			write(&Response{ID: -1, Error: api.RATE_LIMITED}, http.StatusTooManyRequests)
+			return
+		}
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
 			return
 		}
-		type Payload struct {
-			Data string `json:"data"`
-		}
-		payload := &Payload{}
+		payload := &api.SubmitRequest{}
 		if err := json.Unmarshal(body, &payload); err != nil {
-			write(&Response{ID: -1, Error: "Malformed_JSON"}, http.StatusBadRequest)
+			write(&Response{ID: -1, Error: api.MALFORMED_JSON}, http.StatusBadRequest)
 			return
 		}
 
-		task := Task{
-			ID:     next_id.Load(),
-			Input:  payload.Data,
-			Status: STATUS_PENDING,
+		id, replayed, error_code, code := submit_task(payload, r.Header.Get("Idempotency-Key"), body)
+		if replayed {
+			w.Header().Set("Idempotent-Replayed", "true")
+		}
+		if code == http.StatusTooManyRequests {
+			set_retry_after(w, OVERLOAD_RETRY_AFTER)
 		}
-		next_id.Add(1)
-		all_tasks_mu.Lock()
-		all_tasks[task.ID] = &task
-		all_tasks_mu.Unlock()
-		pending_tasks.Enqueue(task.ID)
-		write(&Response{ID: task.ID, Error: ""}, http.StatusOK)
+		write(&Response{ID: id, Error: error_code}, code)
 	})
 
 	// === Client ===
-	http.HandleFunc("GET /status/{id}", func(w http.ResponseWriter, r *http.Request) {
-		type Response struct {
-			ID     int64    `json:"id"`
-			Status string   `json:"status"`
-			Input  string   `json:"input"`
-			Output []string `json:"output"`
-			Error  string   `json:"error"`
+	handle(mux, "POST /submit/batch", func(w http.ResponseWriter, r *http.Request) {
+		type Response = api.SubmitResponse
+		fail := func(error_code api.Code, code int) {
+			respond(w, r, &Response{ID: -1, Error: error_code}, error_code, code)
 		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		payloads := []json.RawMessage{}
+		if err := json.Unmarshal(body, &payloads); err != nil {
+			fail(api.MALFORMED_JSON, http.StatusBadRequest)
+			return
+		}
+		if len(payloads) > MAX_BATCH_SIZE {
+			fail(api.BATCH_TOO_LARGE, http.StatusRequestEntityTooLarge)
+			return
+		}
+		// The rate limit applies to the batch as a whole: each item costs one token.
+		if ok, retry_after := admission.Take(client_id(r), len(payloads), time.Now()); !ok {
+			submissions_rejected_total.Add(float64(len(payloads)), REJECT_RATE_LIMITED)
+			set_retry_after(w, retry_after)
+			fail(api.RATE_LIMITED, http.StatusTooManyRequests)
+			return
+		}
+
+		// Items are independent: one malformed item does not prevent the others from being
+		// submitted. Each item may carry its own idempotency key.
+		responses := make([]Response, len(payloads))
+		for i, raw := range payloads {
+			payload := &api.SubmitRequest{}
+			if err := json.Unmarshal(raw, payload); err != nil {
+				responses[i] = Response{ID: -1, Error: api.MALFORMED_JSON}
+				continue
+			}
+			id, _, error_code, code := submit_task(payload, "", raw)
+			responses[i] = Response{ID: id, Error: error_code}
+			if code == http.StatusTooManyRequests {
+				set_retry_after(w, OVERLOAD_RETRY_AFTER)
+			}
+		}
+		respond(w, r, responses, "", http.StatusOK)
+	})
+
+	// === Client ===
+	handle(mux, "GET /status/{id}", func(w http.ResponseWriter, r *http.Request) {
+		type Response = api.StatusResponse
 		write := func(resp *Response, code int) {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(code)
-			json.NewEncoder(w).Encode(resp)
+			respond(w, r, resp, resp.Error, code)
 		}
 
 		id, err := strconv.Atoi(r.PathValue("id"))
 		if err != nil || id < 0 {
-			write(&Response{ID: -1, Status: "", Error: "Malformed_ID"}, http.StatusBadRequest)
+			write(&Response{ID: -1, Status: "", Error: api.MALFORMED_ID}, http.StatusBadRequest)
 			return
 		}
 
-		all_tasks_mu.RLock()
-		defer all_tasks_mu.RUnlock()
-		task, ok := all_tasks[int64(id)]
-		if !ok {
-			write(&Response{ID: -1, Status: "", Error: "Unknown_Task"}, http.StatusBadRequest)
+		// Encoding, which for a large output is most of the work, happens outside the shard lock.
+		task, blob, error_code, code := snapshot_task(int64(id))
+		if error_code != "" {
+			write(&Response{ID: task.ID, Status: task.Status, Error: error_code}, code)
 			return
 		}
-		if task.Status == STATUS_FINISHED {
-			write(&Response{ID: task.ID, Output: task.Output, Status: task.Status}, http.StatusOK)
-		} else {
-			write(&Response{ID: task.ID, Status: task.Status}, http.StatusOK)
+		if blob != nil {
+			output, err := io.ReadAll(blob)
+			blob.Close()
+			if err != nil {
+				lgr.Error(err).Int64("id", task.ID).Msg("read output blob")
+				write(&Response{ID: task.ID, Status: task.Status, Error: api.OUTPUT_UNAVAILABLE}, http.StatusInternalServerError)
+				return
+			}
+			// The blob already holds the output's JSON encoding, so it is sent as is instead of being
+			// decoded only to be encoded again.
+			resp := struct {
+				*Response
+				Output json.RawMessage `json:"output"`
+			}{&Response{ID: task.ID, Type: task.Type, Status: task.Status}, output}
+			respond(w, r, &resp, "", http.StatusOK)
+			return
+		}
+		switch task.Status {
+		case api.STATUS_FINISHED:
+			write(&Response{ID: task.ID, Type: task.Type, Output: task.Output, Status: task.Status}, http.StatusOK)
+		case api.STATUS_FAILED:
+			write(&Response{ID: task.ID, Type: task.Type, Status: task.Status, Failure: task.Failure, FailureMessage: task.FailureMessage}, http.StatusOK)
+		case api.STATUS_SCHEDULED:
+			write(&Response{ID: task.ID, Type: task.Type, Status: task.Status, RunAt: task.RunAt.Format(time.RFC3339)}, http.StatusOK)
+		default:
+			write(&Response{ID: task.ID, Type: task.Type, Status: task.Status}, http.StatusOK)
 		}
 	})
 
 	// === Worker ===
-	http.HandleFunc("GET /pending", func(w http.ResponseWriter, r *http.Request) {
-		type Response struct {
-			ID    int64  `json:"id"`
-			Input string `json:"input"`
+	handle(mux, "GET /pending", func(w http.ResponseWriter, r *http.Request) {
+		type Response = api.PendingTask
+		fail := func(error_code api.Code, code int) {
+			respond(w, r, &Response{ID: -1, Error: error_code}, error_code, code)
 		}
-		write := func(resp *Response, code int) {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(code)
-			json.NewEncoder(w).Encode(resp)
+
+		// Without ?max, the response is a single task object as it always was. With it, the
+		// response is an array of up to max tasks.
+		batch_size := 0
+		if v := r.URL.Query().Get("max"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 || n > MAX_BATCH_SIZE {
+				fail(api.MALFORMED_BATCH_SIZE, http.StatusBadRequest)
+				return
+			}
+			batch_size = n
 		}
 
-		id := pending_tasks.Dequeue()
-		all_tasks_mu.Lock()
-		{
-			all_tasks[id].Status = STATUS_PROCESSING
-			task := all_tasks[id]
-			write(&Response{ID: task.ID, Input: task.Input}, http.StatusOK)
+		// Workers that registered identify themselves, so that their tasks can be handed back if
+		// they die. One that was declared dead must register again first.
+		// They are only handed the task types they registered with. Workers that did not register
+		// predate task types and run api.DEFAULT_TASK_TYPE.
+		worker_id := r.Header.Get("Worker-ID")
+		if !acts_as_worker(r, worker_id) {
+			fail(api.FORBIDDEN, http.StatusForbidden)
+			return
+		}
+		types := default_types
+		if worker_id != "" {
+			var alive bool
+			if types, alive = workers.Types(worker_id); !alive {
+				fail(api.UNKNOWN_WORKER, http.StatusBadRequest)
+				return
+			}
 		}
-		all_tasks_mu.Unlock()
-	})
 
-	// === Worker ===
-	http.HandleFunc("POST /processed", func(w http.ResponseWriter, r *http.Request) {
-		type Response struct {
-			ID    int64  `json:"id"`
-			Error string `json:"error"`
+		// Without ?wait, the request waits until a task arrives or the worker disconnects. With it,
+		// the request gives up after the duration and replies 204 No Content.
+		ctx := r.Context()
+		if v := r.URL.Query().Get("wait"); v != "" {
+			wait, err := time.ParseDuration(v)
+			if err != nil || wait <= 0 || wait > MAX_LONG_POLL {
+				fail(api.MALFORMED_WAIT, http.StatusBadRequest)
+				return
+			}
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, wait)
+			defer cancel()
 		}
-		write := func(resp *Response, code int) {
+
+		// Only the first task is waited for. The rest of the batch is whatever is already queued.
+		tasks := make([]Response, 0, max(1, batch_size))
+		long_polls_in_flight.Inc()
+		for len(tasks) == 0 {
+			id, err := pending_tasks.Dequeue(ctx, types)
+			if err != nil {
+				long_polls_in_flight.Dec()
+				if r.Context().Err() == nil {
+					w.WriteHeader(http.StatusNoContent)
+				}
+				return
+			}
+			if claimed, ok := claim_pending(id, worker_id); ok {
+				tasks = append(tasks, claimed)
+			} else if worker_id != "" && !workers.Alive(worker_id) {
+				// Declared dead while waiting, so it must register again first.
+				long_polls_in_flight.Dec()
+				fail(api.UNKNOWN_WORKER, http.StatusBadRequest)
+				return
+			}
+		}
+		long_polls_in_flight.Dec()
+		for len(tasks) < batch_size {
+			id, ok := pending_tasks.TryDequeue(types)
+			if !ok {
+				break
+			}
+			claimed, ok := claim_pending(id, worker_id)
+			if !ok && worker_id != "" && !workers.Alive(worker_id) {
+				break
+			}
+			if ok {
+				tasks = append(tasks, claimed)
+			}
+		}
+
+		// The tasks are PROCESSING from here on. If the worker is gone by the time the response
+		// is written, they are handed back instead of being stranded. This cannot catch a write
+		// that lands in the socket buffer of a worker that dies before reading it.
+		var body []byte
+		var err error
+		if batch_size == 0 {
+			body, err = json.Marshal(&tasks[0])
+		} else {
+			body, err = json.Marshal(tasks)
+		}
+		invariant.AlwaysNil(err, "Tasks are JSON serializable")
+		delivered := r.Context().Err() == nil
+		if delivered {
 			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(code)
-			json.NewEncoder(w).Encode(resp)
+			w.WriteHeader(http.StatusOK)
+			_, err = w.Write(append(body, '\n'))
+			if err == nil {
+				err = http.NewResponseController(w).Flush()
+			}
+			delivered = err == nil
 		}
-		type Payload struct {
-			ID     int64    `json:"id"`
-			Input  string   `json:"input"`
-			Output []string `json:"output"`
+		if !delivered {
+			ids := make([]int64, len(tasks))
+			for i := range tasks {
+				ids[i] = tasks[i].ID
+			}
+			release_delivery(ids, worker_id)
+		}
+	})
+
+	// === Worker ===
+	handle(mux, "POST /processed", func(w http.ResponseWriter, r *http.Request) {
+		type Response = api.ProcessedResponse
+		write := func(resp *Response, code int) {
+			respond(w, r, resp, resp.Error, code)
 		}
 
 		// === Implementation ===
@@ -179,58 +504,277 @@ func main() {
 		if err != nil {
 			return
 		}
-		payload := &Payload{}
+		payload := &api.ProcessedRequest{}
 		if err := json.Unmarshal(body, &payload); err != nil {
-			invariant.Unreachable("Server generates valid JSON response")
+			write(&Response{ID: -1, Error: api.MALFORMED_JSON}, http.StatusBadRequest)
+			return
 		}
 
-		all_tasks_mu.Lock()
-		{
-			task, exists := all_tasks[payload.ID] // this line
-			invariant.Always(exists, "Worker processes an existing task")
-			invariant.Always(task.Input == payload.Input, "Worker's submitted output has expected input")
-			task.Output = payload.Output
-			task.Status = STATUS_FINISHED
-			write(&Response{ID: task.ID}, http.StatusOK)
+		worker_id := r.Header.Get("Worker-ID")
+		if !acts_as_worker(r, worker_id) {
+			write(&Response{ID: payload.ID, Error: api.FORBIDDEN}, http.StatusForbidden)
+			return
 		}
-		all_tasks_mu.Unlock()
+		error_code, code := complete_task(payload, worker_id)
+		write(&Response{ID: payload.ID, Error: error_code}, code)
 	})
-	http.ListenAndServe(":8080", nil)
-}
 
-type Int64Queue struct {
-	data        []int64
-	mu          sync.Mutex
-	has_pending *sync.Cond
-}
+	// === Worker ===
+	handle(mux, "POST /processed/batch", func(w http.ResponseWriter, r *http.Request) {
+		type Response = api.ProcessedResponse
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		payloads := []api.ProcessedRequest{}
+		if err := json.Unmarshal(body, &payloads); err != nil {
+			respond(w, r, &Response{ID: -1, Error: api.MALFORMED_JSON}, api.MALFORMED_JSON, http.StatusBadRequest)
+			return
+		}
 
-func NewInt64Queue() *Int64Queue {
-	queue := &Int64Queue{}
-	queue.has_pending = sync.NewCond(&queue.mu)
-	return queue
-}
+		worker_id := r.Header.Get("Worker-ID")
+		if !acts_as_worker(r, worker_id) {
+			respond(w, r, &Response{ID: -1, Error: api.FORBIDDEN}, api.FORBIDDEN, http.StatusForbidden)
+			return
+		}
+		responses := make([]Response, len(payloads))
+		for i := range payloads {
+			error_code, _ := complete_task(&payloads[i], worker_id)
+			responses[i] = Response{ID: payloads[i].ID, Error: error_code}
+		}
+		respond(w, r, responses, "", http.StatusOK)
+	})
 
-func (queue *Int64Queue) Len() int {
-	queue.mu.Lock()
-	n := len(queue.data)
-	queue.mu.Unlock()
-	return n
-}
+	// === Client ===
+	handle(mux, "POST /tasks/{id}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		type Response = api.CancelResponse
+		write := func(resp *Response, code int) {
+			respond(w, r, resp, resp.Error, code)
+		}
 
-func (queue *Int64Queue) Enqueue(v int64) {
-	queue.mu.Lock()
-	queue.data = append(queue.data, v)
-	queue.has_pending.Signal()
-	queue.mu.Unlock()
-}
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil || id < 0 {
+			write(&Response{ID: -1, Error: api.MALFORMED_ID}, http.StatusBadRequest)
+			return
+		}
 
-func (queue *Int64Queue) Dequeue() int64 {
-	queue.mu.Lock()
-	for len(queue.data) == 0 {
-		queue.has_pending.Wait()
-	}
-	v := queue.data[0]
-	queue.data = queue.data[1:]
-	queue.mu.Unlock()
-	return v
+		status, error_code, code := cancel_task(int64(id))
+		if status == "" {
+			write(&Response{ID: -1, Error: error_code}, code)
+			return
+		}
+		write(&Response{ID: int64(id), Status: status, Error: error_code}, code)
+	})
+
+	// === Client ===
+	handle(mux, "GET /tasks/{id}/deliveries", func(w http.ResponseWriter, r *http.Request) {
+		type Response = api.DeliveriesResponse
+		write := func(resp *Response, code int) {
+			respond(w, r, resp, resp.Error, code)
+		}
+
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil || id < 0 {
+			write(&Response{ID: -1, Error: api.MALFORMED_ID}, http.StatusBadRequest)
+			return
+		}
+
+		shard := all_tasks.Shard(int64(id))
+		shard.RLock()
+		task, error_code, code := lookup_task(int64(id))
+		if task == nil {
+			shard.RUnlock()
+			write(&Response{ID: -1, Error: error_code}, code)
+			return
+		}
+		resp := &Response{
+			ID:          task.ID,
+			CallbackURL: task.CallbackURL,
+			Deliveries:  append([]api.DeliveryAttempt{}, task.Deliveries...),
+		}
+		shard.RUnlock()
+		write(resp, http.StatusOK)
+	})
+
+	// === Client ===
+	handle(mux, "GET /tasks/{id}/events", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil || id < 0 {
+			respond(w, r, &api.TaskEvent{ID: -1, Error: api.MALFORMED_ID}, api.MALFORMED_ID, http.StatusBadRequest)
+			return
+		}
+		stream_events(w, r, []int64{int64(id)})
+	})
+
+	// === Client ===
+	// Multiplexed form of GET /tasks/{id}/events: GET /events?ids=1,2,3
+	handle(mux, "GET /events", func(w http.ResponseWriter, r *http.Request) {
+		fail := func(error_code api.Code) {
+			respond(w, r, &api.TaskEvent{ID: -1, Error: error_code}, error_code, http.StatusBadRequest)
+		}
+		ids := []int64{}
+		seen := map[int64]bool{}
+		for _, v := range strings.Split(r.URL.Query().Get("ids"), ",") {
+			id, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || id < 0 {
+				fail(api.MALFORMED_ID)
+				return
+			}
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) > MAX_BATCH_SIZE {
+			fail(api.BATCH_TOO_LARGE)
+			return
+		}
+		stream_events(w, r, ids)
+	})
+
+	// === Worker ===
+	handle(mux, "POST /workers", func(w http.ResponseWriter, r *http.Request) {
+		type Response = api.WorkerResponse
+		write := func(resp *Response, code int) {
+			respond(w, r, resp, resp.Error, code)
+		}
+
+		payload := &api.RegisterWorkerRequest{}
+		if err := json.NewDecoder(r.Body).Decode(payload); err != nil {
+			write(&Response{Error: api.MALFORMED_JSON}, http.StatusBadRequest)
+			return
+		}
+		if !valid_worker_id(payload.ID) {
+			write(&Response{Error: api.MALFORMED_WORKER_ID}, http.StatusBadRequest)
+			return
+		}
+		if len(payload.Types) == 0 {
+			payload.Types = default_types
+		}
+		for _, task_type := range payload.Types {
+			if !valid_task_type(task_type) {
+				write(&Response{ID: payload.ID, Error: api.MALFORMED_TASK_TYPE}, http.StatusBadRequest)
+				return
+			}
+		}
+		if payload.Slots < 0 || payload.Slots > MAX_WORKER_SLOTS {
+			write(&Response{ID: payload.ID, Error: api.MALFORMED_SLOTS}, http.StatusBadRequest)
+			return
+		}
+		if payload.Slots == 0 {
+			payload.Slots = 1
+		}
+		orphaned, ok := workers.Register(payload.ID, owner_of(r), payload.Types, payload.Capabilities, payload.Slots, time.Now())
+		if !ok {
+			lgr.Warn().Str("worker", payload.ID).Str("name", owner_of(r)).Msg("worker ID is registered by another key")
+			write(&Response{ID: payload.ID, Error: api.FORBIDDEN}, http.StatusForbidden)
+			return
+		}
+		requeue_orphaned(orphaned)
+		lgr.Info().Str("worker", payload.ID).Int("slots", payload.Slots).Msg("worker registered")
+		write(&Response{ID: payload.ID, HeartbeatIntervalMillisecond: workers.heartbeat_interval.Milliseconds()}, http.StatusOK)
+	})
+
+	// === Worker ===
+	handle(mux, "POST /workers/{worker}/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+		type Response = api.WorkerResponse
+		write := func(resp *Response, code int) {
+			respond(w, r, resp, resp.Error, code)
+		}
+
+		id := r.PathValue("worker")
+		if !acts_as_worker(r, id) {
+			write(&Response{ID: id, Error: api.FORBIDDEN}, http.StatusForbidden)
+			return
+		}
+		payload := &api.HeartbeatRequest{}
+		if err := json.NewDecoder(r.Body).Decode(payload); err != nil {
+			write(&Response{ID: id, Error: api.MALFORMED_JSON}, http.StatusBadRequest)
+			return
+		}
+		if !workers.Heartbeat(id, payload, time.Now()) {
+			write(&Response{ID: id, Error: api.UNKNOWN_WORKER}, http.StatusBadRequest)
+			return
+		}
+		write(&Response{ID: id, HeartbeatIntervalMillisecond: workers.heartbeat_interval.Milliseconds()}, http.StatusOK)
+	})
+
+	// === Worker ===
+	handle(mux, "POST /workers/{worker}/release", func(w http.ResponseWriter, r *http.Request) {
+		type Response = api.WorkerResponse
+		write := func(resp *Response, code int) {
+			respond(w, r, resp, resp.Error, code)
+		}
+
+		id := r.PathValue("worker")
+		if !acts_as_worker(r, id) {
+			write(&Response{ID: id, Error: api.FORBIDDEN}, http.StatusForbidden)
+			return
+		}
+		payload := &api.ReleaseRequest{}
+		if err := json.NewDecoder(r.Body).Decode(payload); err != nil {
+			write(&Response{ID: id, Error: api.MALFORMED_JSON}, http.StatusBadRequest)
+			return
+		}
+		orphaned, ok := workers.Release(id, payload.Tasks)
+		if !ok {
+			write(&Response{ID: id, Error: api.UNKNOWN_WORKER}, http.StatusBadRequest)
+			return
+		}
+		requeue_orphaned(orphaned)
+		write(&Response{ID: id}, http.StatusOK)
+	})
+
+	// === Worker ===
+	handle(mux, "DELETE /workers/{worker}", func(w http.ResponseWriter, r *http.Request) {
+		type Response = api.WorkerResponse
+		write := func(resp *Response, code int) {
+			respond(w, r, resp, resp.Error, code)
+		}
+
+		id := r.PathValue("worker")
+		if !acts_as_worker(r, id) {
+			write(&Response{ID: id, Error: api.FORBIDDEN}, http.StatusForbidden)
+			return
+		}
+		orphaned, ok := workers.Deregister(id)
+		if !ok {
+			write(&Response{ID: id, Error: api.UNKNOWN_WORKER}, http.StatusBadRequest)
+			return
+		}
+		requeue_orphaned(orphaned)
+		lgr.Info().Str("worker", id).Msg("worker deregistered")
+		write(&Response{ID: id}, http.StatusOK)
+	})
+
+	// === Operator ===
+	handle(mux, "GET /workers", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, r, workers.List(), "", http.StatusOK)
+	})
+
+	// === Operator ===
+	handle(mux, "GET /tasks", func(w http.ResponseWriter, r *http.Request) {
+		listing, code := list_tasks(r.URL.Query())
+		respond(w, r, listing, listing.Error, code)
+	})
+	// === Operator ===
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		metrics.Render(w)
+	})
+
+	openapi, err := json.Marshal(api.OpenAPI())
+	invariant.AlwaysNil(err, "OpenAPI document is JSON serializable")
+	mux.HandleFunc("GET "+api.PREFIX+"/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(openapi)
+	})
+	// Without this, an unknown /v1 path would get the mux's plain-text 404 instead of an
+	// api.ErrorResponse. Being the least specific /v1 pattern, it also answers known paths called
+	// with the wrong method.
+	mux.HandleFunc(api.PREFIX+"/", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, r, nil, api.ROUTE_NOT_FOUND, http.StatusNotFound)
+	})
 }
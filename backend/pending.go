@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// PendingQueues holds one Int64Queue of pending task IDs per task type, so that GET /pending can
+// hand a worker only the types it has handlers for. Queues are created on first use and never
+// removed, which is fine since submit only accepts types that registered workers list.
+type PendingQueues struct {
+	mu     sync.Mutex
+	queues map[string]*Int64Queue
+	// has_pending is closed by the next push to any queue, for Dequeue to wait on several queues
+	// at once. It works like Int64Queue.has_pending.
+	has_pending chan struct{}
+	// next rotates the queue Dequeue looks at first, so that a busy type cannot starve the others
+	// for workers that run both.
+	next atomic.Uint64
+}
+
+func NewPendingQueues() *PendingQueues {
+	return &PendingQueues{
+		queues:      make(map[string]*Int64Queue),
+		has_pending: make(chan struct{}),
+	}
+}
+
+// queue returns the queue of task_type, creating it if create is set. It returns nil otherwise.
+func (pending *PendingQueues) queue(task_type string, create bool) *Int64Queue {
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+	queue, ok := pending.queues[task_type]
+	if !ok && create {
+		queue = NewInt64Queue()
+		pending.queues[task_type] = queue
+	}
+	return queue
+}
+
+func (pending *PendingQueues) notify() {
+	pending.mu.Lock()
+	select {
+	case <-pending.has_pending:
+	default:
+		close(pending.has_pending)
+	}
+	pending.mu.Unlock()
+}
+
+func (pending *PendingQueues) Enqueue(task_type string, id int64) {
+	pending.queue(task_type, true).Enqueue(id)
+	pending.notify()
+}
+
+// EnqueueFront puts id at the head of its type's queue. See Int64Queue.EnqueueFront.
+func (pending *PendingQueues) EnqueueFront(task_type string, id int64) {
+	pending.queue(task_type, true).EnqueueFront(id)
+	pending.notify()
+}
+
+// Remove reports whether id was queued under task_type.
+func (pending *PendingQueues) Remove(task_type string, id int64) bool {
+	queue := pending.queue(task_type, false)
+	return queue != nil && queue.Remove(id)
+}
+
+// Len returns the number of pending tasks of every type.
+func (pending *PendingQueues) Len() int {
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+	n := 0
+	for _, queue := range pending.queues {
+		n += queue.Len()
+	}
+	return n
+}
+
+// Lens returns the number of pending tasks by type.
+func (pending *PendingQueues) Lens() map[string]int {
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+	lens := make(map[string]int, len(pending.queues))
+	for task_type, queue := range pending.queues {
+		lens[task_type] = queue.Len()
+	}
+	return lens
+}
+
+// Dequeue blocks until a task of one of types is available or ctx is done, in which case it
+// returns ctx.Err().
+func (pending *PendingQueues) Dequeue(ctx context.Context, types []string) (int64, error) {
+	for {
+		// Taken before looking at the queues, so that a push after they were found empty is not
+		// missed.
+		pending.mu.Lock()
+		select {
+		case <-pending.has_pending:
+			pending.has_pending = make(chan struct{})
+		default:
+		}
+		wait := pending.has_pending
+		pending.mu.Unlock()
+
+		if id, ok := pending.TryDequeue(types); ok {
+			return id, nil
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// TryDequeue is Dequeue without blocking. ok is false if no queue of types has a task.
+func (pending *PendingQueues) TryDequeue(types []string) (id int64, ok bool) {
+	start := int(pending.next.Add(1))
+	for i := range types {
+		queue := pending.queue(types[(start+i)%len(types)], false)
+		if queue == nil {
+			continue
+		}
+		if id, ok := queue.TryDequeue(); ok {
+			return id, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPendingQueuesOnlyHandOutRequestedTypes(t *testing.T) {
+	pending := NewPendingQueues()
+	pending.Enqueue("a", 1)
+	pending.Enqueue("b", 2)
+	pending.Enqueue("a", 3)
+
+	if _, ok := pending.TryDequeue([]string{"c"}); ok {
+		t.Fatal("TryDequeue handed out a type that was not asked for")
+	}
+	for _, want := range []int64{1, 3} {
+		if id, ok := pending.TryDequeue([]string{"a", "c"}); !ok || id != want {
+			t.Fatalf("Got: %d, %t\nWant: %d, true", id, ok, want)
+		}
+	}
+	if n := pending.Len(); n != 1 {
+		t.Fatalf("Got len: %d\nWant len: 1", n)
+	}
+	if !pending.Remove("b", 2) || pending.Remove("c", 2) {
+		t.Fatal("Remove did not find the task under its own type only")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	if _, err := pending.Dequeue(ctx, []string{"a", "b"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Got: %v\nWant: %v", err, context.DeadlineExceeded)
+	}
+
+	// A task of any of the requested types wakes a waiting Dequeue up, and other types do not.
+	go func() {
+		time.Sleep(time.Millisecond * 20)
+		pending.Enqueue("c", 4)
+		time.Sleep(time.Millisecond * 20)
+		pending.EnqueueFront("b", 5)
+	}()
+	id, err := pending.Dequeue(context.Background(), []string{"a", "b"})
+	if err != nil || id != 5 {
+		t.Fatalf("Got: %d, %v\nWant: 5, <nil>", id, err)
+	}
+}
+
+// A worker running several types takes from each of them in turn rather than draining the first.
+func TestPendingQueuesRotateBetweenTypes(t *testing.T) {
+	pending := NewPendingQueues()
+	for id := range int64(10) {
+		pending.Enqueue("a", id)
+		pending.Enqueue("b", 100+id)
+	}
+	taken := map[bool]int{}
+	for range 10 {
+		id, _ := pending.TryDequeue([]string{"a", "b"})
+		taken[id >= 100]++
+	}
+	if taken[false] != 5 || taken[true] != 5 {
+		t.Fatalf("Got: %d of a and %d of b\nWant: 5 of each", taken[false], taken[true])
+	}
+}
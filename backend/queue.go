@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/james-orcales/golang_snacks/invariant"
+)
+
+// Int64Queue is a FIFO queue of distinct values, stored in a ring buffer that grows when full and
+// shrinks once mostly empty, so that memory is given back after a burst has drained.
+//
+// Remove takes a value out of the middle of the queue in O(1) by forgetting it in queued, leaving
+// a tombstone in the ring that pop skips over. Tombstones are compacted away once they outnumber
+// the values still queued, so they cannot pile up either. Every push is numbered, so that the
+// tombstone of a removed value is never mistaken for the value being queued again.
+type Int64Queue struct {
+	mu sync.Mutex
+	// ring holds count entries starting at head, wrapping around. len(ring) is always a power of two.
+	ring  []queue_entry
+	head  int
+	count int
+	// queued maps the values in ring that have not been removed to the push that queued them.
+	queued map[int64]uint64
+	pushes uint64
+	// length mirrors len(queued) so that Len does not need the lock.
+	length atomic.Int64
+	// has_pending is closed by the next Enqueue and replaced by Dequeue when it needs to wait again.
+	// A channel is used instead of a sync.Cond so that waiting can be abandoned when a context ends.
+	has_pending chan struct{}
+}
+
+type queue_entry struct {
+	v    int64
+	push uint64
+}
+
+// MIN_QUEUE_CAPACITY is the size the ring starts at and never shrinks below.
+const MIN_QUEUE_CAPACITY = 64
+
+func NewInt64Queue() *Int64Queue {
+	return &Int64Queue{
+		ring:        make([]queue_entry, MIN_QUEUE_CAPACITY),
+		queued:      make(map[int64]uint64),
+		has_pending: make(chan struct{}),
+	}
+}
+
+// Len returns the number of queued values. It does not take the lock, so it is cheap to call
+// from metrics and the autoscaler endpoint.
+func (queue *Int64Queue) Len() int {
+	return int(queue.length.Load())
+}
+
+func (queue *Int64Queue) Enqueue(v int64) {
+	queue.mu.Lock()
+	queue.push(v, false)
+	queue.mu.Unlock()
+}
+
+// EnqueueFront puts v at the head of the queue. It is used to hand back a task whose delivery
+// failed, so that it does not lose its place to tasks submitted after it.
+func (queue *Int64Queue) EnqueueFront(v int64) {
+	queue.mu.Lock()
+	queue.push(v, true)
+	queue.mu.Unlock()
+}
+
+func (queue *Int64Queue) push(v int64, front bool) {
+	_, exists := queue.queued[v]
+	invariant.Always(!exists, "Value is queued at most once")
+	queue.pushes++
+	queue.queued[v] = queue.pushes
+	queue.length.Store(int64(len(queue.queued)))
+	if queue.count == len(queue.ring) {
+		queue.resize(len(queue.ring) * 2)
+	}
+	mask := len(queue.ring) - 1
+	if front {
+		queue.head = (queue.head - 1) & mask
+		queue.ring[queue.head] = queue_entry{v, queue.pushes}
+	} else {
+		queue.ring[(queue.head+queue.count)&mask] = queue_entry{v, queue.pushes}
+	}
+	queue.count++
+	select {
+	case <-queue.has_pending:
+	default:
+		close(queue.has_pending)
+	}
+}
+
+// resize copies the entries still in the ring to a new ring of the given capacity, dropping
+// tombstones on the way.
+func (queue *Int64Queue) resize(capacity int) {
+	ring := make([]queue_entry, capacity)
+	n := 0
+	mask := len(queue.ring) - 1
+	for i := range queue.count {
+		entry := queue.ring[(queue.head+i)&mask]
+		if queue.is_live(entry) {
+			ring[n] = entry
+			n++
+		}
+	}
+	queue.ring = ring
+	queue.head = 0
+	queue.count = n
+}
+
+// Dequeue blocks until a value is available or ctx is done, in which case it returns ctx.Err().
+func (queue *Int64Queue) Dequeue(ctx context.Context) (int64, error) {
+	for {
+		queue.mu.Lock()
+		if v, ok := queue.pop(); ok {
+			queue.mu.Unlock()
+			return v, nil
+		}
+		select {
+		case <-queue.has_pending:
+			queue.has_pending = make(chan struct{})
+		default:
+		}
+		wait := queue.has_pending
+		queue.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// TryDequeue is Dequeue without blocking. ok is false if the queue is empty.
+func (queue *Int64Queue) TryDequeue() (v int64, ok bool) {
+	queue.mu.Lock()
+	v, ok = queue.pop()
+	queue.mu.Unlock()
+	return v, ok
+}
+
+func (queue *Int64Queue) pop() (int64, bool) {
+	defer queue.shrink()
+	mask := len(queue.ring) - 1
+	for len(queue.queued) > 0 {
+		invariant.Always(queue.count > 0, "Every queued value is in the ring")
+		entry := queue.ring[queue.head]
+		queue.head = (queue.head + 1) & mask
+		queue.count--
+		if queue.is_live(entry) {
+			delete(queue.queued, entry.v)
+			queue.length.Store(int64(len(queue.queued)))
+			return entry.v, true
+		}
+	}
+	// Only tombstones are left, if anything.
+	queue.head, queue.count = 0, 0
+	return 0, false
+}
+
+// is_live reports whether entry is still queued rather than a tombstone.
+func (queue *Int64Queue) is_live(entry queue_entry) bool {
+	push, ok := queue.queued[entry.v]
+	return ok && push == entry.push
+}
+
+// shrink halves the ring while it is at most a quarter full, and compacts it when tombstones
+// outnumber the queued values. Both keep the work amortized O(1) per operation.
+func (queue *Int64Queue) shrink() {
+	live := len(queue.queued)
+	capacity := len(queue.ring)
+	for capacity > MIN_QUEUE_CAPACITY && live <= capacity/4 {
+		capacity /= 2
+	}
+	if capacity != len(queue.ring) || (queue.count > MIN_QUEUE_CAPACITY && queue.count-live > live) {
+		queue.resize(max(capacity, MIN_QUEUE_CAPACITY))
+	}
+}
+
+// Remove reports whether v was in the queue.
+func (queue *Int64Queue) Remove(v int64) bool {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	_, ok := queue.queued[v]
+	if !ok {
+		return false
+	}
+	delete(queue.queued, v)
+	queue.length.Store(int64(len(queue.queued)))
+	queue.shrink()
+	return true
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/james-orcales/golang_snacks/invariant"
+)
+
+func TestInt64QueueDequeueRespectsContext(t *testing.T) {
+	queue := NewInt64Queue()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	if _, err := queue.Dequeue(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Got: %v\nWant: %v", err, context.DeadlineExceeded)
+	}
+
+	// A value enqueued while a Dequeue is waiting wakes it up
+	go func() {
+		time.Sleep(time.Millisecond * 20)
+		queue.Enqueue(7)
+	}()
+	v, err := queue.Dequeue(context.Background())
+	if err != nil || v != 7 {
+		t.Fatalf("Got: %d, %v\nWant: 7, <nil>", v, err)
+	}
+}
+
+func TestInt64QueueRemoveAndEnqueueFront(t *testing.T) {
+	queue := NewInt64Queue()
+	for v := range int64(4) {
+		queue.Enqueue(v)
+	}
+	if !queue.Remove(1) {
+		t.Fatal("Remove(1) reported the value as absent")
+	}
+	if queue.Remove(1) {
+		t.Fatal("Remove(1) twice reported the value as present")
+	}
+	queue.EnqueueFront(9)
+
+	want := []int64{9, 0, 2, 3}
+	if n := queue.Len(); n != len(want) {
+		t.Fatalf("Got len: %d\nWant len: %d", n, len(want))
+	}
+	for _, w := range want {
+		if v, ok := queue.TryDequeue(); !ok || v != w {
+			t.Fatalf("Got: %d, %t\nWant: %d, true", v, ok, w)
+		}
+	}
+	if _, ok := queue.TryDequeue(); ok {
+		t.Fatal("TryDequeue on an empty queue reported a value")
+	}
+}
+
+func TestInt64QueueRemovedValueCanBeQueuedAgain(t *testing.T) {
+	queue := NewInt64Queue()
+	queue.Enqueue(1)
+	queue.Enqueue(2)
+	queue.Remove(1)
+	queue.Enqueue(1)
+	// The tombstone of the first 1 must not let the second one jump ahead of 2
+	for _, w := range []int64{2, 1} {
+		if v, ok := queue.TryDequeue(); !ok || v != w {
+			t.Fatalf("Got: %d, %t\nWant: %d, true", v, ok, w)
+		}
+	}
+	if n := queue.Len(); n != 0 {
+		t.Fatalf("Got len: %d\nWant len: 0", n)
+	}
+}
+
+func TestInt64QueueWrapsGrowsAndShrinks(t *testing.T) {
+	queue := NewInt64Queue()
+	next_in, next_out := int64(0), int64(0)
+	// Move head around the ring before growing it, so that growing has to unwrap it
+	for range MIN_QUEUE_CAPACITY / 2 {
+		queue.Enqueue(next_in)
+		next_in++
+		queue.TryDequeue()
+		next_out++
+	}
+	for range 10_000 {
+		queue.Enqueue(next_in)
+		next_in++
+	}
+	if capacity := len(queue.ring); capacity < 10_000 {
+		t.Fatalf("Got capacity: %d\nWant at least 10000", capacity)
+	}
+	for next_out < next_in {
+		if v, ok := queue.TryDequeue(); !ok || v != next_out {
+			t.Fatalf("Got: %d, %t\nWant: %d, true", v, ok, next_out)
+		}
+		next_out++
+	}
+	if capacity := len(queue.ring); capacity != MIN_QUEUE_CAPACITY {
+		t.Fatalf("Drained queue kept its memory\nGot capacity: %d\nWant: %d", capacity, MIN_QUEUE_CAPACITY)
+	}
+
+	// Removing most of a large queue compacts the tombstones away
+	for v := range int64(10_000) {
+		queue.Enqueue(v)
+	}
+	for v := range int64(9_990) {
+		queue.Remove(v)
+	}
+	if capacity := len(queue.ring); capacity > MIN_QUEUE_CAPACITY {
+		t.Fatalf("Removed values kept their memory\nGot capacity: %d\nWant: %d", capacity, MIN_QUEUE_CAPACITY)
+	}
+	for v := int64(9_990); v < 10_000; v++ {
+		if got, ok := queue.TryDequeue(); !ok || got != v {
+			t.Fatalf("Got: %d, %t\nWant: %d, true", got, ok, v)
+		}
+	}
+}
+
+// Run with -race. Producers, consumers, removers and Len readers all hit the queue at once, and
+// every value must come out exactly once, either dequeued or removed.
+func TestInt64QueueConcurrentUse(t *testing.T) {
+	const PRODUCERS, PER_PRODUCER = 4, 2_000
+	queue := NewInt64Queue()
+	var seen sync.Map
+	var taken atomic.Int64
+	var wg sync.WaitGroup
+	record := func(v int64) {
+		if _, dup := seen.LoadOrStore(v, true); dup {
+			t.Errorf("Value %d came out twice", v)
+		}
+		taken.Add(1)
+	}
+	for p := range int64(PRODUCERS) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range int64(PER_PRODUCER) {
+				v := p*PER_PRODUCER + i
+				if i%3 == 0 {
+					queue.EnqueueFront(v)
+				} else {
+					queue.Enqueue(v)
+				}
+				if i%7 == 0 && queue.Remove(v) {
+					record(v)
+				}
+			}
+		}()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var consumers sync.WaitGroup
+	for range 4 {
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+			for {
+				v, err := queue.Dequeue(ctx)
+				if err != nil {
+					return
+				}
+				record(v)
+			}
+		}()
+	}
+	go func() {
+		for ctx.Err() == nil {
+			if n := queue.Len(); n < 0 {
+				t.Errorf("Got negative len: %d", n)
+			}
+		}
+	}()
+	wg.Wait()
+	for taken.Load() < PRODUCERS*PER_PRODUCER && !t.Failed() {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	consumers.Wait()
+	if n := queue.Len(); n != 0 {
+		t.Fatalf("Got len: %d\nWant len: 0", n)
+	}
+}
+
+// slice_queue is Int64Queue as it was before the ring buffer, kept for the benchmarks below. Its
+// data slice is resliced on every pop and reallocated on every push to the front.
+type slice_queue struct {
+	data        []int64
+	queued      map[int64]struct{}
+	mu          sync.Mutex
+	has_pending chan struct{}
+}
+
+func (queue *slice_queue) Enqueue(v int64) {
+	queue.mu.Lock()
+	queue.push(v, false)
+	queue.mu.Unlock()
+}
+
+func (queue *slice_queue) EnqueueFront(v int64) {
+	queue.mu.Lock()
+	queue.push(v, true)
+	queue.mu.Unlock()
+}
+
+func (queue *slice_queue) push(v int64, front bool) {
+	_, exists := queue.queued[v]
+	invariant.Always(!exists, "Value is queued at most once")
+	queue.queued[v] = struct{}{}
+	if front {
+		queue.data = append([]int64{v}, queue.data...)
+	} else {
+		queue.data = append(queue.data, v)
+	}
+	select {
+	case <-queue.has_pending:
+	default:
+		close(queue.has_pending)
+	}
+}
+
+func (queue *slice_queue) TryDequeue() (int64, bool) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	for len(queue.queued) > 0 {
+		v := queue.data[0]
+		queue.data = queue.data[1:]
+		if _, ok := queue.queued[v]; ok {
+			delete(queue.queued, v)
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+func (queue *slice_queue) Remove(v int64) bool {
+	queue.mu.Lock()
+	_, ok := queue.queued[v]
+	delete(queue.queued, v)
+	queue.mu.Unlock()
+	return ok
+}
+
+type benchmark_queue interface {
+	Enqueue(v int64)
+	EnqueueFront(v int64)
+	TryDequeue() (int64, bool)
+	Remove(v int64) bool
+}
+
+var benchmark_queues = []struct {
+	name string
+	new  func() benchmark_queue
+}{
+	{"slice", func() benchmark_queue {
+		return &slice_queue{queued: map[int64]struct{}{}, has_pending: make(chan struct{})}
+	}},
+	{"ring", func() benchmark_queue { return NewInt64Queue() }},
+}
+
+// BenchmarkQueueSteady keeps a backlog of 1000 values while values flow through.
+func BenchmarkQueueSteady(b *testing.B) {
+	for _, q := range benchmark_queues {
+		b.Run(q.name, func(b *testing.B) {
+			queue := q.new()
+			for v := range int64(1000) {
+				queue.Enqueue(v)
+			}
+			b.ReportAllocs()
+			for i := range int64(b.N) {
+				queue.Enqueue(1000 + i)
+				queue.TryDequeue()
+			}
+		})
+	}
+}
+
+// BenchmarkQueueBurst fills the queue with 100k values and drains it again.
+func BenchmarkQueueBurst(b *testing.B) {
+	for _, q := range benchmark_queues {
+		b.Run(q.name, func(b *testing.B) {
+			queue := q.new()
+			b.ReportAllocs()
+			for range b.N {
+				for v := range int64(100_000) {
+					queue.Enqueue(v)
+				}
+				for range 100_000 {
+					queue.TryDequeue()
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkQueueRequeueAndCancel mixes in what GET /pending and cancellation do: a failed delivery
+// goes back to the front, and a cancelled task is removed from the middle.
+func BenchmarkQueueRequeueAndCancel(b *testing.B) {
+	for _, q := range benchmark_queues {
+		b.Run(q.name, func(b *testing.B) {
+			queue := q.new()
+			for v := range int64(10_000) {
+				queue.Enqueue(v)
+			}
+			b.ReportAllocs()
+			for i := range int64(b.N) {
+				queue.Enqueue(10_000 + 2*i)
+				queue.Enqueue(10_000 + 2*i + 1)
+				queue.Remove(10_000 + 2*i + 1)
+				if v, ok := queue.TryDequeue(); ok && i%10 == 0 {
+					queue.EnqueueFront(v)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Retention evicts terminal tasks from all_tasks once they are older than max_age, and evicts the
+// oldest ones early while the terminal tasks together hold more than max_bytes. Evicted IDs are
+// reported as Task_Expired rather than Unknown_Task, which needs no bookkeeping because IDs are
+// handed out sequentially: an ID below next_id that is missing from all_tasks was evicted.
+type Retention struct {
+	max_age   time.Duration
+	max_bytes int64
+	mu        sync.Mutex
+	// terminal holds terminal tasks in the order they became terminal, which is also the order
+	// they expire in.
+	terminal []retained_task
+	bytes    int64
+}
+
+type retained_task struct {
+	id   int64
+	at   time.Time
+	size int64
+}
+
+func NewRetention(max_age time.Duration, max_bytes int64) *Retention {
+	return &Retention{max_age: max_age, max_bytes: max_bytes}
+}
+
+// Track registers a task that just became terminal. The caller holds the lock of the task's shard.
+func (retention *Retention) Track(task *Task) {
+	size := task_size_bytes(task)
+	retention.mu.Lock()
+	retention.terminal = append(retention.terminal, retained_task{id: task.ID, at: task.FinishedAt, size: size})
+	retention.bytes += size
+	retention.mu.Unlock()
+}
+
+// Sweep evicts every task that is past its retention and returns how many tasks and bytes it freed.
+// Offloaded outputs are released as well, but do not count toward the freed bytes.
+func (retention *Retention) Sweep(now time.Time) (evicted int, freed int64) {
+	var refs []string
+	defer func() {
+		// Deleting files is kept out of the critical section.
+		for _, ref := range refs {
+			blobs.Release(ref)
+		}
+	}()
+	// Track is called with a shard locked, so the expired tasks are picked first and removed from
+	// their shards only after retention.mu is released.
+	retention.mu.Lock()
+	for _, retained := range retention.terminal {
+		if now.Sub(retained.at) < retention.max_age && retention.bytes <= retention.max_bytes {
+			break
+		}
+		retention.bytes -= retained.size
+		freed += retained.size
+		evicted++
+	}
+	expired := retention.terminal[:evicted]
+	if evicted > 0 {
+		// Copy instead of reslicing so the backing array does not keep growing.
+		retention.terminal = append([]retained_task(nil), retention.terminal[evicted:]...)
+	}
+	retention.mu.Unlock()
+
+	for _, retained := range expired {
+		shard := all_tasks.Shard(retained.id)
+		shard.Lock()
+		if ref := shard.tasks[retained.id].OutputRef; ref != "" {
+			refs = append(refs, ref)
+		}
+		delete(shard.tasks, retained.id)
+		shard.Unlock()
+	}
+	return evicted, freed
+}
+
+// Bytes is the estimated memory held by terminal tasks.
+func (retention *Retention) Bytes() int64 {
+	retention.mu.Lock()
+	defer retention.mu.Unlock()
+	return retention.bytes
+}
+
+// task_size_bytes estimates the heap used by a task's strings, which dominate its footprint. An
+// offloaded output takes up no heap.
+func task_size_bytes(task *Task) int64 {
+	return int64(len(task.Input)+len(task.FailureMessage)) + output_size_bytes(task.Output)
+}
+
+func output_size_bytes(output []string) int64 {
+	const STRING_HEADER_SIZE = 16
+	size := int64(0)
+	for _, s := range output {
+		size += STRING_HEADER_SIZE + int64(len(s))
+	}
+	return size
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"api"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// with_retained inserts the given tasks, IDs from 0 in order, and tracks the terminal ones in
+// retention as if each finished a second after the one before.
+func with_retained(t *testing.T, retention *Retention, epoch time.Time, tasks ...*Task) {
+	t.Helper()
+	with_workers(t)
+	for i, task := range tasks {
+		task.ID = int64(i)
+		all_tasks.Insert(task)
+		if is_terminal(task.Status) {
+			task.FinishedAt = epoch.Add(time.Second * time.Duration(i))
+			retention.Track(task)
+		}
+	}
+	next_id.Store(max(next_id.Load(), int64(len(tasks))))
+}
+
+func remaining(ids ...int64) map[int64]bool {
+	left := map[int64]bool{}
+	for _, id := range ids {
+		left[id] = true
+	}
+	return left
+}
+
+func check_remaining(t *testing.T, n int64, want map[int64]bool) {
+	t.Helper()
+	for id := range n {
+		if _, _, error_code, _ := snapshot_task(id); (error_code == "") != want[id] {
+			t.Errorf("Task %d\nGot: %q\nWant: kept=%v", id, error_code, want[id])
+		}
+	}
+}
+
+func TestRetentionEvictsOldestTerminalTasksPastTheirAge(t *testing.T) {
+	retention := NewRetention(time.Minute, 1<<30)
+	epoch := time.Now()
+	with_retained(t, retention, epoch,
+		&Task{Status: api.STATUS_FINISHED, Input: "a"},
+		&Task{Status: api.STATUS_PENDING, Input: "b"},
+		&Task{Status: api.STATUS_FAILED, Input: "c"},
+		&Task{Status: api.STATUS_PROCESSING, Input: "d"},
+		&Task{Status: api.STATUS_CANCELLED, Input: "e"},
+	)
+
+	if evicted, _ := retention.Sweep(epoch.Add(time.Second * 30)); evicted != 0 {
+		t.Fatalf("Got: %d evicted before any task was a minute old\nWant: 0", evicted)
+	}
+	// Tasks 0 and 2 are a minute old, task 4 is not yet.
+	if evicted, _ := retention.Sweep(epoch.Add(time.Minute + time.Second*2)); evicted != 2 {
+		t.Fatalf("Got: %d evicted\nWant: 2", evicted)
+	}
+	check_remaining(t, 5, remaining(1, 3, 4))
+
+	// However long they wait, tasks that are not terminal stay.
+	retention.Sweep(epoch.Add(time.Hour))
+	check_remaining(t, 5, remaining(1, 3))
+}
+
+func TestRetentionEvictsOldestTerminalTasksOverTheByteBudget(t *testing.T) {
+	input := strings.Repeat("x", 100)
+	// Room for two terminal tasks.
+	retention := NewRetention(time.Hour, 200)
+	epoch := time.Now()
+	with_retained(t, retention, epoch,
+		&Task{Status: api.STATUS_FINISHED, Input: input},
+		&Task{Status: api.STATUS_PROCESSING, Input: input},
+		&Task{Status: api.STATUS_FINISHED, Input: input},
+		&Task{Status: api.STATUS_PENDING, Input: input},
+		&Task{Status: api.STATUS_FINISHED, Input: input},
+	)
+
+	evicted, freed := retention.Sweep(epoch)
+	if evicted != 1 || freed != 100 || retention.Bytes() != 200 {
+		t.Fatalf("Got: %d evicted, %d bytes freed, %d bytes retained\nWant: 1, 100, 200", evicted, freed, retention.Bytes())
+	}
+	check_remaining(t, 5, remaining(1, 2, 3, 4))
+}
+
+func TestRetentionReleasesOffloadedOutputs(t *testing.T) {
+	previous := blobs
+	t.Cleanup(func() { blobs = previous })
+	var err error
+	if blobs, err = NewBlobStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	ref, err := blobs.Put([]byte(`["large"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	retention := NewRetention(time.Minute, 1<<30)
+	epoch := time.Now()
+	with_retained(t, retention, epoch, &Task{Status: api.STATUS_FINISHED, Input: "a", OutputRef: ref})
+
+	retention.Sweep(epoch.Add(time.Minute))
+	if _, err := blobs.Open(ref); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Got: %v\nWant: the evicted task's blob deleted", err)
+	}
+}
+
+func TestStatusOfEvictedTaskIsExpired(t *testing.T) {
+	retention := NewRetention(time.Minute, 1<<30)
+	epoch := time.Now()
+	with_retained(t, retention, epoch, &Task{Status: api.STATUS_FINISHED, Input: "a", Output: []string{"a"}})
+	retention.Sweep(epoch.Add(time.Minute))
+
+	mux := http.NewServeMux()
+	register_routes(mux)
+	tests := []struct {
+		id         int64
+		code       int
+		error_code api.Code
+	}{
+		{0, http.StatusGone, api.TASK_EXPIRED},
+		{next_id.Load() + 1000, http.StatusBadRequest, api.UNKNOWN_TASK},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, api.PREFIX+"/status/"+strconv.FormatInt(tt.id, 10), nil))
+		if w.Code != tt.code || !strings.Contains(w.Body.String(), string(tt.error_code)) {
+			t.Errorf("GET /status/%d\nGot: %d %s\nWant: %d %s", tt.id, w.Code, w.Body, tt.code, tt.error_code)
+		}
+	}
+}
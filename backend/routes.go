@@ -0,0 +1,38 @@
+package main
+
+import (
+	"api"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// handle registers handler under pattern, which is written without api.PREFIX, both as is and
+// with the prefix. The unversioned routes stay for workers and clients built before /v1, so that a
+// deployment can be upgraded one service at a time.
+func handle(mux *http.ServeMux, pattern string, handler http.HandlerFunc) {
+	method, path, _ := strings.Cut(pattern, " ")
+	mux.HandleFunc(pattern, handler)
+	mux.HandleFunc(method+" "+api.PREFIX+path, handler)
+}
+
+// unversioned returns the pattern a /v1 pattern was registered as by handle.
+func unversioned(pattern string) string {
+	method, path, ok := strings.Cut(pattern, " ")
+	if !ok {
+		return strings.TrimPrefix(pattern, api.PREFIX)
+	}
+	return method + " " + strings.TrimPrefix(path, api.PREFIX)
+}
+
+// respond writes resp as a JSON response with status code. A failed /v1 request is answered with
+// an api.ErrorResponse for error_code instead, so that every /v1 failure has the same shape. The
+// unversioned routes keep their per-endpoint failure bodies, which older workers decode.
+func respond(w http.ResponseWriter, r *http.Request, resp any, error_code api.Code, code int) {
+	if code >= 400 && strings.HasPrefix(r.URL.Path, api.PREFIX+"/") {
+		resp = &api.ErrorResponse{Error: error_code, Message: error_code.Message()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/james-orcales/golang_snacks/invariant"
+)
+
+// Scheduler holds tasks that are not yet visible to workers. A single goroutine (Run) sleeps until
+// the earliest due time and hands every due task to the ready callback, which is responsible for
+// moving it into the pending queue.
+//
+// The heap lives in memory only. There is no durable task store yet, so scheduled tasks are lost
+// on restart like every other task. Once one exists, the heap must be rebuilt from it on startup
+// by calling Schedule for every task still in STATUS_SCHEDULED.
+type Scheduler struct {
+	mu      sync.Mutex
+	entries scheduled_heap
+	by_id   map[int64]*scheduled_entry
+	// wake is signalled whenever the earliest due time may have moved earlier.
+	wake  chan struct{}
+	ready func(id int64)
+}
+
+type scheduled_entry struct {
+	id    int64
+	at    time.Time
+	index int
+}
+
+func NewScheduler(ready func(id int64)) *Scheduler {
+	return &Scheduler{
+		by_id: make(map[int64]*scheduled_entry),
+		wake:  make(chan struct{}, 1),
+		ready: ready,
+	}
+}
+
+func (scheduler *Scheduler) Len() int {
+	scheduler.mu.Lock()
+	n := len(scheduler.entries)
+	scheduler.mu.Unlock()
+	return n
+}
+
+func (scheduler *Scheduler) Schedule(id int64, at time.Time) {
+	scheduler.mu.Lock()
+	_, exists := scheduler.by_id[id]
+	invariant.Always(!exists, "Task is scheduled at most once")
+	entry := &scheduled_entry{id: id, at: at}
+	heap.Push(&scheduler.entries, entry)
+	scheduler.by_id[id] = entry
+	is_earliest := entry.index == 0
+	scheduler.mu.Unlock()
+
+	if is_earliest {
+		select {
+		case scheduler.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Remove reports whether id was still waiting to become due.
+func (scheduler *Scheduler) Remove(id int64) bool {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	entry, ok := scheduler.by_id[id]
+	if !ok {
+		return false
+	}
+	heap.Remove(&scheduler.entries, entry.index)
+	delete(scheduler.by_id, id)
+	// Run may wake up for a task that is no longer there, which is harmless.
+	return true
+}
+
+func (scheduler *Scheduler) Run() {
+	timer := time.NewTimer(time.Hour)
+	for {
+		var due []int64
+		next := time.Duration(-1)
+		scheduler.mu.Lock()
+		{
+			now := time.Now()
+			for len(scheduler.entries) > 0 {
+				entry := scheduler.entries[0]
+				if entry.at.After(now) {
+					next = entry.at.Sub(now)
+					break
+				}
+				heap.Pop(&scheduler.entries)
+				delete(scheduler.by_id, entry.id)
+				due = append(due, entry.id)
+			}
+		}
+		scheduler.mu.Unlock()
+
+		for _, id := range due {
+			scheduler.ready(id)
+		}
+
+		if next < 0 {
+			next = time.Hour
+		}
+		timer.Reset(next)
+		select {
+		case <-timer.C:
+		case <-scheduler.wake:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// scheduled_heap implements heap.Interface ordered by due time, with ties broken by task ID so that
+// tasks due at the same instant become pending in submission order.
+type scheduled_heap []*scheduled_entry
+
+func (h scheduled_heap) Len() int { return len(h) }
+
+func (h scheduled_heap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].id < h[j].id
+	}
+	return h[i].at.Before(h[j].at)
+}
+
+func (h scheduled_heap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *scheduled_heap) Push(x any) {
+	entry := x.(*scheduled_entry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *scheduled_heap) Pop() any {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	entry.index = -1
+	*h = old[:n-1]
+	return entry
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedulerReleasesInDueOrder(t *testing.T) {
+	ready := make(chan int64, 3)
+	scheduler := NewScheduler(func(id int64) { ready <- id })
+	go scheduler.Run()
+
+	now := time.Now()
+	scheduler.Schedule(2, now.Add(time.Millisecond*60))
+	scheduler.Schedule(0, now.Add(time.Millisecond*20))
+	// Due at the same instant as 0 but submitted later
+	scheduler.Schedule(1, now.Add(time.Millisecond*20))
+
+	for _, want := range []int64{0, 1, 2} {
+		select {
+		case got := <-ready:
+			if got != want {
+				t.Fatalf("Got: %d\nWant: %d", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for task %d", want)
+		}
+	}
+	if n := scheduler.Len(); n != 0 {
+		t.Fatalf("Got len: %d\nWant len: 0", n)
+	}
+}
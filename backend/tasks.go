@@ -0,0 +1,342 @@
+package main
+
+import (
+	"api"
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/james-orcales/golang_snacks/invariant"
+)
+
+// submit_task validates payload and creates its task. key is the idempotency key, if any, and
+// fingerprint is the request body it arrived in. On failure, id is -1 and error_code is set.
+func submit_task(payload *api.SubmitRequest, key string, fingerprint []byte) (id int64, replayed bool, error_code api.Code, code int) {
+	var run_at time.Time
+	switch {
+	// Bounded before converting to a time.Duration, which would overflow.
+	case payload.DelayMillisecond < 0 || payload.DelayMillisecond > MAX_SCHEDULE_DELAY.Milliseconds() ||
+		(payload.DelayMillisecond > 0 && payload.RunAt != ""):
+		return -1, false, api.MALFORMED_SCHEDULE, http.StatusBadRequest
+	case payload.DelayMillisecond > 0:
+		run_at = time.Now().Add(time.Millisecond * time.Duration(payload.DelayMillisecond))
+	case payload.RunAt != "":
+		var err error
+		run_at, err = time.Parse(time.RFC3339, payload.RunAt)
+		if err != nil {
+			return -1, false, api.MALFORMED_SCHEDULE, http.StatusBadRequest
+		}
+	}
+	// A time that has already passed is treated the same as no schedule at all.
+	is_scheduled := run_at.After(time.Now())
+
+	if payload.CallbackURL != "" {
+		if len(webhooks.secret) == 0 {
+			return -1, false, api.WEBHOOKS_DISABLED, http.StatusBadRequest
+		}
+		if !valid_callback_url(payload.CallbackURL) {
+			return -1, false, api.MALFORMED_CALLBACK_URL, http.StatusBadRequest
+		}
+	}
+
+	// Bounded before converting to a time.Duration, which would overflow.
+	if payload.TimeoutMillisecond < 0 || payload.TimeoutMillisecond > MAX_TASK_TIMEOUT.Milliseconds() {
+		return -1, false, api.MALFORMED_TIMEOUT, http.StatusBadRequest
+	}
+	timeout := time.Millisecond * time.Duration(payload.TimeoutMillisecond)
+
+	task_type := payload.Type
+	if task_type == "" {
+		task_type = api.DEFAULT_TASK_TYPE
+	}
+	if !workers.Supports(task_type) {
+		return -1, false, api.UNKNOWN_TASK_TYPE, http.StatusBadRequest
+	}
+
+	if key != "" && payload.Key != "" && key != payload.Key {
+		return -1, false, api.MALFORMED_IDEMPOTENCY_KEY, http.StatusBadRequest
+	}
+	if key == "" {
+		key = payload.Key
+	}
+
+	// Admission runs inside submit so that replays of an accepted submission are never rejected.
+	rejected := ""
+	submit := func() (int64, bool) {
+		if rejected = admission.Admit(payload.Priority, int64(pending_tasks.Len())); rejected != "" {
+			submissions_rejected_total.Inc(rejected)
+			return -1, false
+		}
+		task := Task{
+			Type:        task_type,
+			Input:       payload.Data,
+			Status:      api.STATUS_PENDING,
+			Priority:    payload.Priority,
+			CallbackURL: payload.CallbackURL,
+			SubmittedAt: time.Now(),
+			Timeout:     timeout,
+		}
+		if is_scheduled {
+			task.Status = api.STATUS_SCHEDULED
+			task.RunAt = run_at
+		}
+		task.ID = next_id.Add(1) - 1
+		all_tasks.Insert(&task)
+		if is_scheduled {
+			scheduled_tasks.Schedule(task.ID, task.RunAt)
+		} else {
+			pending_tasks.Enqueue(task.Type, task.ID)
+		}
+		return task.ID, true
+	}
+
+	if key == "" {
+		id, _ = submit()
+	} else {
+		var conflict bool
+		id, replayed, conflict = idempotency_keys.Do(key, fingerprint, submit)
+		if conflict {
+			return -1, false, api.IDEMPOTENCY_KEY_REUSED, http.StatusUnprocessableEntity
+		}
+	}
+	if rejected != "" {
+		return -1, false, api.OVERLOADED, http.StatusTooManyRequests
+	}
+	if !replayed {
+		tasks_submitted_total.Inc()
+	}
+	return id, replayed, "", http.StatusOK
+}
+
+// lookup_task finds a task for a client request. If it does not exist, error_code and code
+// describe why. The caller holds the lock of id's shard.
+//
+// An ID below next_id that is missing was evicted. The one exception is an ID that was just
+// allocated and is about to be inserted, which is harmless: nobody has been told that ID yet, so
+// only a client guessing IDs can see it reported as expired.
+func lookup_task(id int64) (task *Task, error_code api.Code, code int) {
+	if task, ok := all_tasks.Shard(id).tasks[id]; ok {
+		return task, "", http.StatusOK
+	}
+	if id < next_id.Load() {
+		return nil, api.TASK_EXPIRED, http.StatusGone
+	}
+	return nil, api.UNKNOWN_TASK, http.StatusBadRequest
+}
+
+// snapshot_task copies a task for a client request, so that the response can be encoded after the
+// shard lock is released. The copy shares Output and Deliveries with the task, which is safe
+// because elements are never modified once added. If the output was offloaded, blob is the open
+// output and the caller closes it.
+func snapshot_task(id int64) (task Task, blob *os.File, error_code api.Code, code int) {
+	shard := all_tasks.Shard(id)
+	shard.RLock()
+	defer shard.RUnlock()
+	found, error_code, code := lookup_task(id)
+	if found == nil {
+		return Task{ID: -1}, nil, error_code, code
+	}
+	task = *found
+	if task.OutputRef != "" {
+		// The blob is opened under the lock so that eviction cannot delete it first. Once open, it
+		// stays readable.
+		var err error
+		blob, err = blobs.Open(task.OutputRef)
+		if err != nil {
+			lgr.Error(err).Int64("id", id).Msg("open output blob")
+			return task, nil, api.OUTPUT_UNAVAILABLE, http.StatusInternalServerError
+		}
+	}
+	return task, blob, "", http.StatusOK
+}
+
+func is_terminal(status string) bool {
+	return status == api.STATUS_FINISHED || status == api.STATUS_FAILED || status == api.STATUS_CANCELLED
+}
+
+// finish_task moves a task into a terminal status. The caller holds the lock of the task's shard.
+func finish_task(task *Task, status string) {
+	invariant.Always(is_terminal(status), "Task finishes with a terminal status")
+	invariant.Always(task.FinishedAt.IsZero(), "Task finishes once")
+	task.Status = status
+	task.FinishedAt = time.Now()
+	if task.WorkerID != "" {
+		workers.Unassign(task.WorkerID, task.ID)
+		task.WorkerID = ""
+	}
+	retention.Track(task)
+	task_events.Publish(task)
+	tasks_completed_total.Inc(status)
+	if status == api.STATUS_FINISHED {
+		task_processing_seconds.Observe(task.FinishedAt.Sub(task.StartedAt).Seconds())
+	}
+	if task.CallbackURL != "" {
+		webhooks.Enqueue(task.ID)
+	}
+}
+
+// release_scheduled moves a task that just became due from scheduled_tasks into pending_tasks.
+func release_scheduled(id int64) {
+	shard := all_tasks.Shard(id)
+	shard.Lock()
+	defer shard.Unlock()
+	task, ok := shard.tasks[id]
+	// Cancellation can win the race against the scheduler popping the task, and the cancelled
+	// task may even have been evicted since.
+	if !ok || task.Status == api.STATUS_CANCELLED {
+		return
+	}
+	invariant.Always(task.Status == api.STATUS_SCHEDULED, "Due task is still scheduled")
+	task.Status = api.STATUS_PENDING
+	pending_tasks.Enqueue(task.Type, id)
+	task_events.Publish(task)
+}
+
+// claim_pending marks a task that just left pending_tasks as PROCESSING by worker_id, which is
+// empty for workers that did not register. It returns false if the task was cancelled between
+// leaving the queue and this call, in which case the caller should dequeue another one.
+func claim_pending(id int64, worker_id string) (claimed api.PendingTask, ok bool) {
+	shard := all_tasks.Shard(id)
+	shard.Lock()
+	defer shard.Unlock()
+	task, ok := shard.tasks[id]
+	if !ok || task.Status == api.STATUS_CANCELLED {
+		return api.PendingTask{}, false
+	}
+	invariant.Always(task.Status == api.STATUS_PENDING, "Dequeued task is pending")
+	if worker_id != "" {
+		// A dead worker's tasks would only be handed back again, so it gets none.
+		if !workers.Assign(worker_id, id) {
+			pending_tasks.EnqueueFront(task.Type, id)
+			return api.PendingTask{}, false
+		}
+		task.WorkerID = worker_id
+	}
+	task.Status = api.STATUS_PROCESSING
+	task.StartedAt = time.Now()
+	task_events.Publish(task)
+	pending_since := task.SubmittedAt
+	if !task.RunAt.IsZero() {
+		pending_since = task.RunAt
+	}
+	tasks_dequeued_total.Inc()
+	task_queue_seconds.Observe(task.StartedAt.Sub(pending_since).Seconds())
+	return api.PendingTask{ID: task.ID, Type: task.Type, Input: task.Input, TimeoutMillisecond: task.Timeout.Milliseconds()}, true
+}
+
+// release_delivery undoes claim_pending for tasks whose response never reached worker_id. They go
+// back to the head of pending_tasks in their original order. Tasks that moved on meanwhile, because
+// they were cancelled or handed back when the worker was declared dead, are left alone.
+func release_delivery(ids []int64, worker_id string) {
+	for i := len(ids) - 1; i >= 0; i-- {
+		shard := all_tasks.Shard(ids[i])
+		shard.Lock()
+		task, ok := shard.tasks[ids[i]]
+		if ok && task.Status == api.STATUS_PROCESSING && task.WorkerID == worker_id {
+			if worker_id != "" {
+				workers.Unassign(worker_id, task.ID)
+				task.WorkerID = ""
+			}
+			task.Status = api.STATUS_PENDING
+			task.StartedAt = time.Time{}
+			pending_tasks.EnqueueFront(task.Type, task.ID)
+			task_events.Publish(task)
+		}
+		shard.Unlock()
+	}
+}
+
+// complete_task records the output of worker_id, which is empty for workers that did not register,
+// or that the task failed if payload.Failure is set. error_code is empty on success.
+func complete_task(payload *api.ProcessedRequest, worker_id string) (error_code api.Code, code int) {
+	// Large outputs are offloaded before taking the lock to keep disk I/O out of the critical
+	// section. If the task turns out to be cancelled, the blob is released again.
+	output_ref := ""
+	if payload.Failure == "" && output_size_bytes(payload.Output) > BLOB_THRESHOLD_BYTES {
+		data, err := json.Marshal(payload.Output)
+		invariant.AlwaysNil(err, "Output is JSON serializable")
+		output_ref, err = blobs.Put(data)
+		if err != nil {
+			lgr.Error(err).Int64("id", payload.ID).Msg("offload output to blob store. keeping it in memory")
+			output_ref = ""
+		}
+	}
+
+	shard := all_tasks.Shard(payload.ID)
+	shard.Lock()
+	defer shard.Unlock()
+	task, exists := shard.tasks[payload.ID]
+	switch {
+	case !exists && (payload.ID < 0 || payload.ID >= next_id.Load()):
+		// A worker with a bug, or one that outlived a backend restart, commits an ID that was never
+		// handed out.
+		error_code, code = api.UNKNOWN_TASK, http.StatusBadRequest
+	case !exists || task.Status == api.STATUS_CANCELLED:
+		// The client withdrew the task while the worker was computing it. The output is discarded.
+		// Only such a task can be evicted before the worker completes it, unless it was also
+		// reassigned to and finished by another worker.
+		error_code, code = api.TASK_CANCELLED, http.StatusConflict
+	case task.Input != payload.Input:
+		error_code, code = api.INPUT_MISMATCH, http.StatusBadRequest
+	}
+	if error_code != "" {
+		if output_ref != "" {
+			blobs.Release(output_ref)
+		}
+		return error_code, code
+	}
+	if task.Status != api.STATUS_PROCESSING || (worker_id != "" && task.WorkerID != worker_id) {
+		// The worker was declared dead and the task handed back, after which another worker may
+		// have taken it or even finished it.
+		if output_ref != "" {
+			blobs.Release(output_ref)
+		}
+		return api.TASK_REASSIGNED, http.StatusConflict
+	}
+	if payload.Failure != "" {
+		task.Failure = payload.Failure
+		task.FailureMessage = payload.FailureMessage[:min(len(payload.FailureMessage), MAX_FAILURE_MESSAGE_LENGTH)]
+		lgr.Warn().Int64("id", task.ID).Str("failure", task.Failure).Str("message", task.FailureMessage).Msg("task failed")
+		finish_task(task, api.STATUS_FAILED)
+		return "", http.StatusOK
+	}
+	if output_ref != "" {
+		task.OutputRef = output_ref
+	} else {
+		task.Output = payload.Output
+	}
+	finish_task(task, api.STATUS_FINISHED)
+	return "", http.StatusOK
+}
+
+// cancel_task withdraws a task. On success, status is api.STATUS_CANCELLED and error_code is empty.
+// status is empty if the task does not exist.
+func cancel_task(id int64) (status string, error_code api.Code, code int) {
+	shard := all_tasks.Shard(id)
+	shard.Lock()
+	defer shard.Unlock()
+	task, error_code, code := lookup_task(id)
+	if task == nil {
+		return "", error_code, code
+	}
+	switch task.Status {
+	default:
+		invariant.Unreachable("Task has a known status")
+	case api.STATUS_SCHEDULED:
+		// Run may have already popped the task, in which case release_scheduled sees the
+		// cancellation and drops it.
+		scheduled_tasks.Remove(task.ID)
+	case api.STATUS_PENDING:
+		// Same race as above, with GET /pending and claim_pending instead of the scheduler.
+		pending_tasks.Remove(task.Type, task.ID)
+	case api.STATUS_PROCESSING:
+		// The worker holding the task is told when it submits its output.
+	case api.STATUS_CANCELLED:
+		return task.Status, "", http.StatusOK
+	case api.STATUS_FINISHED, api.STATUS_FAILED:
+		return task.Status, api.TASK_FINISHED, http.StatusConflict
+	}
+	finish_task(task, api.STATUS_CANCELLED)
+	return task.Status, "", http.StatusOK
+}
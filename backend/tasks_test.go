@@ -0,0 +1,102 @@
+package main
+
+import (
+	"api"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestFailedTaskIsTerminal(t *testing.T) {
+	with_workers(t)
+	id, _, _, _ := submit_task(&api.SubmitRequest{Data: "x"}, "", nil)
+	take(t, "")
+	message := strings.Repeat("m", MAX_FAILURE_MESSAGE_LENGTH+1)
+	payload := &api.ProcessedRequest{ID: id, Input: "x", Output: []string{"ignored"}, Failure: api.FAILURE_DEADLINE_EXCEEDED, FailureMessage: message}
+	if error_code, _ := complete_task(payload, ""); error_code != "" {
+		t.Fatal(error_code)
+	}
+
+	task, _, _, _ := snapshot_task(id)
+	if task.Status != api.STATUS_FAILED || task.Failure != api.FAILURE_DEADLINE_EXCEEDED || len(task.FailureMessage) != MAX_FAILURE_MESSAGE_LENGTH || task.Output != nil {
+		t.Fatalf("Got: %s %s %d bytes of message, output %v\nWant: FAILED deadline_exceeded, a truncated message and no output",
+			task.Status, task.Failure, len(task.FailureMessage), task.Output)
+	}
+	if _, error_code, code := cancel_task(id); error_code != api.TASK_FINISHED || code != http.StatusConflict {
+		t.Fatalf("Got: %q %d\nWant: %q 409", error_code, code, api.TASK_FINISHED)
+	}
+	if error_code, _ := complete_task(&api.ProcessedRequest{ID: id, Input: "x"}, ""); error_code != api.TASK_REASSIGNED {
+		t.Fatalf("Got: %q\nWant: %q", error_code, api.TASK_REASSIGNED)
+	}
+	if listing, _ := list_tasks(url.Values{"status": {api.STATUS_FAILED}}); len(listing.Tasks) != 1 || listing.Counts[api.STATUS_FAILED] != 1 {
+		t.Fatalf("Got: %+v\nWant: the failed task", listing)
+	}
+}
+
+func TestSubmitterTimeoutIsHandedToTheWorker(t *testing.T) {
+	with_workers(t)
+	// The largest timeouts would overflow a time.Duration, wrapping to a short or negative one.
+	for _, timeout := range []int64{-1, MAX_TASK_TIMEOUT.Milliseconds() + 1, 18446744073709552, math.MaxInt64 / 1000, math.MaxInt64} {
+		if _, _, error_code, _ := submit_task(&api.SubmitRequest{Data: "x", TimeoutMillisecond: timeout}, "", nil); error_code != api.MALFORMED_TIMEOUT {
+			t.Fatalf("Got: %q for %dms\nWant: %q", error_code, timeout, api.MALFORMED_TIMEOUT)
+		}
+	}
+	submit_task(&api.SubmitRequest{Data: "x", TimeoutMillisecond: 1500}, "", nil)
+	id, _ := pending_tasks.TryDequeue(default_types)
+	if claimed, _ := claim_pending(id, ""); claimed.TimeoutMillisecond != 1500 {
+		t.Fatalf("Got: %dms\nWant: 1500ms", claimed.TimeoutMillisecond)
+	}
+}
+
+func TestScheduleDelayIsBounded(t *testing.T) {
+	with_scheduler(t)
+	// The largest delays would overflow a time.Duration and land in the past.
+	for _, delay := range []int64{-1, MAX_SCHEDULE_DELAY.Milliseconds() + 1, math.MaxInt64} {
+		if _, _, error_code, _ := submit_task(&api.SubmitRequest{Data: "x", DelayMillisecond: delay}, "", nil); error_code != api.MALFORMED_SCHEDULE {
+			t.Fatalf("Got: %q for %dms\nWant: %q", error_code, delay, api.MALFORMED_SCHEDULE)
+		}
+	}
+	id, _, error_code, _ := submit_task(&api.SubmitRequest{Data: "x", DelayMillisecond: MAX_SCHEDULE_DELAY.Milliseconds()}, "", nil)
+	if task, _, _, _ := snapshot_task(id); error_code != "" || task.Status != api.STATUS_SCHEDULED {
+		t.Fatalf("Got: %q %s\nWant: SCHEDULED", error_code, task.Status)
+	}
+}
+
+func TestProcessedBatchRejectsBadWorkerInput(t *testing.T) {
+	with_workers(t)
+	mux := http.NewServeMux()
+	register_routes(mux)
+	post := func(body string) (int, string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, api.PREFIX+"/processed/batch", strings.NewReader(body)))
+		return w.Code, w.Body.String()
+	}
+
+	if code, body := post(`[{"id":`); code != http.StatusBadRequest || !strings.Contains(body, string(api.MALFORMED_JSON)) {
+		t.Fatalf("Got: %d %s\nWant: 400 %s", code, body, api.MALFORMED_JSON)
+	}
+
+	submit_task(&api.SubmitRequest{Data: "x"}, "", nil)
+	submit_task(&api.SubmitRequest{Data: "y"}, "", nil)
+	good, mismatched := take(t, ""), take(t, "")
+	unknown := next_id.Load() + 1000
+	code, body := post(fmt.Sprintf(`[{"id":%d,"input":"x","output":["x"]},{"id":%d,"input":"x","output":["x"]},{"id":%d,"input":"z","output":["z"]}]`, good, unknown, mismatched))
+	responses := []api.ProcessedResponse{}
+	if err := json.Unmarshal([]byte(body), &responses); code != http.StatusOK || err != nil || len(responses) != 3 {
+		t.Fatalf("Got: %d %s\nWant: 200 with an item per task", code, body)
+	}
+	for i, want := range []api.Code{"", api.UNKNOWN_TASK, api.INPUT_MISMATCH} {
+		if responses[i].Error != want {
+			t.Errorf("Item %d\nGot: %q\nWant: %q", i, responses[i].Error, want)
+		}
+	}
+	if task, _, _, _ := snapshot_task(mismatched); task.Status != api.STATUS_PROCESSING || task.Output != nil {
+		t.Fatalf("Got: %s %v\nWant: the mismatched task left PROCESSING without output", task.Status, task.Output)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync"
+)
+
+// TaskTable holds every retained task, split into shards by ID so that requests for different
+// tasks do not contend on one lock. IDs are handed out sequentially, so consecutive tasks land in
+// different shards.
+//
+// A shard's lock guards the tasks in it, including every field of those tasks. Code never holds
+// two shard locks at once, which is what keeps the lock order simple:
+//
+//	shard → pending_tasks, scheduled_tasks, task_events, retention → Subscription
+type TaskTable struct {
+	shards []TaskShard
+}
+
+type TaskShard struct {
+	sync.RWMutex
+	tasks map[int64]*Task
+	// Pads the shard to its own cache line, so that locking one shard does not slow down the
+	// shards next to it.
+	_ [64]byte
+}
+
+// DEFAULT_TASK_SHARDS is comfortably more than the number of cores the backend runs on.
+const DEFAULT_TASK_SHARDS = 64
+
+func NewTaskTable(shards int) *TaskTable {
+	table := &TaskTable{shards: make([]TaskShard, shards)}
+	for i := range table.shards {
+		table.shards[i].tasks = make(map[int64]*Task)
+	}
+	return table
+}
+
+// Shard returns the shard that holds id, whether or not the task exists.
+func (table *TaskTable) Shard(id int64) *TaskShard {
+	return &table.shards[uint64(id)%uint64(len(table.shards))]
+}
+
+// Insert adds a new task.
+func (table *TaskTable) Insert(task *Task) {
+	shard := table.Shard(task.ID)
+	shard.Lock()
+	shard.tasks[task.ID] = task
+	shard.Unlock()
+}
+
+// Range calls fn for every task, holding the read lock of one shard at a time. Tasks in different
+// shards are therefore not seen at the same instant, which is fine for listings and metrics.
+func (table *TaskTable) Range(fn func(task *Task)) {
+	for i := range table.shards {
+		shard := &table.shards[i]
+		shard.RLock()
+		for _, task := range shard.tasks {
+			fn(task)
+		}
+		shard.RUnlock()
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"api"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTaskTableRangeVisitsEveryShard(t *testing.T) {
+	table := NewTaskTable(4)
+	for id := range int64(10) {
+		table.Insert(&Task{ID: id})
+	}
+	seen := map[int64]bool{}
+	table.Range(func(task *Task) { seen[task.ID] = true })
+	if len(seen) != 10 {
+		t.Fatalf("Got: %d tasks\nWant: 10", len(seen))
+	}
+	if table.Shard(3) == table.Shard(4) || table.Shard(3) != table.Shard(7) {
+		t.Fatal("Tasks are not spread over shards by ID")
+	}
+}
+
+// The benchmarks run the real submit, dequeue, complete and status paths against a table with a
+// single shard, which behaves like the global lock the table replaced, and against the default.
+//
+//	go test -run '^$' -bench . -cpu 1,4,16
+
+func with_task_table(b *testing.B, shards int) {
+	all_tasks = NewTaskTable(shards)
+	pending_tasks = NewPendingQueues()
+	retention = NewRetention(time.Hour, 1<<40)
+	b.Cleanup(func() {
+		all_tasks = NewTaskTable(DEFAULT_TASK_SHARDS)
+		pending_tasks = NewPendingQueues()
+		retention = NewRetention(time.Hour, 1<<40)
+	})
+}
+
+var benchmark_shards = []int{1, DEFAULT_TASK_SHARDS}
+
+// BenchmarkSubmit is many clients submitting at a high rate.
+func BenchmarkSubmit(b *testing.B) {
+	for _, shards := range benchmark_shards {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			with_task_table(b, shards)
+			payload := &api.SubmitRequest{Data: "abcdef"}
+			b.SetParallelism(8)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, _, error_code, _ := submit_task(payload, "", nil); error_code != "" {
+						b.Fatal(error_code)
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkWorkers is many workers taking and completing tasks while clients keep submitting and
+// polling their status.
+func BenchmarkWorkers(b *testing.B) {
+	for _, shards := range benchmark_shards {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			with_task_table(b, shards)
+			payload := &api.SubmitRequest{Data: "abcdef"}
+			output := substrings(payload.Data)
+			b.SetParallelism(8)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					id, _, _, _ := submit_task(payload, "", nil)
+					snapshot_task(id)
+					id, ok := pending_tasks.TryDequeue(default_types)
+					if !ok {
+						continue
+					}
+					claimed, ok := claim_pending(id, "")
+					if !ok {
+						b.Fatal("Dequeued task could not be claimed")
+					}
+					if error_code, _ := complete_task(&api.ProcessedRequest{ID: id, Input: claimed.Input, Output: output}, ""); error_code != "" {
+						b.Fatal(error_code)
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkStatusWhileCompleting is clients reading large finished outputs while workers complete
+// other tasks. locked_encode encodes the response with the shard lock held, as GET /status used to.
+func BenchmarkStatusWhileCompleting(b *testing.B) {
+	for _, shards := range benchmark_shards {
+		for _, locked_encode := range []bool{true, false} {
+			b.Run(fmt.Sprintf("shards=%d/locked_encode=%v", shards, locked_encode), func(b *testing.B) {
+				with_task_table(b, shards)
+				// Just under BLOB_THRESHOLD_BYTES, so that the output stays in memory.
+				large := make([]string, 1000)
+				for i := range large {
+					large[i] = strings.Repeat("x", 40)
+				}
+				const FINISHED = 1024
+				first := next_id.Load()
+				for range FINISHED {
+					id, _, _, _ := submit_task(&api.SubmitRequest{Data: "x"}, "", nil)
+					pending_tasks.TryDequeue(default_types)
+					claim_pending(id, "")
+					complete_task(&api.ProcessedRequest{ID: id, Input: "x", Output: large}, "")
+				}
+				var i atomic.Int64
+				b.SetParallelism(8)
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						n := i.Add(1)
+						if n%4 != 0 {
+							id := first + n%FINISHED
+							if locked_encode {
+								shard := all_tasks.Shard(id)
+								shard.RLock()
+								task, _, _ := lookup_task(id)
+								json.NewEncoder(io.Discard).Encode(task.Output)
+								shard.RUnlock()
+							} else {
+								task, _, _, _ := snapshot_task(id)
+								json.NewEncoder(io.Discard).Encode(task.Output)
+							}
+							continue
+						}
+						submit_task(&api.SubmitRequest{Data: "y"}, "", nil)
+						id, ok := pending_tasks.TryDequeue(default_types)
+						if !ok {
+							continue
+						}
+						claimed, _ := claim_pending(id, "")
+						complete_task(&api.ProcessedRequest{ID: id, Input: claimed.Input, Output: []string{claimed.Input}}, "")
+					}
+				})
+			})
+		}
+	}
+}
+
+// substrings is the worker's computation, without its artificial delay.
+func substrings(s string) []string {
+	out := []string{}
+	for i := range len(s) {
+		for j := i + 1; j <= len(s); j++ {
+			out = append(out, s[i:j])
+		}
+	}
+	return out
+}
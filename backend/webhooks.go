@@ -0,0 +1,207 @@
+package main
+
+import (
+	"api"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/james-orcales/golang_snacks/invariant"
+)
+
+// Webhooks POSTs a task's result to its callback URL once the task reaches a terminal status.
+// Delivery is at least once: a receiver can see the same delivery twice if its response is lost,
+// and should deduplicate on the X-Webhook-ID header.
+//
+// Every request is signed with HMAC-SHA256 over "<X-Webhook-Timestamp>.<body>" and the signature
+// sent as "X-Webhook-Signature: sha256=<hex>". Receivers should recompute it and reject stale
+// timestamps to prevent replays.
+//
+// Attempts are recorded on the task itself (Task.Deliveries), so the delivery log is evicted along
+// with the task.
+type Webhooks struct {
+	// tasks is the table deliveries read the task from and record their attempts on.
+	tasks        *TaskTable
+	secret       []byte
+	max_attempts int
+	// backoff is the delay before the second attempt. It doubles for every attempt after that.
+	backoff time.Duration
+	client  *http.Client
+	// due holds IDs of tasks with a delivery that should be attempted now. Retries are put back
+	// once their backoff elapses, so that a receiver that is down does not tie up a sender.
+	due *Int64Queue
+}
+
+const WEBHOOK_MAX_BACKOFF = time.Minute
+
+func NewWebhooks(tasks *TaskTable, secret []byte, max_attempts int, backoff time.Duration) *Webhooks {
+	return &Webhooks{
+		tasks:        tasks,
+		secret:       secret,
+		max_attempts: max_attempts,
+		backoff:      backoff,
+		client:       &http.Client{Timeout: time.Second * 10},
+		due:          NewInt64Queue(),
+	}
+}
+
+// valid_callback_url reports whether raw is an absolute http(s) URL.
+func valid_callback_url(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Enqueue schedules the first delivery for a task that just became terminal. It does not block, so
+// it can be called with a shard locked.
+func (webhooks *Webhooks) Enqueue(id int64) {
+	webhooks.due.Enqueue(id)
+}
+
+// Run delivers due webhooks with the given number of concurrent senders until ctx is done. It
+// returns once every sender has stopped. Retries still waiting out their backoff are dropped.
+func (webhooks *Webhooks) Run(ctx context.Context, senders int) {
+	var wg sync.WaitGroup
+	for range senders {
+		wg.Go(func() { webhooks.send_loop(ctx) })
+	}
+	wg.Wait()
+}
+
+func (webhooks *Webhooks) send_loop(ctx context.Context) {
+	for {
+		id, err := webhooks.due.Dequeue(ctx)
+		if err != nil {
+			return
+		}
+		webhooks.deliver(ctx, id)
+	}
+}
+
+// Sign returns the X-Webhook-Signature value for a request body.
+func (webhooks *Webhooks) Sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, webhooks.secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (webhooks *Webhooks) deliver(ctx context.Context, id int64) {
+	// === Build payload ===
+	var callback_url string
+	var attempt int
+	payload := api.WebhookPayload{ID: id}
+	{
+		shard := webhooks.tasks.Shard(id)
+		shard.RLock()
+		task, ok := shard.tasks[id]
+		if !ok {
+			shard.RUnlock()
+			lgr.Warn().Int64("id", id).Msg("task was evicted before its webhook was delivered")
+			return
+		}
+		callback_url = task.CallbackURL
+		attempt = len(task.Deliveries) + 1
+		payload.Status = task.Status
+		payload.Failure = task.Failure
+		payload.FinishedAt = format_time(task.FinishedAt)
+		var blob io.ReadCloser
+		var err error
+		if task.Status == api.STATUS_FINISHED {
+			if task.OutputRef != "" {
+				// Opened under the lock for the same reason as in GET /status.
+				blob, err = blobs.Open(task.OutputRef)
+			} else {
+				payload.Output, err = json.Marshal(task.Output)
+			}
+		}
+		shard.RUnlock()
+		if blob != nil {
+			payload.Output, err = io.ReadAll(blob)
+			blob.Close()
+		}
+		if err != nil {
+			lgr.Error(err).Int64("id", id).Msg("read output for webhook. giving up")
+			return
+		}
+	}
+	body, err := json.Marshal(&payload)
+	invariant.AlwaysNil(err, "Webhook payload is JSON serializable")
+
+	// === Send ===
+	start := time.Now()
+	record := api.DeliveryAttempt{Attempt: attempt, At: format_time(start)}
+	retry := false
+	{
+		timestamp := strconv.FormatInt(start.Unix(), 10)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, callback_url, bytes.NewReader(body))
+		invariant.AlwaysNil(err, "Callback URL was validated on submit")
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Webhook-ID", strconv.FormatInt(id, 10))
+		req.Header.Set("X-Webhook-Timestamp", timestamp)
+		req.Header.Set("X-Webhook-Signature", webhooks.Sign(timestamp, body))
+		resp, err := webhooks.client.Do(req)
+		if err != nil {
+			record.Error = err.Error()
+			retry = true
+		} else {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+			resp.Body.Close()
+			record.StatusCode = resp.StatusCode
+			switch {
+			case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			case resp.StatusCode >= 500, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusRequestTimeout:
+				retry = true
+			default:
+				// Any other client error will not go away by sending the same request again.
+			}
+		}
+		record.DurationMillis = time.Since(start).Milliseconds()
+	}
+
+	// === Record ===
+	shard := webhooks.tasks.Shard(id)
+	shard.Lock()
+	if task, ok := shard.tasks[id]; ok {
+		task.Deliveries = append(task.Deliveries, record)
+	}
+	shard.Unlock()
+
+	webhook_deliveries_total.Inc(strconv.Itoa(record.StatusCode))
+	switch {
+	case record.StatusCode >= 200 && record.StatusCode < 300:
+		lgr.Info().Int64("id", id).Int("attempt", attempt).Int("status_code", record.StatusCode).Msg("delivered webhook")
+	case !retry || attempt >= webhooks.max_attempts:
+		lgr.Warn().
+			Int64("id", id).Int("attempt", attempt).Int("status_code", record.StatusCode).Str("error", record.Error).
+			Msg("webhook delivery failed. giving up")
+	default:
+		// The shift is capped so that a large WEBHOOK_MAX_ATTEMPTS cannot overflow the delay.
+		delay := min(WEBHOOK_MAX_BACKOFF, webhooks.backoff<<min(attempt-1, 16))
+		// Jitter spreads out the retries of many tasks that failed against the same receiver.
+		delay = delay/2 + rand.N(delay/2+1)
+		lgr.Info().
+			Int64("id", id).Int("attempt", attempt).Int("status_code", record.StatusCode).Str("error", record.Error).
+			Int64("retry_in_ms", delay.Milliseconds()).
+			Msg("webhook delivery failed. retrying")
+		go func() {
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				webhooks.due.Enqueue(id)
+			case <-ctx.Done():
+			}
+		}()
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"api"
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/james-orcales/golang_snacks/itlog"
+)
+
+// TestWebhooksDeliverySemantics runs a local receiver that checks every signature and answers with
+// a scripted sequence of status codes.
+func TestWebhooksDeliverySemantics(t *testing.T) {
+	lgr = itlog.New(io.Discard, itlog.LevelInfo)
+
+	tests := []struct {
+		name  string
+		codes []int
+		// Status codes the delivery log should end up with.
+		want []int
+	}{
+		{"delivered first time", []int{200}, []int{200}},
+		{"server errors are retried", []int{500, 503, 204}, []int{500, 503, 204}},
+		{"rate limiting is retried", []int{429, 200}, []int{429, 200}},
+		{"client errors are not retried", []int{400, 200}, []int{400}},
+		{"gives up after max attempts", []int{500, 500, 500, 500}, []int{500, 500, 500}},
+	}
+	for id, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tasks := NewTaskTable(DEFAULT_TASK_SHARDS)
+			webhooks := NewWebhooks(tasks, []byte("test-secret"), 3, time.Millisecond*5)
+			ctx, cancel := context.WithCancel(context.Background())
+			stopped := make(chan struct{})
+			go func() {
+				webhooks.Run(ctx, 1)
+				close(stopped)
+			}()
+			// No sender or pending retry may outlive the test and race with the next one on lgr.
+			t.Cleanup(func() {
+				cancel()
+				<-stopped
+			})
+
+			received := make(chan api.WebhookPayload, len(tt.codes))
+			n := 0
+			receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				want := webhooks.Sign(r.Header.Get("X-Webhook-Timestamp"), body)
+				if !hmac.Equal([]byte(r.Header.Get("X-Webhook-Signature")), []byte(want)) {
+					t.Errorf("Got signature: %s\nWant: %s", r.Header.Get("X-Webhook-Signature"), want)
+				}
+				payload := api.WebhookPayload{}
+				if err := json.Unmarshal(body, &payload); err != nil {
+					t.Errorf("Malformed payload: %s", body)
+				}
+				w.WriteHeader(tt.codes[n])
+				n++
+				received <- payload
+			}))
+			defer receiver.Close()
+
+			task := &Task{ID: int64(id), Status: api.STATUS_FINISHED, Output: []string{"a"}, CallbackURL: receiver.URL, FinishedAt: time.Now()}
+			tasks.Insert(task)
+			webhooks.Enqueue(task.ID)
+
+			for range tt.want {
+				select {
+				case payload := <-received:
+					if payload.ID != task.ID || payload.Status != api.STATUS_FINISHED || string(payload.Output) != `["a"]` {
+						t.Fatalf("Got payload: %+v", payload)
+					}
+				case <-time.After(time.Second * 2):
+					t.Fatal("Timed out waiting for a delivery")
+				}
+			}
+			// Leave time for an unwanted extra attempt to show up
+			time.Sleep(time.Millisecond * 50)
+			if len(received) > 0 {
+				t.Fatalf("Got %d more deliveries than expected", len(received))
+			}
+
+			shard := tasks.Shard(task.ID)
+			shard.RLock()
+			defer shard.RUnlock()
+			if len(task.Deliveries) != len(tt.want) {
+				t.Fatalf("Got %d logged attempts\nWant: %d", len(task.Deliveries), len(tt.want))
+			}
+			for i, attempt := range task.Deliveries {
+				if attempt.Attempt != i+1 || attempt.StatusCode != tt.want[i] {
+					t.Errorf("Got attempt: %+v\nWant: attempt %d with status %d", attempt, i+1, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"api"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/james-orcales/golang_snacks/invariant"
+)
+
+// WorkerRegistry tracks the workers that registered with POST /workers and the tasks handed to
+// each. A worker that misses heartbeats for longer than timeout is declared dead and its tasks go
+// back to pending_tasks. Dead workers stay listed for dead_retention, and come back to life if
+// they resume sending heartbeats.
+//
+// Workers that never registered still work, but their tasks are not tracked: if one dies, its
+// tasks stay PROCESSING.
+type WorkerRegistry struct {
+	heartbeat_interval time.Duration
+	timeout            time.Duration
+	dead_retention     time.Duration
+	mu                 sync.Mutex
+	workers            map[string]*Worker
+}
+
+type Worker struct {
+	ID string
+	// Owner is the name of the principal that registered the worker, and the only one that may act
+	// as it. It is empty while authentication is disabled.
+	Owner        string
+	Types        []string
+	Capabilities []string
+	// Slots is how many tasks the worker processes at once.
+	Slots         int
+	RegisteredAt  time.Time
+	LastHeartbeat time.Time
+	// DiedAt is zero while the worker is alive.
+	DiedAt time.Time
+	// Reported is what the last heartbeat said the worker was doing.
+	Reported  []int64
+	Stats     api.WorkerStats
+	SlotStats []api.SlotStats
+	// held are the tasks handed to the worker that it has not committed yet.
+	held map[int64]struct{}
+}
+
+// orphaned_tasks are the tasks a worker held when it died, restarted or deregistered.
+type orphaned_tasks struct {
+	worker string
+	ids    []int64
+	reason string
+}
+
+// Reasons tasks are handed back, for the backend_tasks_requeued_total metric.
+const (
+	REQUEUE_WORKER_DEAD         = "worker_dead"
+	REQUEUE_WORKER_RESTARTED    = "worker_restarted"
+	REQUEUE_WORKER_DEREGISTERED = "worker_deregistered"
+	REQUEUE_WORKER_RELEASED     = "worker_released"
+)
+
+const MAX_WORKER_ID_LENGTH = 128
+
+const MAX_TASK_TYPE_LENGTH = 64
+
+const MAX_WORKER_SLOTS = 1024
+
+// default_types are the task types of workers that did not list any, or did not register.
+var default_types = []string{api.DEFAULT_TASK_TYPE}
+
+func NewWorkerRegistry(heartbeat_interval time.Duration, missed_heartbeats int, dead_retention time.Duration) *WorkerRegistry {
+	return &WorkerRegistry{
+		heartbeat_interval: heartbeat_interval,
+		timeout:            heartbeat_interval * time.Duration(missed_heartbeats),
+		dead_retention:     dead_retention,
+		workers:            make(map[string]*Worker),
+	}
+}
+
+func valid_worker_id(id string) bool {
+	return id != "" && len(id) <= MAX_WORKER_ID_LENGTH && !strings.ContainsFunc(id, func(r rune) bool { return r <= ' ' })
+}
+
+func valid_task_type(task_type string) bool {
+	return task_type != "" && len(task_type) <= MAX_TASK_TYPE_LENGTH && !strings.ContainsFunc(task_type, func(r rune) bool {
+		return !('a' <= r && r <= 'z' || '0' <= r && r <= '9' || r == '-' || r == '_' || r == '.')
+	})
+}
+
+// Register adds a worker owned by owner. If the ID is already registered, the worker is assumed to
+// have restarted and lost whatever it held, which is returned for requeue_orphaned. ok is false if
+// the ID is registered to another owner, in which case nothing changes.
+func (registry *WorkerRegistry) Register(id, owner string, types, capabilities []string, slots int, now time.Time) (orphaned orphaned_tasks, ok bool) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	orphaned = orphaned_tasks{worker: id, reason: REQUEUE_WORKER_RESTARTED}
+	if previous, exists := registry.workers[id]; exists {
+		if previous.Owner != owner {
+			return orphaned_tasks{}, false
+		}
+		orphaned.ids = previous.take_held()
+	}
+	registry.workers[id] = &Worker{
+		ID:           id,
+		Owner:        owner,
+		Types:        types,
+		Capabilities: capabilities,
+		Slots:        slots,
+		RegisteredAt: now,
+		// Registering counts as the first sign of life.
+		LastHeartbeat: now,
+		held:          make(map[int64]struct{}),
+	}
+	return orphaned, true
+}
+
+// Owns reports whether owner may act as worker id: id is registered to owner, or not registered at
+// all, which the caller then reports on its own terms.
+func (registry *WorkerRegistry) Owns(id, owner string) bool {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	worker, ok := registry.workers[id]
+	return !ok || worker.Owner == owner
+}
+
+// Heartbeat records that a worker is alive. It returns false if the worker is unknown.
+func (registry *WorkerRegistry) Heartbeat(id string, heartbeat *api.HeartbeatRequest, now time.Time) bool {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	worker, ok := registry.workers[id]
+	if !ok {
+		return false
+	}
+	if !worker.DiedAt.IsZero() {
+		lgr.Warn().Str("worker", id).Msg("dead worker resumed sending heartbeats")
+		worker.DiedAt = time.Time{}
+	}
+	worker.LastHeartbeat = now
+	worker.Reported = heartbeat.Tasks
+	worker.Stats = heartbeat.Stats
+	worker.SlotStats = heartbeat.Slots
+	return true
+}
+
+// Deregister removes a worker, returning the tasks it still held. ok is false if it was unknown.
+func (registry *WorkerRegistry) Deregister(id string) (orphaned orphaned_tasks, ok bool) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	worker, ok := registry.workers[id]
+	if !ok {
+		return orphaned_tasks{}, false
+	}
+	delete(registry.workers, id)
+	return orphaned_tasks{worker: id, ids: worker.take_held(), reason: REQUEUE_WORKER_DEREGISTERED}, true
+}
+
+// Release takes the given tasks from those held by id, skipping the ones it does not hold, so that
+// they can be handed back before the worker deregisters.
+func (registry *WorkerRegistry) Release(id string, tasks []int64) (orphaned orphaned_tasks, ok bool) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	worker, ok := registry.workers[id]
+	if !ok {
+		return orphaned_tasks{}, false
+	}
+	orphaned = orphaned_tasks{worker: id, reason: REQUEUE_WORKER_RELEASED}
+	for _, task := range tasks {
+		if _, held := worker.held[task]; held {
+			delete(worker.held, task)
+			orphaned.ids = append(orphaned.ids, task)
+		}
+	}
+	return orphaned, true
+}
+
+// Alive reports whether id is registered and not dead.
+func (registry *WorkerRegistry) Alive(id string) bool {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	worker, ok := registry.workers[id]
+	return ok && worker.DiedAt.IsZero()
+}
+
+// Types returns the task types of a live worker. alive is false if id is unknown or dead.
+func (registry *WorkerRegistry) Types(id string) (types []string, alive bool) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	worker, ok := registry.workers[id]
+	if !ok || !worker.DiedAt.IsZero() {
+		return nil, false
+	}
+	return worker.Types, true
+}
+
+// Supports reports whether tasks of task_type can be submitted: some registered worker lists it,
+// or it is api.DEFAULT_TASK_TYPE. Workers recently declared dead count, so that a worker crashing
+// does not turn submissions away while it restarts.
+func (registry *WorkerRegistry) Supports(task_type string) bool {
+	if task_type == api.DEFAULT_TASK_TYPE {
+		return true
+	}
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	for _, worker := range registry.workers {
+		if slices.Contains(worker.Types, task_type) {
+			return true
+		}
+	}
+	return false
+}
+
+// Assign records that a task was handed to a worker. It returns false if the worker is unknown or
+// dead, in which case the task must not be handed to it. The caller holds the lock of the task's
+// shard.
+func (registry *WorkerRegistry) Assign(id string, task int64) bool {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	worker, ok := registry.workers[id]
+	if !ok || !worker.DiedAt.IsZero() {
+		return false
+	}
+	worker.held[task] = struct{}{}
+	return true
+}
+
+// Unassign forgets that a worker holds a task, once the task is committed or handed back. The
+// caller holds the lock of the task's shard.
+func (registry *WorkerRegistry) Unassign(id string, task int64) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if worker, ok := registry.workers[id]; ok {
+		delete(worker.held, task)
+	}
+}
+
+// Reap declares workers dead once they missed their heartbeats, forgets workers that have been
+// dead for dead_retention, and returns the tasks held by dead workers. A dead worker's tasks are
+// taken on every call, as a worker may be handed a task just before it is declared dead.
+func (registry *WorkerRegistry) Reap(now time.Time) []orphaned_tasks {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	orphaned := []orphaned_tasks{}
+	for id, worker := range registry.workers {
+		if worker.DiedAt.IsZero() && now.Sub(worker.LastHeartbeat) > registry.timeout {
+			worker.DiedAt = now
+			workers_died_total.Inc()
+			lgr.Warn().Str("worker", id).Int("held", len(worker.held)).Msg("worker missed its heartbeats. declaring it dead")
+		}
+		if worker.DiedAt.IsZero() {
+			continue
+		}
+		if len(worker.held) > 0 {
+			orphaned = append(orphaned, orphaned_tasks{worker: id, ids: worker.take_held(), reason: REQUEUE_WORKER_DEAD})
+		}
+		if now.Sub(worker.DiedAt) > registry.dead_retention {
+			delete(registry.workers, id)
+		}
+	}
+	return orphaned
+}
+
+// take_held empties the worker's held tasks and returns them. The registry is locked.
+func (worker *Worker) take_held() []int64 {
+	ids := make([]int64, 0, len(worker.held))
+	for id := range worker.held {
+		ids = append(ids, id)
+	}
+	clear(worker.held)
+	// Requeued in the order they were submitted, which IDs follow.
+	slices.Sort(ids)
+	return ids
+}
+
+// List returns every registered worker, ordered by ID.
+func (registry *WorkerRegistry) List() *api.WorkerListing {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	listing := &api.WorkerListing{Workers: make([]api.WorkerSummary, 0, len(registry.workers))}
+	for _, worker := range registry.workers {
+		summary := api.WorkerSummary{
+			ID:            worker.ID,
+			Status:        api.WORKER_ALIVE,
+			Types:         worker.Types,
+			Capabilities:  worker.Capabilities,
+			RegisteredAt:  worker.RegisteredAt.Format(time.RFC3339),
+			LastHeartbeat: worker.LastHeartbeat.Format(time.RFC3339),
+			Tasks:         worker.Reported,
+			Stats:         worker.Stats,
+			Slots:         worker.Slots,
+			SlotStats:     worker.SlotStats,
+		}
+		if !worker.DiedAt.IsZero() {
+			summary.Status = api.WORKER_DEAD
+		} else {
+			listing.Alive++
+			listing.Capacity += worker.Slots
+		}
+		listing.Workers = append(listing.Workers, summary)
+	}
+	slices.SortFunc(listing.Workers, func(a, b api.WorkerSummary) int { return strings.Compare(a.ID, b.ID) })
+	return listing
+}
+
+// Counts returns the number of workers by status.
+func (registry *WorkerRegistry) Counts() (alive, dead int) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	for _, worker := range registry.workers {
+		if worker.DiedAt.IsZero() {
+			alive++
+		} else {
+			dead++
+		}
+	}
+	return alive, dead
+}
+
+// SlotCounts returns the number of slots of live workers by state, as of their last heartbeat.
+// Slots of workers that have not sent one yet are idle.
+func (registry *WorkerRegistry) SlotCounts() map[string]int {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	counts := map[string]int{api.SLOT_IDLE: 0, api.SLOT_COMPUTING: 0, api.SLOT_COMMITTING: 0}
+	for _, worker := range registry.workers {
+		if !worker.DiedAt.IsZero() {
+			continue
+		}
+		for _, slot := range worker.SlotStats {
+			counts[slot.State]++
+		}
+		counts[api.SLOT_IDLE] += max(0, worker.Slots-len(worker.SlotStats))
+	}
+	return counts
+}
+
+// requeue_orphaned hands the tasks of a worker that is gone back to the head of pending_tasks.
+// Tasks that moved on since, because they were cancelled or the worker committed them in the
+// meantime, are left alone.
+func requeue_orphaned(orphaned orphaned_tasks) {
+	requeued := 0
+	for i := len(orphaned.ids) - 1; i >= 0; i-- {
+		shard := all_tasks.Shard(orphaned.ids[i])
+		shard.Lock()
+		task, ok := shard.tasks[orphaned.ids[i]]
+		if ok && task.Status == api.STATUS_PROCESSING && task.WorkerID == orphaned.worker {
+			invariant.Always(task.FinishedAt.IsZero(), "Processing task has not finished")
+			task.Status = api.STATUS_PENDING
+			task.StartedAt = time.Time{}
+			task.WorkerID = ""
+			pending_tasks.EnqueueFront(task.Type, task.ID)
+			task_events.Publish(task)
+			requeued++
+		}
+		shard.Unlock()
+	}
+	if requeued > 0 {
+		tasks_requeued_total.Add(float64(requeued), orphaned.reason)
+		lgr.Warn().Str("worker", orphaned.worker).Str("reason", orphaned.reason).Int("requeued", requeued).Msg("handed tasks back")
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"api"
+	"io"
+	"maps"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/james-orcales/golang_snacks/itlog"
+)
+
+func with_workers(t *testing.T) {
+	lgr = itlog.New(io.Discard, itlog.LevelInfo)
+	all_tasks = NewTaskTable(DEFAULT_TASK_SHARDS)
+	pending_tasks = NewPendingQueues()
+	workers = NewWorkerRegistry(time.Second, 3, time.Minute)
+	t.Cleanup(func() {
+		all_tasks = NewTaskTable(DEFAULT_TASK_SHARDS)
+		pending_tasks = NewPendingQueues()
+		workers = NewWorkerRegistry(time.Second*5, 3, time.Minute*10)
+	})
+}
+
+func take(t *testing.T, worker_id string) int64 {
+	t.Helper()
+	id, ok := pending_tasks.TryDequeue(default_types)
+	if !ok {
+		t.Fatal("No pending task")
+	}
+	if _, ok := claim_pending(id, worker_id); !ok {
+		t.Fatalf("Task %d could not be claimed", id)
+	}
+	return id
+}
+
+func TestDeadWorkerTasksAreRequeued(t *testing.T) {
+	with_workers(t)
+	now := time.Now()
+	workers.Register("a", "", default_types, nil, 1, now)
+	workers.Register("b", "", default_types, nil, 1, now)
+	first, _, _, _ := submit_task(&api.SubmitRequest{Data: "x"}, "", nil)
+	second, _, _, _ := submit_task(&api.SubmitRequest{Data: "y"}, "", nil)
+	take(t, "a")
+	take(t, "a")
+
+	// b keeps sending heartbeats, a goes quiet.
+	workers.Heartbeat("b", &api.HeartbeatRequest{}, now.Add(time.Second*2))
+	if orphaned := workers.Reap(now.Add(time.Second * 3)); len(orphaned) != 0 {
+		t.Fatalf("Got: %v before the timeout\nWant: nothing", orphaned)
+	}
+	for _, orphaned := range workers.Reap(now.Add(time.Second * 4)) {
+		requeue_orphaned(orphaned)
+	}
+	if workers.Alive("a") || !workers.Alive("b") {
+		t.Fatalf("Got: a alive=%v, b alive=%v\nWant: false, true", workers.Alive("a"), workers.Alive("b"))
+	}
+	for _, want := range []int64{first, second} {
+		snapshot, _, _, _ := snapshot_task(want)
+		if snapshot.Status != api.STATUS_PENDING {
+			t.Fatalf("Got: task %d %s\nWant: %s", want, snapshot.Status, api.STATUS_PENDING)
+		}
+		// Requeued at the head, in submission order.
+		if got := take(t, "b"); got != want {
+			t.Fatalf("Got: task %d\nWant: %d", got, want)
+		}
+	}
+
+	// a wakes up and tries to commit a task b now holds.
+	error_code, code := complete_task(&api.ProcessedRequest{ID: first, Input: "x", Output: []string{"x"}}, "a")
+	if error_code != api.TASK_REASSIGNED || code != http.StatusConflict {
+		t.Fatalf("Got: %q %d\nWant: %q 409", error_code, code, api.TASK_REASSIGNED)
+	}
+	if error_code, _ := complete_task(&api.ProcessedRequest{ID: first, Input: "x", Output: []string{"x"}}, "b"); error_code != "" {
+		t.Fatal(error_code)
+	}
+	// Committing twice is a stale commit too.
+	if error_code, _ := complete_task(&api.ProcessedRequest{ID: first, Input: "x", Output: []string{"x"}}, "b"); error_code != api.TASK_REASSIGNED {
+		t.Fatalf("Got: %q\nWant: %q", error_code, api.TASK_REASSIGNED)
+	}
+
+	// A heartbeat brings a back, and dead workers are eventually forgotten.
+	if !workers.Heartbeat("a", &api.HeartbeatRequest{}, now.Add(time.Second*5)) || !workers.Alive("a") {
+		t.Fatal("Heartbeat did not revive a")
+	}
+	workers.Reap(now.Add(time.Second * 9))
+	workers.Reap(now.Add(time.Minute * 2))
+	if listing := workers.List(); len(listing.Workers) != 0 {
+		t.Fatalf("Got: %v\nWant: no workers", listing.Workers)
+	}
+}
+
+func TestDeadWorkerCannotClaimOrReleaseTasks(t *testing.T) {
+	with_workers(t)
+	now := time.Now()
+	workers.Register("a", "", default_types, nil, 1, now)
+	workers.Register("b", "", default_types, nil, 1, now)
+	first, _, _, _ := submit_task(&api.SubmitRequest{Data: "x"}, "", nil)
+	second, _, _, _ := submit_task(&api.SubmitRequest{Data: "y"}, "", nil)
+	take(t, "a")
+
+	// a is declared dead while the response handing it the first task is still being written.
+	workers.Heartbeat("b", &api.HeartbeatRequest{}, now.Add(time.Second*3))
+	for _, orphaned := range workers.Reap(now.Add(time.Second * 4)) {
+		requeue_orphaned(orphaned)
+	}
+	if got := take(t, "b"); got != first {
+		t.Fatalf("Got: task %d\nWant: %d", got, first)
+	}
+	// The write fails, and the delivery is undone. The task is b's now.
+	release_delivery([]int64{first}, "a")
+	if task, _, _, _ := snapshot_task(first); task.Status != api.STATUS_PROCESSING || task.WorkerID != "b" {
+		t.Fatalf("Got: %s held by %q\nWant: PROCESSING held by b", task.Status, task.WorkerID)
+	}
+
+	// a is not handed anything else until it registers again.
+	id, _ := pending_tasks.TryDequeue(default_types)
+	if _, ok := claim_pending(id, "a"); ok {
+		t.Fatal("A dead worker claimed a task")
+	}
+	if task, _, _, _ := snapshot_task(second); task.Status != api.STATUS_PENDING {
+		t.Fatalf("Got: %s\nWant: %s", task.Status, api.STATUS_PENDING)
+	}
+	if got := take(t, "b"); got != second {
+		t.Fatalf("Got: task %d\nWant: %d, back at the head of the queue", got, second)
+	}
+}
+
+func TestRestartedAndDeregisteredWorkerTasksAreRequeued(t *testing.T) {
+	with_workers(t)
+	now := time.Now()
+	workers.Register("a", "", default_types, nil, 1, now)
+	first, _, _, _ := submit_task(&api.SubmitRequest{Data: "x"}, "", nil)
+	second, _, _, _ := submit_task(&api.SubmitRequest{Data: "y"}, "", nil)
+	take(t, "a")
+	take(t, "a")
+	// Tasks committed in the meantime are not handed back.
+	if error_code, _ := complete_task(&api.ProcessedRequest{ID: first, Input: "x", Output: []string{"x"}}, "a"); error_code != "" {
+		t.Fatal(error_code)
+	}
+
+	restarted, _ := workers.Register("a", "", default_types, nil, 1, now)
+	requeue_orphaned(restarted)
+	if got := take(t, "a"); got != second {
+		t.Fatalf("Got: task %d\nWant: %d", got, second)
+	}
+
+	orphaned, ok := workers.Deregister("a")
+	if !ok {
+		t.Fatal("a was not registered")
+	}
+	requeue_orphaned(orphaned)
+	if snapshot, _, _, _ := snapshot_task(second); snapshot.Status != api.STATUS_PENDING {
+		t.Fatalf("Got: %s\nWant: %s", snapshot.Status, api.STATUS_PENDING)
+	}
+	if _, ok := workers.Deregister("a"); ok {
+		t.Fatal("a was deregistered twice")
+	}
+}
+
+func TestReleasedTasksAreRequeued(t *testing.T) {
+	with_workers(t)
+	now := time.Now()
+	workers.Register("a", "", default_types, nil, 1, now)
+	workers.Register("b", "", default_types, nil, 1, now)
+	first, _, _, _ := submit_task(&api.SubmitRequest{Data: "x"}, "", nil)
+	second, _, _, _ := submit_task(&api.SubmitRequest{Data: "y"}, "", nil)
+	third, _, _, _ := submit_task(&api.SubmitRequest{Data: "z"}, "", nil)
+	take(t, "a")
+	take(t, "a")
+	take(t, "b")
+
+	// Tasks a does not hold, including b's, are left alone.
+	orphaned, ok := workers.Release("a", []int64{second, third, next_id.Load() + 1000})
+	if !ok {
+		t.Fatal("a was not registered")
+	}
+	requeue_orphaned(orphaned)
+	for id, want := range map[int64]string{first: api.STATUS_PROCESSING, second: api.STATUS_PENDING, third: api.STATUS_PROCESSING} {
+		if snapshot, _, _, _ := snapshot_task(id); snapshot.Status != want {
+			t.Fatalf("Got: task %d %s\nWant: %s", id, snapshot.Status, want)
+		}
+	}
+	if got := take(t, "b"); got != second {
+		t.Fatalf("Got: task %d\nWant: %d", got, second)
+	}
+	if error_code, _ := complete_task(&api.ProcessedRequest{ID: second, Input: "y", Output: []string{"y"}}, "a"); error_code != api.TASK_REASSIGNED {
+		t.Fatalf("Got: %q\nWant: %q", error_code, api.TASK_REASSIGNED)
+	}
+	if _, ok := workers.Release("nope", []int64{first}); ok {
+		t.Fatal("An unknown worker released a task")
+	}
+}
+
+func TestSubmitOnlyAcceptsRegisteredTypes(t *testing.T) {
+	with_workers(t)
+	now := time.Now()
+	workers.Register("a", "", []string{"hash"}, nil, 1, now)
+	workers.Register("b", "", default_types, nil, 1, now)
+
+	if _, _, error_code, _ := submit_task(&api.SubmitRequest{Data: "x", Type: "resize"}, "", nil); error_code != api.UNKNOWN_TASK_TYPE {
+		t.Fatalf("Got: %q\nWant: %q", error_code, api.UNKNOWN_TASK_TYPE)
+	}
+	substrings, _, _, _ := submit_task(&api.SubmitRequest{Data: "x"}, "", nil)
+	hash, _, error_code, _ := submit_task(&api.SubmitRequest{Data: "y", Type: "hash"}, "", nil)
+	if error_code != "" {
+		t.Fatal(error_code)
+	}
+
+	for worker, want := range map[string]int64{"a": hash, "b": substrings} {
+		types, _ := workers.Types(worker)
+		id, ok := pending_tasks.TryDequeue(types)
+		if !ok || id != want {
+			t.Fatalf("Worker %s\nGot: %d, %t\nWant: %d, true", worker, id, ok, want)
+		}
+		if claimed, _ := claim_pending(id, worker); claimed.Type != types[0] {
+			t.Fatalf("Got: %q\nWant: %q", claimed.Type, types[0])
+		}
+	}
+
+	// Types stay accepted while their only worker is dead, and are forgotten with it.
+	workers.Heartbeat("b", &api.HeartbeatRequest{}, now.Add(time.Second*4))
+	workers.Reap(now.Add(time.Second * 4))
+	if !workers.Supports("hash") {
+		t.Fatal("hash was rejected while its worker was only recently dead")
+	}
+	workers.Reap(now.Add(time.Minute * 2))
+	if workers.Supports("hash") || !workers.Supports(api.DEFAULT_TASK_TYPE) {
+		t.Fatal("Got: hash still accepted, or the default type rejected")
+	}
+}
+
+func TestCapacityCountsSlotsOfLiveWorkers(t *testing.T) {
+	with_workers(t)
+	now := time.Now()
+	workers.Register("a", "", default_types, nil, 4, now)
+	workers.Register("b", "", default_types, nil, 2, now)
+	workers.Heartbeat("a", &api.HeartbeatRequest{Slots: []api.SlotStats{
+		{Slot: 0, State: api.SLOT_COMPUTING},
+		{Slot: 1, State: api.SLOT_COMMITTING},
+		{Slot: 2, State: api.SLOT_IDLE},
+		{Slot: 3, State: api.SLOT_COMPUTING},
+	}}, now.Add(time.Second*2))
+
+	if listing := workers.List(); listing.Capacity != 6 || listing.Workers[0].SlotStats[3].State != api.SLOT_COMPUTING {
+		t.Fatalf("Got: capacity %d, %+v\nWant: capacity 6", listing.Capacity, listing.Workers)
+	}
+	// b has not sent a heartbeat, so its slots are idle.
+	want := map[string]int{api.SLOT_IDLE: 3, api.SLOT_COMPUTING: 2, api.SLOT_COMMITTING: 1}
+	if got := workers.SlotCounts(); !maps.Equal(got, want) {
+		t.Fatalf("Got: %v\nWant: %v", got, want)
+	}
+
+	workers.Reap(now.Add(time.Second * 4))
+	if listing := workers.List(); listing.Capacity != 4 || listing.Alive != 1 {
+		t.Fatalf("Got: capacity %d of %d workers\nWant: capacity 4 of 1 worker", listing.Capacity, listing.Alive)
+	}
+	if got := workers.SlotCounts(); got[api.SLOT_IDLE] != 1 {
+		t.Fatalf("Got: %v\nWant: only a's idle slot", got)
+	}
+}
@@ -0,0 +1,7 @@
+module autoscaler
+
+go 1.25.3
+
+require api v0.0.0
+
+replace api => ./api
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/james-orcales/golang_snacks/itlog"
+)
+
+// Backoff after failed fetches.
+const (
+	FETCH_BACKOFF     = time.Millisecond * 100
+	MAX_FETCH_BACKOFF = time.Second * 10
+)
+
+// The circuit breaker opens after BREAKER_THRESHOLD fetches in a row failed with the backend
+// unavailable, and lets a single fetch through every BREAKER_COOLDOWN until one succeeds.
+const (
+	BREAKER_THRESHOLD = 5
+	BREAKER_COOLDOWN  = time.Second * 5
+)
+
+// Counters logged along with the failures they count.
+var (
+	// client_retries_total counts calls the client repeated by itself, see api.Client.OnRetry.
+	client_retries_total atomic.Int64
+	// fetch_backoffs_total counts failed fetches a slot backed off after.
+	fetch_backoffs_total atomic.Int64
+	// breaker_trips_total counts the times the circuit breaker opened.
+	breaker_trips_total atomic.Int64
+)
+
+// Backoff is the delay after consecutive failures of a slot. It doubles from base up to max, with
+// jitter so that slots and workers that failed together do not retry together.
+type Backoff struct {
+	base     time.Duration
+	max      time.Duration
+	failures int
+}
+
+func NewBackoff(base, max time.Duration) *Backoff {
+	return &Backoff{base: base, max: max}
+}
+
+// Next counts a failure and returns how long to wait before trying again.
+func (backoff *Backoff) Next() time.Duration {
+	delay := min(backoff.max, backoff.base<<min(backoff.failures, 16))
+	backoff.failures++
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// Failures is the number of failures since the last Reset.
+func (backoff *Backoff) Failures() int {
+	return backoff.failures
+}
+
+func (backoff *Backoff) Reset() {
+	backoff.failures = 0
+}
+
+// CircuitBreaker stops every slot from calling a backend that keeps failing. Once threshold calls
+// in a row failed, it opens: Wait blocks for cooldown, then lets one call through to probe the
+// backend while the others keep waiting. The first success closes it again.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	lgr       *itlog.Logger
+	mu        sync.Mutex
+	failures  int
+	// open_until is zero while the breaker is closed.
+	open_until time.Time
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration, lgr *itlog.Logger) *CircuitBreaker {
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown, lgr: lgr}
+}
+
+// Wait blocks until the breaker lets a call through, or ctx is done.
+func (breaker *CircuitBreaker) Wait(ctx context.Context) error {
+	for {
+		breaker.mu.Lock()
+		now := time.Now()
+		if breaker.open_until.IsZero() {
+			breaker.mu.Unlock()
+			return nil
+		}
+		if !now.Before(breaker.open_until) {
+			// This call probes the backend. The others wait for its outcome, or another cooldown
+			// if it never reports one.
+			breaker.open_until = now.Add(breaker.cooldown)
+			breaker.mu.Unlock()
+			return nil
+		}
+		wait := breaker.open_until.Sub(now)
+		breaker.mu.Unlock()
+		if !sleep(ctx, wait) {
+			return ctx.Err()
+		}
+	}
+}
+
+// Success closes the breaker.
+func (breaker *CircuitBreaker) Success() {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	if !breaker.open_until.IsZero() {
+		breaker.lgr.Warn().Msg("backend is back. closing the circuit breaker")
+	}
+	breaker.failures = 0
+	breaker.open_until = time.Time{}
+}
+
+// Failure counts a call that failed because the backend is unavailable, opening the breaker once
+// there were threshold of them in a row. Failures while it is open push the next probe back.
+func (breaker *CircuitBreaker) Failure() {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	breaker.failures++
+	if breaker.failures < breaker.threshold {
+		return
+	}
+	if breaker.open_until.IsZero() {
+		breaker_trips_total.Add(1)
+		breaker.lgr.Warn().Int("failures", breaker.failures).Int64("cooldown_ms", breaker.cooldown.Milliseconds()).Int64("trips_total", breaker_trips_total.Load()).Msg("backend keeps failing. opening the circuit breaker")
+	}
+	breaker.open_until = time.Now().Add(breaker.cooldown)
+}
+
+// Open reports whether the breaker is holding calls back.
+func (breaker *CircuitBreaker) Open() bool {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	return !breaker.open_until.IsZero()
+}
+
+// sleep waits for d, returning false if ctx ended first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"api"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/james-orcales/golang_snacks/itlog"
+)
+
+func TestBackoffDoublesUpToMax(t *testing.T) {
+	backoff := NewBackoff(time.Millisecond*100, time.Millisecond*400)
+	for _, want := range []time.Duration{100, 200, 400, 400} {
+		want *= time.Millisecond
+		if delay := backoff.Next(); delay < want/2 || delay > want {
+			t.Fatalf("Got: %s after %d failures\nWant: between %s and %s", delay, backoff.Failures(), want/2, want)
+		}
+	}
+	backoff.Reset()
+	if delay := backoff.Next(); delay > time.Millisecond*100 {
+		t.Fatalf("Got: %s after a reset\nWant: at most 100ms", delay)
+	}
+}
+
+func TestCircuitBreakerProbesOnceOpen(t *testing.T) {
+	breaker := NewCircuitBreaker(2, time.Millisecond*50, itlog.New(io.Discard, itlog.LevelInfo))
+	ctx := context.Background()
+
+	breaker.Failure()
+	if breaker.Open() {
+		t.Fatal("Breaker opened before the threshold")
+	}
+	breaker.Failure()
+	if !breaker.Open() {
+		t.Fatal("Breaker did not open at the threshold")
+	}
+
+	start := time.Now()
+	if err := breaker.Wait(ctx); err != nil || time.Since(start) < time.Millisecond*50 {
+		t.Fatalf("Got: %v after %s\nWant: the probe let through after the cooldown", err, time.Since(start))
+	}
+	// The probe is in flight, so nobody else is let through.
+	short, cancel := context.WithTimeout(ctx, time.Millisecond*20)
+	defer cancel()
+	if err := breaker.Wait(short); err == nil {
+		t.Fatal("A second call was let through while probing")
+	}
+
+	breaker.Success()
+	start = time.Now()
+	if err := breaker.Wait(ctx); err != nil || time.Since(start) > time.Millisecond*10 || breaker.Open() {
+		t.Fatalf("Got: %v after %s\nWant: a closed breaker", err, time.Since(start))
+	}
+}
+
+// A backend that is down is not called in a hot loop.
+func TestFetchBacksOffWhileTheBackendFails(t *testing.T) {
+	requests := atomic.Int64{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	client := api.NewClient(server.URL, "")
+	session := NewSession(client, 1, itlog.New(io.Discard, itlog.LevelInfo))
+	slot := session.Slots()[0]
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+	for ctx.Err() == nil {
+		process_one(ctx, ctx, client, session, slot, itlog.New(io.Discard, itlog.LevelInfo))
+	}
+	// Backing off 100ms, 200ms and 400ms at most, and at least half that.
+	if n := requests.Load(); n < 2 || n > 5 {
+		t.Fatalf("Got: %d requests in 500ms\nWant: 2 to 5", n)
+	}
+	if slot.backoff.Failures() < 2 {
+		t.Fatalf("Got: %d failures\nWant: at least 2", slot.backoff.Failures())
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"api"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/james-orcales/golang_snacks/itlog"
+)
+
+// ExternalHandler runs the tasks of one type in a separate executable, so that handlers can be
+// written in any language and deployed without rebuilding the worker. They are configured in the
+// file at HANDLERS_FILE, one per line:
+//
+//	# type     mode        timeout  command
+//	resize     persistent  30s      /opt/handlers/resize --quality 80
+//	wordcount  oneshot     5s       python3 /opt/handlers/wordcount.py
+//
+// Blank lines and lines starting with # are ignored. The command is split on whitespace and run
+// without a shell. A timeout of 0 disables it.
+//
+// The worker writes each task to the handler's stdin as one JSON line, a HandlerRequest, and the
+// handler replies on stdout with one JSON line, a HandlerResponse. Whatever the handler writes to
+// stderr is logged by the worker. In oneshot mode, a process is started for every task and its
+// stdin is closed after the request. In persistent mode, a process serves task after task, and is
+// restarted if it exits, times out or replies out of turn. Up to one persistent process runs per
+// slot, so that slots do not wait on each other.
+type ExternalHandler struct {
+	task_type  string
+	command    []string
+	timeout    time.Duration
+	persistent bool
+	lgr        *itlog.Logger
+
+	// idle holds the persistent processes not serving a task, one entry per slot. An entry is nil
+	// until its process is started. Taking an entry is what lets a task use a process.
+	idle chan *handler_process
+}
+
+// HandlerRequest is the line written to an external handler's stdin for each task.
+type HandlerRequest struct {
+	ID    int64  `json:"id"`
+	Type  string `json:"type"`
+	Input string `json:"input"`
+}
+
+// HandlerResponse is the line an external handler writes to stdout for each task. Error is set
+// instead of Output when the task failed. ID must be the ID of the request.
+type HandlerResponse struct {
+	ID     int64    `json:"id"`
+	Output []string `json:"output"`
+	Error  string   `json:"error"`
+}
+
+// Handler modes.
+const (
+	MODE_ONESHOT    = "oneshot"
+	MODE_PERSISTENT = "persistent"
+)
+
+// STDERR_WAIT_DELAY bounds how long a handler's stderr is read after the handler exits, in case it
+// left a child process holding the pipe open. It is also how long Close waits for a persistent
+// handler to exit by itself.
+const STDERR_WAIT_DELAY = time.Second
+
+// MAX_STDERR_LINE_LENGTH splits longer stderr lines into several log entries.
+const MAX_STDERR_LINE_LENGTH = 4096
+
+// NewExternalHandler creates a handler that runs up to n_slots tasks at once.
+func NewExternalHandler(task_type, mode string, timeout time.Duration, command []string, n_slots int, lgr *itlog.Logger) *ExternalHandler {
+	handler := &ExternalHandler{
+		task_type:  task_type,
+		command:    command,
+		timeout:    timeout,
+		persistent: mode == MODE_PERSISTENT,
+		lgr:        lgr.Clone().WithStr("type", task_type),
+		idle:       make(chan *handler_process, n_slots),
+	}
+	for range n_slots {
+		handler.idle <- nil
+	}
+	return handler
+}
+
+// LoadExternalHandlers reads the handler configuration file at path.
+func LoadExternalHandlers(path string, n_slots int, lgr *itlog.Logger) ([]*ExternalHandler, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	external, err := parse_external_handlers(contents, n_slots, lgr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return external, nil
+}
+
+func parse_external_handlers(contents []byte, n_slots int, lgr *itlog.Logger) ([]*ExternalHandler, error) {
+	external := []*ExternalHandler{}
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for line_number := 1; scanner.Scan(); line_number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("line %d: want \"<type> <mode> <timeout> <command> [arguments]\"", line_number)
+		}
+		task_type, mode, command := fields[0], fields[1], fields[3:]
+		if seen[task_type] {
+			return nil, fmt.Errorf("line %d: duplicate type %q", line_number, task_type)
+		}
+		seen[task_type] = true
+		if mode != MODE_ONESHOT && mode != MODE_PERSISTENT {
+			return nil, fmt.Errorf("line %d: unknown mode %q", line_number, mode)
+		}
+		timeout, err := time.ParseDuration(fields[2])
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("line %d: malformed timeout %q", line_number, fields[2])
+		}
+		external = append(external, NewExternalHandler(task_type, mode, timeout, command, n_slots, lgr))
+	}
+	return external, scanner.Err()
+}
+
+// Run is the Handler of the external handler's type.
+func (handler *ExternalHandler) Run(ctx context.Context, task api.PendingTask) ([]string, error) {
+	if handler.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, handler.timeout)
+		defer cancel()
+	}
+	request, err := json.Marshal(&HandlerRequest{ID: task.ID, Type: handler.task_type, Input: task.Input})
+	if err != nil {
+		return nil, err
+	}
+	request = append(request, '\n')
+
+	var line []byte
+	if handler.persistent {
+		line, err = handler.exchange(ctx, task.ID, request)
+	} else {
+		line, err = handler.run_once(ctx, request)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("handler %s: %w", handler.task_type, ctx.Err())
+		}
+		return nil, fmt.Errorf("handler %s: %w", handler.task_type, err)
+	}
+
+	response := HandlerResponse{}
+	if err := json.Unmarshal(line, &response); err != nil {
+		return nil, fmt.Errorf("handler %s replied with malformed JSON: %w", handler.task_type, err)
+	}
+	if response.ID != task.ID {
+		return nil, fmt.Errorf("handler %s replied for task %d instead of %d", handler.task_type, response.ID, task.ID)
+	}
+	if response.Error != "" {
+		return nil, errors.New(response.Error)
+	}
+	return response.Output, nil
+}
+
+// run_once starts a process for a single task and returns the first line it writes to stdout.
+func (handler *ExternalHandler) run_once(ctx context.Context, request []byte) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, handler.command[0], handler.command[1:]...)
+	cmd.Stdin = bytes.NewReader(request)
+	stdout := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	stderr := &stderr_logger{lgr: handler.lgr}
+	defer stderr.Flush()
+	cmd.Stderr = stderr
+	cmd.WaitDelay = STDERR_WAIT_DELAY
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+	line, _, _ := bytes.Cut(stdout.Bytes(), []byte("\n"))
+	if len(line) == 0 {
+		return nil, errors.New("handler exited without replying")
+	}
+	return line, nil
+}
+
+// handler_process is the running process of a persistent handler.
+type handler_process struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	// exited is closed once the process has exited and its stderr is drained.
+	exited chan struct{}
+}
+
+// exchange writes the request of task id to an idle persistent process, starting one if needed,
+// and returns the line it replies with. A process that times out is killed, since its reply would
+// arrive during the next task, and so is one that replies for another task.
+func (handler *ExternalHandler) exchange(ctx context.Context, id int64, request []byte) ([]byte, error) {
+	var process *handler_process
+	select {
+	case process = <-handler.idle:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { handler.idle <- process }()
+	if process != nil {
+		select {
+		case <-process.exited:
+			// It died between tasks. Start over rather than failing a task it never saw.
+			process = nil
+		default:
+		}
+	}
+	if process == nil {
+		var err error
+		if process, err = handler.start(); err != nil {
+			return nil, err
+		}
+	}
+
+	type reply struct {
+		line []byte
+		err  error
+	}
+	replied := make(chan reply, 1)
+	go func() {
+		if _, err := process.stdin.Write(request); err != nil {
+			replied <- reply{nil, err}
+			return
+		}
+		line, err := process.stdout.ReadBytes('\n')
+		replied <- reply{bytes.TrimSuffix(line, []byte("\n")), err}
+	}()
+	select {
+	case r := <-replied:
+		if r.err != nil {
+			process.stop()
+			process = nil
+			return nil, fmt.Errorf("persistent process: %w", r.err)
+		}
+		in_turn := HandlerResponse{}
+		if json.Unmarshal(r.line, &in_turn) == nil && in_turn.ID != id {
+			// Whatever the process is doing, it is out of step with the worker.
+			process.stop()
+			process = nil
+		}
+		return r.line, nil
+	case <-ctx.Done():
+		process.stop()
+		process = nil
+		return nil, ctx.Err()
+	}
+}
+
+func (handler *ExternalHandler) start() (*handler_process, error) {
+	cmd := exec.Command(handler.command[0], handler.command[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr := &stderr_logger{lgr: handler.lgr}
+	cmd.Stderr = stderr
+	cmd.WaitDelay = STDERR_WAIT_DELAY
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	process := &handler_process{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout), exited: make(chan struct{})}
+	go func() {
+		err := cmd.Wait()
+		stderr.Flush()
+		handler.lgr.Warn().Int("pid", cmd.Process.Pid).Err(err).Msg("persistent handler exited")
+		close(process.exited)
+	}()
+	handler.lgr.Info().Int("pid", cmd.Process.Pid).Msg("started persistent handler")
+	return process, nil
+}
+
+func (process *handler_process) stop() {
+	process.cmd.Process.Kill()
+	<-process.exited
+}
+
+// Close stops the persistent processes once they finish their tasks. Each is given a moment to
+// exit by itself once its stdin is closed.
+func (handler *ExternalHandler) Close() {
+	processes := make([]*handler_process, cap(handler.idle))
+	for i := range processes {
+		processes[i] = <-handler.idle
+	}
+	for _, process := range processes {
+		if process != nil {
+			process.stdin.Close()
+			select {
+			case <-process.exited:
+			case <-time.After(STDERR_WAIT_DELAY):
+				process.stop()
+			}
+		}
+		handler.idle <- nil
+	}
+}
+
+// stderr_logger is the stderr of a handler process. It logs each line the handler writes. os/exec
+// writes to it from a single goroutine.
+type stderr_logger struct {
+	lgr     *itlog.Logger
+	partial []byte
+}
+
+func (stderr *stderr_logger) Write(p []byte) (int, error) {
+	stderr.partial = append(stderr.partial, p...)
+	for {
+		line, rest, found := bytes.Cut(stderr.partial, []byte("\n"))
+		if !found && len(stderr.partial) < MAX_STDERR_LINE_LENGTH {
+			break
+		}
+		if !found {
+			line, rest = stderr.partial[:MAX_STDERR_LINE_LENGTH], stderr.partial[MAX_STDERR_LINE_LENGTH:]
+		}
+		stderr.lgr.Warn().Str("stderr", string(line)).Msg("handler")
+		stderr.partial = append(stderr.partial[:0], rest...)
+	}
+	return len(p), nil
+}
+
+// Flush logs the last line if the handler did not end it with a newline.
+func (stderr *stderr_logger) Flush() {
+	if len(stderr.partial) > 0 {
+		stderr.lgr.Warn().Str("stderr", string(stderr.partial)).Msg("handler")
+		stderr.partial = stderr.partial[:0]
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"api"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/james-orcales/golang_snacks/itlog"
+)
+
+// TestMain lets the test binary stand in for an external handler: with WORKER_TEST_HANDLER set, it
+// speaks the handler protocol instead of running the tests.
+func TestMain(m *testing.M) {
+	if mode := os.Getenv("WORKER_TEST_HANDLER"); mode != "" {
+		fake_handler(mode)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// fake_handler answers each request according to its input: "fail" replies with an error, "hang"
+// never replies, "exit" exits without replying, "skip" replies for another task, and anything else
+// is echoed back with the handler's process ID. Every request is also logged to stderr.
+func fake_handler(mode string) {
+	scanner := bufio.NewScanner(os.Stdin)
+	encoder := json.NewEncoder(os.Stdout)
+	for scanner.Scan() {
+		request := HandlerRequest{}
+		json.Unmarshal(scanner.Bytes(), &request)
+		fmt.Fprintf(os.Stderr, "got %s\n", request.Input)
+		switch request.Input {
+		case "fail":
+			encoder.Encode(&HandlerResponse{ID: request.ID, Error: "cannot " + request.Type})
+		case "hang":
+			time.Sleep(time.Hour)
+		case "exit":
+			os.Exit(3)
+		case "skip":
+			encoder.Encode(&HandlerResponse{ID: request.ID + 1})
+		default:
+			encoder.Encode(&HandlerResponse{ID: request.ID, Output: []string{request.Input, fmt.Sprint(os.Getpid())}})
+		}
+		if mode == MODE_ONESHOT {
+			return
+		}
+	}
+}
+
+// new_test_handler runs the test binary as the handler. The -test flag keeps its package variables
+// from requiring the worker's environment.
+func new_test_handler(t *testing.T, mode string, n_slots int, logs io.Writer) *ExternalHandler {
+	t.Setenv("WORKER_TEST_HANDLER", mode)
+	handler := NewExternalHandler("resize", mode, time.Second*2, []string{os.Args[0], "-test.run=^$"}, n_slots, itlog.New(logs, itlog.LevelInfo))
+	t.Cleanup(handler.Close)
+	return handler
+}
+
+func TestExternalHandler(t *testing.T) {
+	for _, mode := range []string{MODE_ONESHOT, MODE_PERSISTENT} {
+		t.Run(mode, func(t *testing.T) {
+			logs := &bytes.Buffer{}
+			handler := new_test_handler(t, mode, 1, logs)
+			ctx := context.Background()
+
+			pids := map[string]bool{}
+			for id := range int64(3) {
+				output, err := handler.Run(ctx, api.PendingTask{ID: id, Input: "ab"})
+				if err != nil || len(output) != 2 || output[0] != "ab" {
+					t.Fatalf("Got: %v, %v\nWant: [ab <pid>], <nil>", output, err)
+				}
+				pids[output[1]] = true
+			}
+			if want := map[string]int{MODE_ONESHOT: 3, MODE_PERSISTENT: 1}[mode]; len(pids) != want {
+				t.Fatalf("Got: %d processes for 3 tasks\nWant: %d", len(pids), want)
+			}
+
+			if _, err := handler.Run(ctx, api.PendingTask{ID: 3, Input: "fail"}); err == nil || err.Error() != "cannot resize" {
+				t.Fatalf("Got: %v\nWant: cannot resize", err)
+			}
+			start := time.Now()
+			_, err := handler.Run(ctx, api.PendingTask{ID: 4, Input: "hang"})
+			if !errors.Is(err, context.DeadlineExceeded) || failure_reason(err) != api.FAILURE_DEADLINE_EXCEEDED {
+				t.Fatalf("Got: %v\nWant: %v", err, context.DeadlineExceeded)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second*4 {
+				t.Fatalf("Timed out handler took %s to give up on", elapsed)
+			}
+			for id, input := range map[int64]string{5: "exit", 6: "skip"} {
+				if _, err := handler.Run(ctx, api.PendingTask{ID: id, Input: input}); err == nil || failure_reason(err) != api.FAILURE_HANDLER_ERROR {
+					t.Fatalf("%s\nGot: %v\nWant: a handler error", input, err)
+				}
+			}
+
+			// The persistent process is replaced after each of the failures above.
+			output, err := handler.Run(ctx, api.PendingTask{ID: 7, Input: "ab"})
+			if err != nil || pids[output[1]] {
+				t.Fatalf("Got: %v, %v\nWant: a reply from a new process", output, err)
+			}
+
+			handler.Close()
+			if !strings.Contains(logs.String(), `stderr="got ab"`) {
+				t.Fatalf("Handler stderr was not logged:\n%s", logs)
+			}
+		})
+	}
+}
+
+func TestPersistentHandlerRunsAProcessPerSlot(t *testing.T) {
+	// The slots log side by side, which a bytes.Buffer is not safe for.
+	handler := new_test_handler(t, MODE_PERSISTENT, 2, io.Discard)
+	hanging := make(chan error, 1)
+	go func() {
+		_, err := handler.Run(context.Background(), api.PendingTask{ID: 0, Input: "hang"})
+		hanging <- err
+	}()
+	// Wait for the hanging task to take its process.
+	for len(handler.idle) == 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	if output, err := handler.Run(context.Background(), api.PendingTask{ID: 1, Input: "ab"}); err != nil || output[0] != "ab" {
+		t.Fatalf("Got: %v, %v\nWant: [ab <pid>], <nil>", output, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("The second slot waited %s for the first", elapsed)
+	}
+
+	// Both processes are busy now. A task waiting for one gives up once its context is done.
+	go handler.Run(context.Background(), api.PendingTask{ID: 2, Input: "hang"})
+	for len(handler.idle) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	start = time.Now()
+	if _, err := handler.Run(ctx, api.PendingTask{ID: 3, Input: "ab"}); !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > time.Second {
+		t.Fatalf("Got: %v after %s\nWant: %v after 50ms", err, time.Since(start), context.DeadlineExceeded)
+	}
+	<-hanging
+}
+
+func TestParseExternalHandlers(t *testing.T) {
+	lgr := itlog.New(&bytes.Buffer{}, itlog.LevelInfo)
+	external, err := parse_external_handlers([]byte(`
+# type  mode        timeout  command
+resize  persistent  30s      /opt/resize --quality 80
+
+wc      oneshot     0s       wc
+`), 1, lgr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(external) != 2 || !external[0].persistent || external[0].timeout != time.Second*30 ||
+		!slices.Equal(external[0].command, []string{"/opt/resize", "--quality", "80"}) || external[1].persistent {
+		t.Fatalf("Got: %+v", external)
+	}
+
+	for _, contents := range []string{
+		"resize persistent 30s",
+		"resize forking 30s /opt/resize",
+		"resize oneshot soon /opt/resize",
+		"resize oneshot 1s a\nresize oneshot 1s b",
+	} {
+		if _, err := parse_external_handlers([]byte(contents), 1, lgr); err == nil {
+			t.Errorf("%q was accepted", contents)
+		}
+	}
+}
@@ -2,4 +2,9 @@ module worker
 
 go 1.25.3
 
-require github.com/james-orcales/golang_snacks v0.0.0-20251123085833-2bebe88de6d7
+require (
+	api v0.0.0
+	github.com/james-orcales/golang_snacks v0.0.0-20251123085833-2bebe88de6d7
+)
+
+replace api => ../api
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"api"
+	"context"
+	"errors"
+	"maps"
+	"slices"
+)
+
+// Handler computes the output of a task. An error fails the task, and is reported to the backend
+// along with its reason, see failure_reason.
+type Handler func(ctx context.Context, task api.PendingTask) ([]string, error)
+
+// handlers maps each task type the worker runs to its Handler. The worker registers with the
+// backend under these types, and is only handed tasks of them.
+var handlers = map[string]Handler{}
+
+// RegisterHandler makes the worker run tasks of task_type with handler. Call it from an init
+// function. Registering a type twice panics.
+func RegisterHandler(task_type string, handler Handler) {
+	if _, exists := handlers[task_type]; exists {
+		panic("handler registered twice for task type " + task_type)
+	}
+	handlers[task_type] = handler
+}
+
+// HandlerTypes returns the task types with a registered Handler, sorted.
+func HandlerTypes() []string {
+	return slices.Sorted(maps.Keys(handlers))
+}
+
+// handler_for returns the Handler of task_type. Backends that predate task types send none, and
+// only have api.DEFAULT_TASK_TYPE.
+func handler_for(task_type string) (Handler, bool) {
+	if task_type == "" {
+		task_type = api.DEFAULT_TASK_TYPE
+	}
+	handler, ok := handlers[task_type]
+	return handler, ok
+}
+
+// failure_reason returns the api.FAILURE_* reason reported for a Handler error.
+func failure_reason(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return api.FAILURE_DEADLINE_EXCEEDED
+	}
+	return api.FAILURE_HANDLER_ERROR
+}
+
+func init() {
+	RegisterHandler(api.DEFAULT_TASK_TYPE, func(ctx context.Context, task api.PendingTask) ([]string, error) {
+		return AllSubstrings(ctx, task.Input)
+	})
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"api"
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestHandlerRegistry(t *testing.T) {
+	if got := HandlerTypes(); !slices.Contains(got, api.DEFAULT_TASK_TYPE) {
+		t.Fatalf("Got: %v\nWant: %s among them", got, api.DEFAULT_TASK_TYPE)
+	}
+	// Tasks from a backend that predates task types carry no type.
+	handler, ok := handler_for("")
+	if !ok {
+		t.Fatal("Tasks without a type have no handler")
+	}
+	if output, err := handler(context.Background(), api.PendingTask{Input: "ab"}); err != nil || !slices.Equal(output, []string{"a", "ab", "b"}) {
+		t.Fatal("Tasks without a type do not run the default handler")
+	}
+	if _, ok := handler_for("resize"); ok {
+		t.Fatal("Got a handler for an unregistered type")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Registering a type twice did not panic")
+		}
+	}()
+	RegisterHandler(api.DEFAULT_TASK_TYPE, handler)
+}
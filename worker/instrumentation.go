@@ -0,0 +1,77 @@
+package main
+
+import (
+	"api"
+	"strconv"
+	"time"
+)
+
+// COMMIT_ERROR is the worker_task_failures_total reason of outputs that could not be committed.
+const COMMIT_ERROR = "commit_error"
+
+var (
+	metrics = &api.Registry{}
+
+	tasks_processed_total = api.NewCounterVec(metrics,
+		"worker_tasks_processed_total", "Tasks computed and committed successfully.",
+	)
+	tasks_discarded_total = api.NewCounterVec(metrics,
+		"worker_tasks_discarded_total", "Outputs the backend refused because the task was cancelled or reassigned.",
+	)
+	task_failures_total = api.NewCounterVec(metrics,
+		"worker_task_failures_total", "Failed tasks by reason: the failure reported for a handler error, or commit_error for outputs that could not be committed.",
+		"reason",
+	)
+	compute_seconds = api.NewHistogramVec(metrics,
+		"worker_compute_seconds", "Time handlers took to compute a task, by task type. Tasks cut short by shutdown are left out.",
+		api.ExponentialBuckets(0.005, 2, 18),
+		"type",
+	)
+	output_bytes_total = api.NewCounterVec(metrics,
+		"worker_output_bytes_total", "Bytes of output produced by handlers, by task type.",
+		"type",
+	)
+)
+
+// session_metrics renders the state of session's slots at scrape time.
+func session_metrics(session *Session) *api.Registry {
+	registry := &api.Registry{}
+	now := time.Now()
+	stats := make([]api.SlotStats, len(session.Slots()))
+	for i, slot := range session.Slots() {
+		stats[i] = slot.Stats(now)
+	}
+	api.NewGaugeFunc(registry,
+		"worker_slots", "Slots by state.",
+		[]string{"state"},
+		func() map[string]float64 {
+			counts := map[string]float64{api.SLOT_IDLE: 0, api.SLOT_COMPUTING: 0, api.SLOT_COMMITTING: 0}
+			for _, slot := range stats {
+				counts[slot.State]++
+			}
+			return counts
+		},
+	)
+	api.NewGaugeFunc(registry,
+		"worker_slot_busy_seconds", "Time each slot spent computing or committing since the worker started.",
+		[]string{"slot"},
+		func() map[string]float64 {
+			busy := map[string]float64{}
+			for _, slot := range stats {
+				busy[strconv.Itoa(slot.Slot)] = float64(slot.BusyMillisecond) / 1000
+			}
+			return busy
+		},
+	)
+	api.NewGaugeFunc(registry,
+		"worker_ready", "1 if the worker is taking tasks, see /readyz.",
+		nil,
+		func() map[string]float64 {
+			if ready, _ := session.Ready(); ready {
+				return map[string]float64{"": 1}
+			}
+			return map[string]float64{"": 0}
+		},
+	)
+	return registry
+}
@@ -1,15 +1,18 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"api"
+	"cmp"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"math/rand/v2"
 	"net/http"
 	"os"
-	"runtime"
+	"os/signal"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/james-orcales/golang_snacks/invariant"
@@ -31,113 +34,420 @@ func get_env_int64(key string) int64 {
 	return int64(i)
 }
 
+// get_env_int64_or is get_env_int64 for optional settings.
+func get_env_int64_or(key string, fallback int64) int64 {
+	if os.Getenv(key) == "" {
+		return fallback
+	}
+	return get_env_int64(key)
+}
+
 var (
 	MAX_COMPUTE_DELAY_MILLISECOND = get_env_int64("MAX_COMPUTE_DELAY_MILLISECOND")
 	MIN_COMPUTE_DELAY_MILLISECOND = get_env_int64("MIN_COMPUTE_DELAY_MILLISECOND")
+	// Number of tasks fetched and committed per round trip. 1 uses the single-task endpoints.
+	BATCH_SIZE = get_env_int64_or("BATCH_SIZE", 1)
+	// Number of slots, which are loops fetching, computing and committing tasks side by side. The
+	// worker registers it as its capacity.
+	CONCURRENCY = get_env_int64_or("CONCURRENCY", 1)
+	// How long the worker keeps processing the tasks in hand after SIGTERM. Tasks still unfinished
+	// after that are handed back. Keep it under compose's stop_grace_period.
+	SHUTDOWN_GRACE_SECOND = get_env_int64_or("SHUTDOWN_GRACE_SECOND", 20)
+	// Bounds each request to the backend. Long polls get LONG_POLL_WAIT on top of it.
+	REQUEST_TIMEOUT_SECOND = get_env_int64_or("REQUEST_TIMEOUT_SECOND", 10)
+	// How long a task may be computed before it fails with api.FAILURE_DEADLINE_EXCEEDED, unless its
+	// submitter asked for less. 0 leaves it to the submitter.
+	TASK_TIMEOUT_SECOND = get_env_int64_or("TASK_TIMEOUT_SECOND", 60)
 )
 
+// API_KEY authenticates the worker to the backend. It must have the worker role.
+var API_KEY = os.Getenv("API_KEY")
+
+// HTTP_ADDR is where the worker serves /healthz, /readyz and /metrics.
+var HTTP_ADDR = cmp.Or(os.Getenv("HTTP_ADDR"), ":9090")
+
+// HANDLERS_FILE configures external handlers, see ExternalHandler. Unset runs only the built-in
+// handlers.
+var HANDLERS_FILE = os.Getenv("HANDLERS_FILE")
+
+// LONG_POLL_WAIT is how long GET /pending waits for a task before the backend replies 204 and the
+// worker asks again. Re-polling periodically lets the worker notice a backend that went away.
+const LONG_POLL_WAIT = time.Second * 30
+
 func main() {
-	runtime.GOMAXPROCS(1)
+	if CONCURRENCY <= 0 {
+		panic("CONCURRENCY must be positive")
+	}
 
 	lgr := itlog.New(os.Stdout, itlog.LevelInfo)
 	lgr.Level = itlog.LevelWarn
 
-	var last_id int64 = -1
-	for {
-		type Task struct {
-			ID     int64    `json:"id"`
-			Input  string   `json:"input"`
-			Output []string `json:"output"`
-		}
-		task := Task{}
+	client := api.NewClient("http://backend:8080", API_KEY)
+	client.WorkerID = new_worker_id()
+	// Every slot holds a connection for its long poll, and the heartbeats need one more.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = int(CONCURRENCY) + 1
+	client.HTTP = &http.Client{Transport: transport}
+	client.Timeout = time.Second * time.Duration(REQUEST_TIMEOUT_SECOND)
+	lgr = lgr.Clone().WithStr("worker", client.WorkerID)
+	client.OnRetry = func(method, path string, attempt int, delay time.Duration, err error) {
+		client_retries_total.Add(1)
+		lgr.Warn().Err(err).Str("request", method+" "+path).Int("attempt", attempt).Int64("backoff_ms", delay.Milliseconds()).Int64("retries_total", client_retries_total.Load()).Msg("retrying")
+	}
 
-		// === Fetch task ===
-		{
-			type Payload struct {
-				ID    int64  `json:"id"`
-				Input string `json:"input"`
-			}
-			payload := &Payload{}
-			// Backend blocks when there are no available tasks
-			resp, err := http.Get("http://backend:8080/pending")
-			if err != nil {
-				continue
-			}
-			defer resp.Body.Close()
-			body, err := io.ReadAll(resp.Body)
-			if err != nil {
-				lgr.Warn().Err(err).Msg("GET /pending: reading response body")
-				continue
-			}
-			if err := json.Unmarshal(body, payload); err != nil {
-				invariant.Unreachable("Backend sends correct GET /pending JSON response")
-			}
-			task = Task{
-				ID:     payload.ID,
-				Input:  payload.Input,
-				Output: AllSubstrings(payload.Input),
-			}
+	// Loaded before registering, so that the worker registers their types.
+	if HANDLERS_FILE != "" {
+		external, err := LoadExternalHandlers(HANDLERS_FILE, int(CONCURRENCY), lgr)
+		if err != nil {
+			panic(err)
+		}
+		for _, handler := range external {
+			RegisterHandler(handler.task_type, handler.Run)
+			defer handler.Close()
 		}
+	}
 
-		invariant.Always(task.ID > last_id, "Task IDs increase monotically")
-		last_id = task.ID
+	run(client, int(CONCURRENCY), time.Second*time.Duration(SHUTDOWN_GRACE_SECOND), HTTP_ADDR, lgr)
+}
 
-		// === Marshal output ===
-		lgr := lgr.Clone().WithInt64("id", task.ID).WithStr("input", task.Input)
+// run registers the worker and processes tasks in n_slots slots until SIGTERM or SIGINT. It then
+// stops fetching, gives the slots up to grace to finish the tasks in hand, hands back the ones left
+// unfinished, and deregisters. A second signal kills the worker. Unless http_addr is
+// empty, /healthz, /readyz and /metrics are served on it meanwhile.
+func run(client *api.Client, n_slots int, grace time.Duration, http_addr string, lgr *itlog.Logger) {
+	session := NewSession(client, n_slots, lgr)
+	if http_addr != "" {
+		server := &http.Server{Addr: http_addr, Handler: NewServeMux(session)}
+		go func() {
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				lgr.Error(err).Str("addr", http_addr).Msg("serving /healthz, /readyz and /metrics")
+			}
+		}()
+		defer server.Close()
+	}
 
-		output_payload, err := json.Marshal(task)
-		if err != nil {
-			lgr.Error(err).Msg("json marshal task output")
-			continue
+	// fetch_ctx ends on the signal, work_ctx once the grace period is over as well.
+	fetch_ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	work_ctx, cancel_work := context.WithCancel(context.Background())
+	defer cancel_work()
+	go func() {
+		<-fetch_ctx.Done()
+		stop()
+		session.Drain()
+		lgr.Warn().Msg("shutting down. finishing the tasks in hand")
+		select {
+		case <-work_ctx.Done():
+		case <-time.After(grace):
+			lgr.Warn().Msg("shutdown grace period is over. handing back unfinished tasks")
+			cancel_work()
 		}
-		lgr.WithStr("output", string(output_payload))
+	}()
 
-		// === Commit ===
-		{
-			type Payload struct {
-				ID    int64  `json:"id"`
-				Error string `json:"error"`
-			}
-			payload := &Payload{}
-			resp, err := http.Post("http://backend:8080/processed", "application/json", bytes.NewReader(output_payload))
-			if err != nil {
-				lgr.Error(err).Msg("json marshal task output")
-				continue
-			}
-			defer resp.Body.Close()
-			body, err := io.ReadAll(resp.Body)
-			if err != nil {
-				lgr.Error(err).Msg("read POST /processed response body")
-				continue
-			}
-			if err := json.Unmarshal(body, payload); err != nil {
-				invariant.Unreachable("Backend sends correct POST /processed JSON response")
-				continue
+	if err := session.Register(fetch_ctx, 0); err != nil {
+		return
+	}
+	// Heartbeats go on while the tasks in hand are finished, or the backend would hand them out again.
+	go session.Heartbeats(work_ctx)
+	defer session.Deregister(context.Background())
+
+	wg := sync.WaitGroup{}
+	for _, slot := range session.Slots() {
+		lgr := lgr.Clone().WithInt64("slot", int64(slot.index))
+		wg.Go(func() {
+			for fetch_ctx.Err() == nil {
+				if BATCH_SIZE > 1 {
+					process_batch(fetch_ctx, work_ctx, client, session, slot, lgr)
+				} else {
+					process_one(fetch_ctx, work_ctx, client, session, slot, lgr)
+				}
 			}
-			if payload.ID < 0 || payload.Error != "" {
-				lgr.Error(fmt.Errorf("%s", payload.Error)).Msg("POST /processed")
-				continue
+		})
+	}
+	wg.Wait()
+	cancel_work()
+}
+
+// process_one is one iteration of a slot's loop using GET /pending and POST /processed. Fetching
+// stops when fetch_ctx ends, computing and committing when work_ctx does.
+func process_one(fetch_ctx, work_ctx context.Context, client *api.Client, session *Session, slot *Slot, lgr *itlog.Logger) {
+	var task api.ProcessedRequest
+
+	// === Fetch task ===
+	{
+		// Backend blocks when there are no available tasks, up to the long-poll timeout
+		slot.Enter(api.SLOT_IDLE)
+		if session.breaker.Wait(fetch_ctx) != nil {
+			return
+		}
+		generation := session.Generation()
+		pending, err := client.Pending(fetch_ctx, LONG_POLL_WAIT)
+		if err != nil {
+			if fetch_ctx.Err() == nil {
+				fetch_failed(fetch_ctx, session, slot, generation, err, "GET /pending", lgr)
 			}
+			return
+		}
+		fetch_succeeded(session, slot)
+		if pending == nil {
+			return
+		}
+		session.Hold(pending.ID)
+		slot.Enter(api.SLOT_COMPUTING)
+		var ok bool
+		if task, ok = compute(work_ctx, pending, lgr); !ok {
+			cut_short(client, session, slot, nil, []api.PendingTask{*pending}, lgr)
+			return
 		}
 	}
+
+	// Task IDs are not monotonic across fetches: a scheduled task becomes pending after tasks that
+	// were submitted later than it.
+	invariant.Always(task.ID >= 0, "Backend hands out valid task IDs")
+
+	lgr = lgr.Clone().WithInt64("id", task.ID).WithStr("input", task.Input)
+
+	// === Commit ===
+	slot.Enter(api.SLOT_COMMITTING)
+	err := client.Processed(work_ctx, &task)
+	session.Release(slot, &task, err)
+	if errors.Is(err, api.TASK_CANCELLED) {
+		lgr.Warn().Msg("task was cancelled while processing. output discarded")
+		return
+	}
+	if errors.Is(err, api.TASK_REASSIGNED) {
+		lgr.Warn().Msg("task was handed to another worker while processing. output discarded")
+		return
+	}
+	if err != nil {
+		lgr.Error(err).Msg("POST /processed")
+		hand_back(client, session, task.ID)
+		return
+	}
+}
+
+// hand_back releases tasks whose commit failed for another reason than the backend having moved
+// them on, which would otherwise stay PROCESSING until the worker dies or deregisters. The backend
+// leaves alone a task whose commit went through despite the error. work_ctx may be done by then,
+// so this gets one request timeout of its own.
+func hand_back(client *api.Client, session *Session, ids ...int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), client.Timeout)
+	defer cancel()
+	session.HandBack(ctx, ids...)
 }
 
-func AllSubstrings(s string) []string {
+// fetch_failed backs the slot off after a failed fetch, so that a backend that is down is not
+// called in a hot loop. Failures that mean the backend is unavailable also count towards opening
+// the circuit breaker.
+func fetch_failed(ctx context.Context, session *Session, slot *Slot, generation int64, err error, request string, lgr *itlog.Logger) {
+	session.Lost(ctx, generation, err)
+	if api.Retryable(err) {
+		session.breaker.Failure()
+	}
+	delay := slot.backoff.Next()
+	fetch_backoffs_total.Add(1)
+	lgr.Warn().Err(err).Int("failures", slot.backoff.Failures()).Int64("backoff_ms", delay.Milliseconds()).Int64("backoffs_total", fetch_backoffs_total.Load()).Msg(request)
+	sleep(ctx, delay)
+}
+
+func fetch_succeeded(session *Session, slot *Slot) {
+	slot.backoff.Reset()
+	session.breaker.Success()
+}
+
+// task_timeout is the shorter of the worker's and the submitter's timeouts, or 0 if neither set one.
+func task_timeout(pending *api.PendingTask) time.Duration {
+	worker := time.Second * time.Duration(TASK_TIMEOUT_SECOND)
+	submitter := time.Millisecond * time.Duration(pending.TimeoutMillisecond)
+	switch {
+	case worker == 0:
+		return submitter
+	case submitter == 0:
+		return worker
+	}
+	return min(worker, submitter)
+}
+
+// compute runs the handler of a task under its task_timeout. A handler error, including running
+// out of time, is returned as a failed task. ok is false if ctx ended because the shutdown grace
+// period is over, in which case the caller hands the task back.
+func compute(ctx context.Context, pending *api.PendingTask, lgr *itlog.Logger) (task api.ProcessedRequest, ok bool) {
+	task = api.ProcessedRequest{ID: pending.ID, Input: pending.Input}
+	task_type := cmp.Or(pending.Type, api.DEFAULT_TASK_TYPE)
+	handler, known := handler_for(pending.Type)
+	if !known {
+		// The backend only hands out the types the worker registered, unless it lost track of them.
+		task.Failure = api.FAILURE_UNKNOWN_TYPE
+		task.FailureMessage = "worker has no handler for task type " + task_type
+		task_failures_total.Inc(task.Failure)
+		lgr.Warn().Int64("id", task.ID).Str("type", task_type).Msg("task of unknown type")
+		return task, true
+	}
+	task_ctx := ctx
+	timeout := task_timeout(pending)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		task_ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	output, err := handler(task_ctx, *pending)
+	if err != nil && ctx.Err() != nil {
+		return task, false
+	}
+	if err != nil && task_ctx.Err() != nil {
+		err = fmt.Errorf("task exceeded its %s deadline: %w", timeout, err)
+	}
+	compute_seconds.Observe(time.Since(start).Seconds(), task_type)
+	if err != nil {
+		task.Failure = failure_reason(err)
+		task.FailureMessage = err.Error()
+		task_failures_total.Inc(task.Failure)
+		lgr.Warn().Int64("id", task.ID).Str("failure", task.Failure).Err(err).Msg("task failed")
+		return task, true
+	}
+	task.Output = output
+	n_bytes := 0
+	for _, s := range output {
+		n_bytes += len(s)
+	}
+	output_bytes_total.Add(float64(n_bytes), task_type)
+	return task, true
+}
+
+// MAX_PREALLOCATED_SUBSTRINGS bounds the output AllSubstrings allocates up front, so that a large
+// input grows its output as it goes rather than allocating gigabytes before its deadline is checked.
+const MAX_PREALLOCATED_SUBSTRINGS = 1 << 20
+
+// CANCELLATION_CHECK_INTERVAL is how many substrings AllSubstrings computes between checks of its
+// context. Checking each one would cost more than computing short ones.
+const CANCELLATION_CHECK_INTERVAL = 1024
+
+// AllSubstrings stops with ctx's error once ctx is done, checking every CANCELLATION_CHECK_INTERVAL
+// substrings.
+func AllSubstrings(ctx context.Context, s string) ([]string, error) {
 	if !invariant.IsRunningUnderGoTest {
-		time.Sleep(time.Millisecond * time.Duration(max(MIN_COMPUTE_DELAY_MILLISECOND, rand.Int64()%(MAX_COMPUTE_DELAY_MILLISECOND))))
+		if !sleep(ctx, time.Millisecond*time.Duration(max(MIN_COMPUTE_DELAY_MILLISECOND, rand.Int64()%(MAX_COMPUTE_DELAY_MILLISECOND)))) {
+			return nil, ctx.Err()
+		}
 	}
 	if s == "" {
 		invariant.Sometimes(true, "String to compute is empty")
-		return []string{""}
+		return []string{""}, nil
 	}
 	n := len(s)
-	out := make([]string, 0, n*(n+1)/2)
+	out := make([]string, 0, min(n*(n+1)/2, MAX_PREALLOCATED_SUBSTRINGS))
 	for i := 0; i < n; i++ {
 		for j := i + 1; j <= n; j++ {
+			if len(out)%CANCELLATION_CHECK_INTERVAL == 0 {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+			}
 			b := make([]byte, j-i)
 			copy(b, s[i:j])
 			out = append(out, string(b))
 		}
 	}
-	return out
+	return out, nil
+}
+
+// process_batch is one iteration of a slot's loop using GET /pending?max and POST /processed/batch.
+// Fetching stops when fetch_ctx ends, computing and committing when work_ctx does.
+func process_batch(fetch_ctx, work_ctx context.Context, client *api.Client, session *Session, slot *Slot, lgr *itlog.Logger) {
+	tasks := []api.ProcessedRequest{}
+
+	// === Fetch tasks ===
+	{
+		// Backend blocks until at least one task is available, up to the long-poll timeout
+		slot.Enter(api.SLOT_IDLE)
+		if session.breaker.Wait(fetch_ctx) != nil {
+			return
+		}
+		generation := session.Generation()
+		pending, err := client.PendingBatch(fetch_ctx, int(BATCH_SIZE), LONG_POLL_WAIT)
+		if err != nil {
+			if fetch_ctx.Err() == nil {
+				fetch_failed(fetch_ctx, session, slot, generation, err, "GET /pending?max", lgr)
+			}
+			return
+		}
+		fetch_succeeded(session, slot)
+		if pending == nil {
+			return
+		}
+		invariant.Always(len(pending) > 0 && int64(len(pending)) <= BATCH_SIZE, "Backend hands out a non-empty batch within the requested size")
+		for i := range pending {
+			session.Hold(pending[i].ID)
+		}
+		slot.Enter(api.SLOT_COMPUTING)
+		for i := range pending {
+			invariant.Always(pending[i].ID >= 0, "Backend hands out valid task IDs")
+			task, ok := compute(work_ctx, &pending[i], lgr)
+			if !ok {
+				cut_short(client, session, slot, tasks, pending[i:], lgr)
+				return
+			}
+			tasks = append(tasks, task)
+		}
+	}
+
+	// === Commit ===
+	commit_batch(work_ctx, client, session, slot, tasks, lgr)
+}
+
+// commit_batch commits the tasks a slot computed in one POST /processed/batch.
+func commit_batch(ctx context.Context, client *api.Client, session *Session, slot *Slot, tasks []api.ProcessedRequest, lgr *itlog.Logger) {
+	slot.Enter(api.SLOT_COMMITTING)
+	results, err := client.ProcessedBatch(ctx, tasks)
+	if err != nil {
+		ids := make([]int64, len(tasks))
+		for i := range tasks {
+			session.Release(slot, &tasks[i], err)
+			ids[i] = tasks[i].ID
+		}
+		lgr.Error(err).Int("count", len(tasks)).Msg("POST /processed/batch")
+		hand_back(client, session, ids...)
+		return
+	}
+	invariant.Always(len(results) == len(tasks), "Backend replies once per committed task")
+	failed := []int64{}
+	for i, result := range results {
+		if result.Error == "" {
+			session.Release(slot, &tasks[i], nil)
+		} else {
+			session.Release(slot, &tasks[i], result.Error)
+		}
+		lgr := lgr.Clone().WithInt64("id", result.ID)
+		switch result.Error {
+		case "":
+		case api.TASK_CANCELLED:
+			lgr.Warn().Msg("task was cancelled while processing. output discarded")
+		case api.TASK_REASSIGNED:
+			lgr.Warn().Msg("task was handed to another worker while processing. output discarded")
+		default:
+			lgr.Error(result.Error).Msg("POST /processed/batch")
+			failed = append(failed, result.ID)
+		}
+	}
+	if len(failed) > 0 {
+		hand_back(client, session, failed...)
+	}
+}
+
+// cut_short wraps up a slot whose computing was stopped by the end of the shutdown grace period:
+// it commits the tasks that were finished, hands back the unfinished ones right away, and frees
+// the slot. work_ctx is done by then, so this gets one request timeout of its own.
+func cut_short(client *api.Client, session *Session, slot *Slot, finished []api.ProcessedRequest, unfinished []api.PendingTask, lgr *itlog.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), client.Timeout)
+	defer cancel()
+	if len(finished) > 0 {
+		commit_batch(ctx, client, session, slot, finished, lgr)
+	}
+	ids := make([]int64, len(unfinished))
+	for i := range unfinished {
+		ids[i] = unfinished[i].ID
+	}
+	session.HandBack(ctx, ids...)
+	slot.Enter(api.SLOT_IDLE)
 }
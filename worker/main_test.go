@@ -1,7 +1,15 @@
 package main
 
 import (
+	"api"
+	"context"
+	"errors"
+	"io"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/james-orcales/golang_snacks/itlog"
 )
 
 // Does not handle UTF
@@ -27,7 +35,10 @@ func TestAllSubstrings(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		got := AllSubstrings(tt.in)
+		got, err := AllSubstrings(context.Background(), tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
 
 		// Verify length first
 		if len(got) != len(tt.want) {
@@ -42,3 +53,44 @@ func TestAllSubstrings(t *testing.T) {
 		}
 	}
 }
+
+func TestAllSubstringsStopsAtItsDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	start := time.Now()
+	// Tens of gigabytes of output if it ran to completion.
+	_, err := AllSubstrings(ctx, strings.Repeat("a", 5_000))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Got: %v\nWant: %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Took %s to notice a 50ms deadline", elapsed)
+	}
+}
+
+func TestComputeFailsTasksPastTheirDeadline(t *testing.T) {
+	lgr := itlog.New(io.Discard, itlog.LevelInfo)
+	pending := &api.PendingTask{ID: 1, Input: strings.Repeat("a", 5_000), TimeoutMillisecond: 50}
+	task, ok := compute(context.Background(), pending, lgr)
+	if !ok || task.Failure != api.FAILURE_DEADLINE_EXCEEDED || !strings.Contains(task.FailureMessage, "50ms deadline") {
+		t.Fatalf("Got: %t, %q %q\nWant: true, a %s failure", ok, task.Failure, task.FailureMessage, api.FAILURE_DEADLINE_EXCEEDED)
+	}
+
+	// A worker shutting down hands the task back instead.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, ok := compute(ctx, pending, lgr); ok {
+		t.Fatal("A task cut short by shutdown was reported as failed")
+	}
+
+	if timeout := task_timeout(&api.PendingTask{TimeoutMillisecond: 120_000}); timeout != time.Second*time.Duration(TASK_TIMEOUT_SECOND) {
+		t.Fatalf("Got: %s\nWant: the worker's %ds", timeout, TASK_TIMEOUT_SECOND)
+	}
+}
+
+func TestComputeFailsTasksOfUnknownType(t *testing.T) {
+	task, ok := compute(context.Background(), &api.PendingTask{ID: 1, Input: "a", Type: "no-such-type"}, itlog.New(io.Discard, itlog.LevelInfo))
+	if !ok || task.Failure != api.FAILURE_UNKNOWN_TYPE || task.Output != nil {
+		t.Fatalf("Got: %t, %q %v\nWant: true, a %s failure", ok, task.Failure, task.Output, api.FAILURE_UNKNOWN_TYPE)
+	}
+}
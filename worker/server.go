@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// NewServeMux serves the worker's health and metrics:
+//
+//   - GET /healthz is 200 while the worker's loops are going round, see Session.Alive.
+//   - GET /readyz is 200 while the worker is taking tasks, see Session.Ready. Otherwise the body
+//     says why not.
+//   - GET /metrics is in the Prometheus text format.
+func NewServeMux(session *Session) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !session.Alive(time.Now()) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("stuck\n"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		if ready, reason := session.Ready(); !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(reason + "\n"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		metrics.Render(w)
+		session_metrics(session).Render(w)
+	})
+	return mux
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"api"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/james-orcales/golang_snacks/itlog"
+)
+
+func get(t *testing.T, mux *http.ServeMux, path string) (int, string) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	return recorder.Code, recorder.Body.String()
+}
+
+func TestServeHealthReadinessAndMetrics(t *testing.T) {
+	server := httptest.NewServer(&fake_backend{})
+	defer server.Close()
+	client := api.NewClient(server.URL, "")
+	client.WorkerID = "w"
+	lgr := itlog.New(io.Discard, itlog.LevelInfo)
+	session := NewSession(client, 2, lgr)
+	mux := NewServeMux(session)
+
+	if code, _ := get(t, mux, "/healthz"); code != http.StatusOK {
+		t.Fatalf("Got: %d before registering\nWant: 200", code)
+	}
+	if code, body := get(t, mux, "/readyz"); code != http.StatusServiceUnavailable || body != "not registered\n" {
+		t.Fatalf("Got: %d %q\nWant: 503 not registered", code, body)
+	}
+	if err := session.Register(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := get(t, mux, "/readyz"); code != http.StatusOK {
+		t.Fatalf("Got: %d after registering\nWant: 200", code)
+	}
+
+	task_type := "test-metrics"
+	handlers[task_type] = func(ctx context.Context, task api.PendingTask) ([]string, error) {
+		return []string{task.Input, task.Input}, nil
+	}
+	defer delete(handlers, task_type)
+	slot := session.Slots()[1]
+	slot.Enter(api.SLOT_COMPUTING)
+	task, _ := compute(context.Background(), &api.PendingTask{ID: 1, Input: "abc", Type: task_type}, lgr)
+	session.Release(slot, &task, nil)
+
+	code, body := get(t, mux, "/metrics")
+	for _, want := range []string{
+		`worker_output_bytes_total{type="test-metrics"} 6`,
+		`worker_compute_seconds_count{type="test-metrics"} 1`,
+		`worker_slots{state="computing"} 1`,
+		`worker_slot_busy_seconds{slot="1"}`,
+		"worker_ready 1",
+	} {
+		if code != http.StatusOK || !strings.Contains(body, want) {
+			t.Fatalf("Got: %d\n%s\nWant: %s", code, body, want)
+		}
+	}
+
+	session.Drain()
+	if code, body := get(t, mux, "/readyz"); code != http.StatusServiceUnavailable || body != "draining\n" {
+		t.Fatalf("Got: %d %q\nWant: 503 draining", code, body)
+	}
+	if session.Alive(time.Now().Add(LIVENESS_TIMEOUT * 2)) {
+		t.Fatal("A heartbeat loop that stopped going round is alive")
+	}
+}
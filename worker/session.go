@@ -0,0 +1,240 @@
+package main
+
+import (
+	"api"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/james-orcales/golang_snacks/itlog"
+)
+
+// Session is the worker's registration with the backend. While registered, the worker sends
+// heartbeats carrying the tasks it holds, and the backend hands those tasks to other workers if
+// the heartbeats stop.
+type Session struct {
+	client *api.Client
+	lgr    *itlog.Logger
+	// mu serializes registrations, so that the heartbeat loop and the main loop noticing the
+	// registration was lost at the same time register once.
+	mu         sync.Mutex
+	generation atomic.Int64
+	interval   atomic.Int64
+	// connected is whether the last registration or heartbeat succeeded.
+	connected atomic.Bool
+	draining  atomic.Bool
+	// ticked is when the registration or heartbeat loop last went round, in Unix nanoseconds, or 0
+	// before the loops started.
+	ticked atomic.Int64
+
+	held_mu sync.Mutex
+	held    map[int64]struct{}
+
+	slots []*Slot
+	// breaker is shared by the slots, since they call the same backend.
+	breaker *CircuitBreaker
+}
+
+// LIVENESS_TIMEOUT is how long a round of the heartbeat loop may take beyond its interval before
+// the worker reports itself unhealthy, see Alive.
+const LIVENESS_TIMEOUT = time.Minute * 2
+
+// new_worker_id returns the hostname, which is the container ID under compose, with a random
+// suffix so that a restarted container is told apart from the one before it.
+func new_worker_id() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "worker"
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return hostname + "-" + hex.EncodeToString(suffix)
+}
+
+func NewSession(client *api.Client, n_slots int, lgr *itlog.Logger) *Session {
+	slots := make([]*Slot, n_slots)
+	for i := range slots {
+		slots[i] = NewSlot(i)
+	}
+	return &Session{
+		client:  client,
+		lgr:     lgr,
+		held:    make(map[int64]struct{}),
+		slots:   slots,
+		breaker: NewCircuitBreaker(BREAKER_THRESHOLD, BREAKER_COOLDOWN, lgr),
+	}
+}
+
+// Slots returns the worker's slots. The worker runs one loop per slot.
+func (session *Session) Slots() []*Slot {
+	return session.slots
+}
+
+// Register registers client.WorkerID, retrying until it succeeds or ctx is done. seen is the
+// Generation the caller saw fail with api.UNKNOWN_WORKER; if someone registered since, Register
+// does nothing.
+func (session *Session) Register(ctx context.Context, seen int64) error {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.generation.Load() != seen {
+		return nil
+	}
+	for {
+		session.tick()
+		resp, err := session.client.RegisterWorker(ctx, &api.RegisterWorkerRequest{ID: session.client.WorkerID, Types: HandlerTypes(), Capabilities: []string{}, Slots: len(session.slots)})
+		if err == nil {
+			session.interval.Store(resp.HeartbeatIntervalMillisecond)
+			session.connected.Store(true)
+			session.generation.Add(1)
+			session.lgr.Info().Str("worker", session.client.WorkerID).Msg("registered")
+			return nil
+		}
+		session.connected.Store(false)
+		session.lgr.Warn().Err(err).Msg("POST /workers")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// Generation counts successful registrations.
+func (session *Session) Generation() int64 {
+	return session.generation.Load()
+}
+
+// Lost re-registers if err says the backend no longer knows the worker, which happens after it
+// was declared dead or the backend restarted.
+func (session *Session) Lost(ctx context.Context, generation int64, err error) {
+	if errors.Is(err, api.UNKNOWN_WORKER) {
+		session.lgr.Warn().Msg("backend forgot this worker. registering again")
+		session.Register(ctx, generation)
+	}
+}
+
+// Heartbeats sends a heartbeat every interval the backend asked for, until ctx is done.
+func (session *Session) Heartbeats(ctx context.Context) {
+	for {
+		session.tick()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Millisecond * time.Duration(session.interval.Load())):
+		}
+		generation := session.Generation()
+		err := session.client.Heartbeat(ctx, session.client.WorkerID, session.heartbeat())
+		if ctx.Err() == nil {
+			session.connected.Store(err == nil)
+		}
+		if err != nil && ctx.Err() == nil {
+			session.lgr.Warn().Err(err).Msg("POST /workers/{worker}/heartbeat")
+			session.Lost(ctx, generation, err)
+		}
+	}
+}
+
+func (session *Session) tick() {
+	session.ticked.Store(time.Now().UnixNano())
+}
+
+// Alive reports whether the registration and heartbeat loops are still going round. They are
+// stuck once they spent LIVENESS_TIMEOUT more than a heartbeat interval on one round, which is
+// longer than the client takes to give up on a request and its retries.
+func (session *Session) Alive(now time.Time) bool {
+	ticked := session.ticked.Load()
+	if ticked == 0 {
+		return true
+	}
+	interval := time.Millisecond * time.Duration(session.interval.Load())
+	return now.Sub(time.Unix(0, ticked)) < interval+LIVENESS_TIMEOUT
+}
+
+// Ready reports whether the worker is taking tasks, and if not, why: it has not registered yet,
+// it lost the backend, or it is shutting down.
+func (session *Session) Ready() (ready bool, reason string) {
+	switch {
+	case session.draining.Load():
+		return false, "draining"
+	case session.Generation() == 0:
+		return false, "not registered"
+	case !session.connected.Load() || session.breaker.Open():
+		return false, "backend unavailable"
+	}
+	return true, ""
+}
+
+// Drain marks the worker as shutting down, so that it is no longer Ready.
+func (session *Session) Drain() {
+	session.draining.Store(true)
+}
+
+// Deregister tells the backend the worker is leaving, so that tasks it still holds are handed
+// back immediately rather than once its heartbeats are missed.
+func (session *Session) Deregister(ctx context.Context) {
+	if err := session.client.DeregisterWorker(ctx, session.client.WorkerID); err != nil {
+		session.lgr.Warn().Err(err).Msg("DELETE /workers/{worker}")
+		return
+	}
+	session.lgr.Info().Str("worker", session.client.WorkerID).Msg("deregistered")
+}
+
+// Hold records tasks taken from /pending.
+func (session *Session) Hold(ids ...int64) {
+	session.held_mu.Lock()
+	defer session.held_mu.Unlock()
+	for _, id := range ids {
+		session.held[id] = struct{}{}
+	}
+}
+
+// Release forgets a task once it is committed, and records the outcome in the stats of the slot
+// that processed it.
+func (session *Session) Release(slot *Slot, task *api.ProcessedRequest, err error) {
+	session.held_mu.Lock()
+	delete(session.held, task.ID)
+	session.held_mu.Unlock()
+	slot.Record(task, err)
+}
+
+// HandBack forgets tasks the worker will not commit, and releases them so that the backend hands
+// them out again without waiting for the worker to deregister or die.
+func (session *Session) HandBack(ctx context.Context, ids ...int64) {
+	session.held_mu.Lock()
+	for _, id := range ids {
+		delete(session.held, id)
+	}
+	session.held_mu.Unlock()
+	if err := session.client.Release(ctx, session.client.WorkerID, &api.ReleaseRequest{Tasks: ids}); err != nil {
+		// Deregistering hands them back too.
+		session.lgr.Warn().Err(err).Int("count", len(ids)).Msg("POST /workers/{worker}/release")
+		return
+	}
+	session.lgr.Info().Int("count", len(ids)).Msg("handed back tasks")
+}
+
+func (session *Session) heartbeat() *api.HeartbeatRequest {
+	session.held_mu.Lock()
+	tasks := make([]int64, 0, len(session.held))
+	for id := range session.held {
+		tasks = append(tasks, id)
+	}
+	session.held_mu.Unlock()
+	slices.Sort(tasks)
+	heartbeat := &api.HeartbeatRequest{Tasks: tasks, Slots: make([]api.SlotStats, len(session.slots))}
+	now := time.Now()
+	for i, slot := range session.slots {
+		stats := slot.Stats(now)
+		heartbeat.Slots[i] = stats
+		heartbeat.Stats.TasksProcessed += stats.Stats.TasksProcessed
+		heartbeat.Stats.TasksDiscarded += stats.Stats.TasksDiscarded
+		heartbeat.Stats.TasksFailed += stats.Stats.TasksFailed
+	}
+	return heartbeat
+}
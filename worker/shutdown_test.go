@@ -0,0 +1,192 @@
+package main
+
+import (
+	"api"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/james-orcales/golang_snacks/itlog"
+)
+
+// fake_backend hands out one task of task_type, or a batch of two to GET /pending?max, and records
+// what the worker does with them.
+type fake_backend struct {
+	task_type string
+	mu        sync.Mutex
+	handed    bool
+	// fetched_after_handing counts GET /pending calls that started after the task was handed out.
+	fetched_after_handing int
+	processed             []api.ProcessedRequest
+	released              []int64
+	deregistered          bool
+	// fail_commits makes every commit fail with a 500.
+	fail_commits bool
+}
+
+func (backend *fake_backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	if backend.fail_commits && strings.HasPrefix(r.URL.Path, api.PREFIX+"/processed") {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	switch r.Method + " " + r.URL.Path {
+	case "POST " + api.PREFIX + "/workers", "POST " + api.PREFIX + "/workers/w/heartbeat":
+		json.NewEncoder(w).Encode(&api.WorkerResponse{ID: "w", HeartbeatIntervalMillisecond: 50})
+	case "GET " + api.PREFIX + "/pending":
+		if !backend.handed {
+			backend.handed = true
+			if r.URL.Query().Has("max") {
+				json.NewEncoder(w).Encode([]api.PendingTask{{ID: 1, Input: "ab", Type: backend.task_type}, {ID: 2, Input: "cd", Type: backend.task_type}})
+				return
+			}
+			json.NewEncoder(w).Encode(&api.PendingTask{ID: 1, Input: "ab", Type: backend.task_type})
+			return
+		}
+		backend.fetched_after_handing++
+		backend.mu.Unlock()
+		// Long poll with nothing to hand out.
+		<-r.Context().Done()
+		backend.mu.Lock()
+	case "POST " + api.PREFIX + "/processed":
+		task := api.ProcessedRequest{}
+		json.NewDecoder(r.Body).Decode(&task)
+		backend.processed = append(backend.processed, task)
+		json.NewEncoder(w).Encode(&api.ProcessedResponse{ID: task.ID})
+	case "POST " + api.PREFIX + "/processed/batch":
+		tasks := []api.ProcessedRequest{}
+		json.NewDecoder(r.Body).Decode(&tasks)
+		results := []api.ProcessedResponse{}
+		for _, task := range tasks {
+			backend.processed = append(backend.processed, task)
+			results = append(results, api.ProcessedResponse{ID: task.ID})
+		}
+		json.NewEncoder(w).Encode(results)
+	case "POST " + api.PREFIX + "/workers/w/release":
+		payload := api.ReleaseRequest{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		backend.released = append(backend.released, payload.Tasks...)
+		json.NewEncoder(w).Encode(&api.WorkerResponse{ID: "w"})
+	case "DELETE " + api.PREFIX + "/workers/w":
+		backend.deregistered = true
+		json.NewEncoder(w).Encode(&api.WorkerResponse{ID: "w"})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// run_until_signalled runs the worker against backend with a handler of its own type, and sends
+// SIGTERM once the handler has started. It returns backend when run does.
+func run_until_signalled(t *testing.T, backend *fake_backend, handler Handler, grace time.Duration) *fake_backend {
+	t.Helper()
+	task_type := "test-" + t.Name()
+	started := make(chan struct{})
+	start := sync.OnceFunc(func() { close(started) })
+	handlers[task_type] = func(ctx context.Context, task api.PendingTask) ([]string, error) {
+		start()
+		return handler(ctx, task)
+	}
+	t.Cleanup(func() { delete(handlers, task_type) })
+
+	backend.task_type = task_type
+	server := httptest.NewServer(backend)
+	t.Cleanup(server.Close)
+	client := api.NewClient(server.URL, "")
+	client.WorkerID = "w"
+
+	done := make(chan struct{})
+	go func() {
+		run(client, 2, grace, "", itlog.New(io.Discard, itlog.LevelInfo))
+		close(done)
+	}()
+	select {
+	case <-started:
+	case <-time.After(time.Second * 5):
+		t.Fatal("The worker never started the task")
+	}
+	syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("The worker did not exit after SIGTERM")
+	}
+
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	if !backend.deregistered {
+		t.Fatal("The worker exited without deregistering")
+	}
+	return backend
+}
+
+func TestShutdownFinishesTheTaskInHand(t *testing.T) {
+	backend := run_until_signalled(t, &fake_backend{}, func(ctx context.Context, task api.PendingTask) ([]string, error) {
+		time.Sleep(time.Millisecond * 200)
+		return []string{task.Input}, nil
+	}, time.Second*5)
+
+	if len(backend.processed) != 1 || backend.processed[0].Output[0] != "ab" {
+		t.Fatalf("Got: %+v\nWant: task 1 committed with its output", backend.processed)
+	}
+	// The other slot was long polling when the signal came. Neither may poll again afterwards.
+	if backend.fetched_after_handing > 1 {
+		t.Fatalf("Got: %d fetches after the task was handed out\nWant: at most 1", backend.fetched_after_handing)
+	}
+}
+
+func TestShutdownHandsBackTasksPastTheGracePeriod(t *testing.T) {
+	start := time.Now()
+	backend := run_until_signalled(t, &fake_backend{}, func(ctx context.Context, task api.PendingTask) ([]string, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, time.Millisecond*100)
+
+	if len(backend.processed) != 0 || !slices.Equal(backend.released, []int64{1}) {
+		t.Fatalf("Got: %+v committed, %v released\nWant: nothing committed, task 1 released", backend.processed, backend.released)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second*2 {
+		t.Fatalf("Shutdown took %s with a grace period of 100ms", elapsed)
+	}
+}
+
+func TestShutdownCommitsTheFinishedPartOfABatch(t *testing.T) {
+	BATCH_SIZE = 2
+	t.Cleanup(func() { BATCH_SIZE = 1 })
+	backend := run_until_signalled(t, &fake_backend{}, func(ctx context.Context, task api.PendingTask) ([]string, error) {
+		if task.Input == "ab" {
+			return []string{task.Input}, nil
+		}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, time.Millisecond*100)
+
+	if len(backend.processed) != 1 || backend.processed[0].ID != 1 || !slices.Equal(backend.released, []int64{2}) {
+		t.Fatalf("Got: %+v committed, %v released\nWant: task 1 committed, task 2 released", backend.processed, backend.released)
+	}
+}
+
+func TestFailedCommitsAreHandedBack(t *testing.T) {
+	for batch_size, want := range map[int64][]int64{1: {1}, 2: {1, 2}} {
+		t.Run(fmt.Sprint("batch of ", batch_size), func(t *testing.T) {
+			BATCH_SIZE = batch_size
+			t.Cleanup(func() { BATCH_SIZE = 1 })
+			backend := run_until_signalled(t, &fake_backend{fail_commits: true}, func(ctx context.Context, task api.PendingTask) ([]string, error) {
+				return []string{task.Input}, nil
+			}, time.Second*5)
+
+			if !slices.Equal(backend.released, want) {
+				t.Fatalf("Got: %v released\nWant: %v, rather than left PROCESSING", backend.released, want)
+			}
+		})
+	}
+}
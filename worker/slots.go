@@ -0,0 +1,75 @@
+package main
+
+import (
+	"api"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Slot is one of the CONCURRENCY loops that fetch, compute and commit tasks. Each slot processes
+// one task, or one batch, at a time. Its stats are reported in heartbeats.
+type Slot struct {
+	index int
+	mu    sync.Mutex
+	// state is one of the api.SLOT_* states, entered at since.
+	state string
+	since time.Time
+	// busy is the time spent outside api.SLOT_IDLE, not counting the current state.
+	busy  time.Duration
+	stats api.WorkerStats
+	// backoff is only used by the slot's own loop.
+	backoff *Backoff
+}
+
+func NewSlot(index int) *Slot {
+	return &Slot{index: index, state: api.SLOT_IDLE, since: time.Now(), backoff: NewBackoff(FETCH_BACKOFF, MAX_FETCH_BACKOFF)}
+}
+
+// Enter moves the slot to state.
+func (slot *Slot) Enter(state string) {
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	now := time.Now()
+	if slot.state != api.SLOT_IDLE {
+		slot.busy += now.Sub(slot.since)
+	}
+	slot.state = state
+	slot.since = now
+}
+
+// Record counts the outcome of committing a task, as one of the counters in api.WorkerStats.
+func (slot *Slot) Record(task *api.ProcessedRequest, err error) {
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	switch {
+	case err == nil && task.Failure == "":
+		slot.stats.TasksProcessed++
+		tasks_processed_total.Inc()
+	case errors.Is(err, api.TASK_CANCELLED), errors.Is(err, api.TASK_REASSIGNED):
+		slot.stats.TasksDiscarded++
+		tasks_discarded_total.Inc()
+	case err == nil:
+		// The handler failed. compute counted it under its reason.
+		slot.stats.TasksFailed++
+	default:
+		slot.stats.TasksFailed++
+		task_failures_total.Inc(COMMIT_ERROR)
+	}
+}
+
+// Stats returns the slot's stats as of now.
+func (slot *Slot) Stats(now time.Time) api.SlotStats {
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	busy := slot.busy
+	if slot.state != api.SLOT_IDLE {
+		busy += now.Sub(slot.since)
+	}
+	return api.SlotStats{
+		Slot:            slot.index,
+		State:           slot.state,
+		BusyMillisecond: busy.Milliseconds(),
+		Stats:           slot.stats,
+	}
+}
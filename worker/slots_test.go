@@ -0,0 +1,43 @@
+package main
+
+import (
+	"api"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/james-orcales/golang_snacks/itlog"
+)
+
+func TestHeartbeatSumsSlotStats(t *testing.T) {
+	session := NewSession(api.NewClient("http://backend:8080", ""), 2, itlog.New(&bytes.Buffer{}, itlog.LevelInfo))
+	first, second := session.Slots()[0], session.Slots()[1]
+
+	session.Hold(1, 2, 3)
+	first.Enter(api.SLOT_COMPUTING)
+	time.Sleep(time.Millisecond * 20)
+	first.Enter(api.SLOT_COMMITTING)
+	session.Release(first, &api.ProcessedRequest{ID: 1}, nil)
+	session.Release(first, &api.ProcessedRequest{ID: 2}, api.TASK_REASSIGNED)
+	first.Enter(api.SLOT_IDLE)
+	second.Enter(api.SLOT_COMPUTING)
+	session.Release(second, &api.ProcessedRequest{ID: 3, Failure: api.FAILURE_HANDLER_ERROR}, nil)
+
+	heartbeat := session.heartbeat()
+	if len(heartbeat.Tasks) != 0 {
+		t.Fatalf("Got: %v still held\nWant: none", heartbeat.Tasks)
+	}
+	want := api.WorkerStats{TasksProcessed: 1, TasksDiscarded: 1, TasksFailed: 1}
+	if heartbeat.Stats != want {
+		t.Fatalf("Got: %+v\nWant: %+v", heartbeat.Stats, want)
+	}
+	if len(heartbeat.Slots) != 2 {
+		t.Fatalf("Got: %d slots\nWant: 2", len(heartbeat.Slots))
+	}
+	if slot := heartbeat.Slots[0]; slot.State != api.SLOT_IDLE || slot.BusyMillisecond < 20 || slot.Stats.TasksProcessed != 1 {
+		t.Fatalf("Got: %+v\nWant: idle after 20ms busy, with 1 task processed", slot)
+	}
+	if slot := heartbeat.Slots[1]; slot.Slot != 1 || slot.State != api.SLOT_COMPUTING || slot.Stats.TasksFailed != 1 {
+		t.Fatalf("Got: %+v\nWant: slot 1 computing, with 1 task failed", slot)
+	}
+}
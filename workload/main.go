@@ -1,10 +1,10 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"api"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"math/rand"
 	"net/http"
 	"os"
@@ -32,11 +32,23 @@ var (
 	REQUESTS_PER_SECOND = get_env_int("REQUESTS_PER_SECOND")
 	MAX_TASKS_CREATED   = get_env_int("MAX_TASKS_CREATED")
 	MAX_STRING_LENGTH   = get_env_int("MAX_STRING_LENGTH")
+	// API_KEY authenticates the workload to the backend. It must have the client role.
+	API_KEY = os.Getenv("API_KEY")
+)
+
+const (
+	SUBMIT_MAX_RETRIES = 5
+	// Upper bound on the wait before reopening a broken event stream.
+	MAX_RECONNECT_DELAY = time.Second * 30
 )
 
 func main() {
 	runtime.GOMAXPROCS(1)
 
+	client := api.NewClient("http://backend:8080", API_KEY)
+	client.MaxRetries = SUBMIT_MAX_RETRIES
+	ctx := context.Background()
+
 	type Task struct {
 		ID    int64  `json:"id"`
 		Input string `json:"input"`
@@ -48,6 +60,8 @@ func main() {
 		pending_count    int
 		processing_count int
 		finished_count   int
+		failed_count     int
+		lost_count       int
 		count_mu         sync.RWMutex
 	)
 
@@ -59,10 +73,12 @@ func main() {
 			}
 			count_mu.RLock()
 			fmt.Printf(
-				"PENDING=%d PROCESSING=%d FINISHED=%d\n",
+				"PENDING=%d PROCESSING=%d FINISHED=%d FAILED=%d LOST=%d\n",
 				pending_count,
 				processing_count,
 				finished_count,
+				failed_count,
+				lost_count,
 			)
 			count_mu.RUnlock()
 		}
@@ -84,135 +100,165 @@ func main() {
 			var task Task
 			// === Submit ===
 			{
-				type Payload struct {
-					Data string `json:"data"`
-				}
-				type Response struct {
-					ID    int64  `json:"id"`
-					Error string `json:"error"`
-				}
-				// === Implementation ===
-				response_payload := &Response{}
-				{
-					request_payload := Payload{Data: rand_string()}
-					b, _ := json.Marshal(request_payload)
-					resp, err := http.Post("http://backend:8080/submit", "application/json", bytes.NewBuffer(b))
-					if err != nil {
-						return
+				// Retries reuse the key so that the backend returns the original task instead of
+				// creating a duplicate when only the response was lost.
+				idempotency_key := fmt.Sprintf("%016x%016x", rand.Uint64(), rand.Uint64())
+				payload := &api.SubmitRequest{Data: rand_string()}
+				var id int64
+				for {
+					var err error
+					id, _, err = client.Submit(ctx, payload, idempotency_key)
+					api_err := &api.Error{}
+					if errors.As(err, &api_err) && api_err.StatusCode == http.StatusTooManyRequests {
+						// Admission control pushed back for longer than the client retries for. This is
+						// not a failure, so keep waiting.
+						time.Sleep(max(api_err.RetryAfter, time.Second))
+						continue
 					}
-					body, err := io.ReadAll(resp.Body)
 					if err != nil {
-						panic(err)
-					}
-					if err := json.Unmarshal(body, response_payload); err != nil {
-						panic(err)
+						return
 					}
-					resp.Body.Close()
-				}
-				if response_payload.ID < 0 || response_payload.Error != "" {
-					panic(fmt.Errorf(response_payload.Error))
+					break
 				}
 				tasks_mu.Lock()
-				task = Task{ID: response_payload.ID}
+				task = Task{ID: id}
 				tasks = append(tasks, &task)
 				tasks_mu.Unlock()
 			}
-			// === Fetch status ===
+			// === Watch status ===
 			{
-				type Payload struct {
-					ID     int64    `json:"id"`
-					Status string   `json:"status"`
-					Input  string   `json:"input"`
-					Output []string `json:"output"`
-					Error  string   `json:"error"`
-				}
 				task := task
 				previous_status := ""
-				for backoff := time.Duration(0); true; backoff *= 2 {
-					if backoff == 0 {
-						backoff++
-					} else {
-						time.Sleep(time.Second * backoff)
-					}
-					resp, err := http.Get(fmt.Sprintf("http://backend:8080/status/%d", task.ID))
-					if err != nil {
-						continue
-					}
-					body, err := io.ReadAll(resp.Body)
-					if err != nil {
-						continue
-					}
-					resp.Body.Close()
-					payload := &Payload{}
-					if err := json.Unmarshal(body, payload); err != nil {
-						invariant.Unreachable("Backend sent a valid payload")
-					}
-					invariant.Always(payload.ID == task.ID, "Backend replied with corresponding task")
-					invariant.Always(payload.Input == task.Input, "Corresponding task has matching input")
+				// observe applies a status to the counters and reports whether the task is done. The
+				// event stream only guarantees the latest status, so any earlier status may be skipped.
+				observe := func(status string) (done bool) {
 					invariant.Always(
-						payload.Status == "PENDING" || payload.Status == "PROCESSING" || payload.Status == "FINISHED",
+						status == api.STATUS_PENDING || status == api.STATUS_PROCESSING || status == api.STATUS_FINISHED || status == api.STATUS_FAILED,
 						"Backend replied with a valid status",
 					)
-
+					defer func() { previous_status = status }()
 					if previous_status == "" {
 						count_mu.Lock()
-						switch payload.Status {
+						defer count_mu.Unlock()
+						switch status {
 						default:
 							panic("unreachable")
-						case "PENDING":
+						case api.STATUS_PENDING:
 							pending_count++
-							count_mu.Unlock()
-						case "PROCESSING":
+						case api.STATUS_PROCESSING:
 							processing_count++
-							count_mu.Unlock()
-						case "FINISHED":
+						case api.STATUS_FINISHED:
 							finished_count++
+							return true
+						case api.STATUS_FAILED:
+							failed_count++
+							return true
+						}
+						return false
+					}
+					switch status {
+					default:
+						panic("unreachable")
+					case api.STATUS_PENDING:
+						invariant.Always(
+							previous_status == api.STATUS_PENDING || previous_status == api.STATUS_PROCESSING,
+							"Task is still pending, or was handed back after a failed delivery",
+						)
+						if previous_status == api.STATUS_PROCESSING {
+							count_mu.Lock()
+							invariant.Always(processing_count > 0, "Some tasks are processing")
+							processing_count--
+							pending_count++
 							count_mu.Unlock()
-							return
 						}
-					} else {
-						switch payload.Status {
-						default:
-							panic("unreachable")
-						case "PENDING":
-							invariant.Always(previous_status == "PENDING", "Task is still pending")
-							invariant.Always(pending_count > 0, "Some tasks are pending")
-						case "PROCESSING":
-							invariant.Always(
-								previous_status == "PENDING" || previous_status == "PROCESSING",
-								"Task transitioned from pending, or is still processing",
-							)
-							if previous_status == "PENDING" {
-								invariant.Always(pending_count > 0, "Some tasks are pending")
-								count_mu.Lock()
-								pending_count--
-								processing_count++
-								count_mu.Unlock()
-							} else {
-								invariant.Always(processing_count > 0, "Some tasks are processing")
-							}
-						case "FINISHED":
-							invariant.Always(
-								previous_status == "PENDING" || previous_status == "PROCESSING",
-								"Task could be finished from any previous state",
-							)
+					case api.STATUS_PROCESSING:
+						invariant.Always(
+							previous_status == api.STATUS_PENDING || previous_status == api.STATUS_PROCESSING,
+							"Task transitioned from pending, or is still processing",
+						)
+						if previous_status == api.STATUS_PENDING {
 							count_mu.Lock()
-							finished_count++
-							if previous_status == "PENDING" {
-								invariant.Always(pending_count > 0, "Some tasks are pending")
-								pending_count--
-							} else {
-								invariant.Always(processing_count > 0, "Some tasks are processing")
-								processing_count--
-							}
+							invariant.Always(pending_count > 0, "Some tasks are pending")
+							pending_count--
+							processing_count++
 							count_mu.Unlock()
+						}
+					case api.STATUS_FINISHED, api.STATUS_FAILED:
+						invariant.Always(
+							previous_status == api.STATUS_PENDING || previous_status == api.STATUS_PROCESSING,
+							"Task could be finished from any previous state",
+						)
+						count_mu.Lock()
+						if status == api.STATUS_FINISHED {
+							finished_count++
+						} else {
+							failed_count++
+						}
+						if previous_status == api.STATUS_PENDING {
+							invariant.Always(pending_count > 0, "Some tasks are pending")
+							pending_count--
+						} else {
+							invariant.Always(processing_count > 0, "Some tasks are processing")
+							processing_count--
+						}
+						count_mu.Unlock()
+						return true
+					}
+					return false
+				}
+
+				// lose stops watching a task the backend no longer knows, which is not a bug in the
+				// backend when it restarted or evicted the task.
+				lose := func(err error) {
+					fmt.Printf("task %d lost: %v\n", task.ID, err)
+					count_mu.Lock()
+					defer count_mu.Unlock()
+					switch previous_status {
+					case api.STATUS_PENDING:
+						pending_count--
+					case api.STATUS_PROCESSING:
+						processing_count--
+					}
+					lost_count++
+				}
+
+				// The stream ends by itself once the task is finished. Reconnecting only happens when
+				// the connection breaks, and replays the current status first.
+				for failures := 0; ; {
+					if failures > 0 {
+						time.Sleep(min(MAX_RECONNECT_DELAY, time.Second<<min(failures-1, 6)))
+					}
+					stream, err := client.Events(ctx, task.ID)
+					if err != nil && !api.Retryable(err) {
+						lose(err)
+						return
+					}
+					if err != nil {
+						failures++
+						continue
+					}
+					failures = 0
+					done := false
+					for !done {
+						event, err := stream.Next()
+						if err != nil {
+							break
+						}
+						invariant.Always(event.ID == task.ID, "Backend replied with corresponding task")
+						if event.Error != "" {
+							stream.Close()
+							lose(event.Error)
 							return
 						}
+						done = observe(event.Status)
 					}
-					previous_status = payload.Status
+					stream.Close()
+					if done {
+						return
+					}
+					failures++
 				}
 			}
-
 		}()
 	}
 	wg.Wait()